@@ -29,6 +29,9 @@ type EdgeMeshAgentConfig struct {
 	// KubeAPIConfig indicates the kubernetes cluster info which edgeMeshAgent will connected
 	// +Required
 	KubeAPIConfig *v1alpha1.KubeAPIConfig `json:"kubeAPIConfig,omitempty"`
+	// CommonConfig indicates common config for all modules
+	// +Required
+	CommonConfig *CommonConfig `json:"commonConfig,omitempty"`
 	// GoChassisConfig defines some configurations related to go-chassis
 	// +Required
 	GoChassisConfig *chassisconfig.GoChassisConfig `json:"goChassisConfig,omitempty"`
@@ -37,6 +40,30 @@ type EdgeMeshAgentConfig struct {
 	Modules *Modules `json:"modules,omitempty"`
 }
 
+// CommonConfig defines some common configuration items
+type CommonConfig struct {
+	// ConfigureDummyDevice indicates whether edgeMeshAgent creates and manages a dummy device,
+	// if enabled, edgedns and edgeproxy will listen on it instead of their ListenInterface
+	// default false
+	ConfigureDummyDevice bool `json:"configureDummyDevice,omitempty"`
+	// DummyDeviceName indicates the name of the dummy device
+	// default "edgemesh0"
+	DummyDeviceName string `json:"dummyDeviceName,omitempty"`
+	// DummyDeviceIP indicates the ip bound to the dummy device, a link-local address is recommended
+	// default "169.254.96.16"
+	DummyDeviceIP string `json:"dummyDeviceIP,omitempty"`
+	// MetricsAddress indicates the address to serve metrics on, e.g. "127.0.0.1:10551",
+	// the metrics are exposed in json at path /debug/vars, an empty address disables it
+	// default ""
+	MetricsAddress string `json:"metricsAddress,omitempty"`
+	// HandoffSocket indicates the unix socket on which the listening sockets are handed off
+	// to the agent replacing this one, e.g. in a rolling update. It must be on a host path
+	// shared by the old and new pods, and differ between agents with different modules
+	// on the same host. An empty path disables it
+	// default "/run/edgemesh/handoff.sock"
+	HandoffSocket string `json:"handoffSocket,omitempty"`
+}
+
 // Modules indicates the modules of edgeMeshAgent will be use
 type Modules struct {
 	// EdgeDNSConfig indicates edgedns module config
@@ -61,6 +88,13 @@ func NewEdgeMeshAgentConfig() *EdgeMeshAgentConfig {
 			Burst:       constants.DefaultKubeBurst,
 			KubeConfig:  constants.DefaultKubeConfig,
 		},
+		CommonConfig: &CommonConfig{
+			ConfigureDummyDevice: false,
+			DummyDeviceName:      "edgemesh0",
+			DummyDeviceIP:        "169.254.96.16",
+			MetricsAddress:       "",
+			HandoffSocket:        "/run/edgemesh/handoff.sock",
+		},
 		GoChassisConfig: chassisconfig.NewGoChassisConfig(),
 		Modules: &Modules{
 			EdgeDNSConfig:     dnsconfig.NewEdgeDNSConfig(),
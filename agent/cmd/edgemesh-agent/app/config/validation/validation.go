@@ -1,6 +1,9 @@
 package validation
 
 import (
+	"net"
+	"path/filepath"
+
 	"k8s.io/apimachinery/pkg/util/validation/field"
 
 	ccvalidation "github.com/kubeedge/kubeedge/pkg/apis/componentconfig/cloudcore/v1alpha1/validation"
@@ -11,5 +14,32 @@ import (
 func ValidateEdgeMeshAgentConfiguration(c *config.EdgeMeshAgentConfig) field.ErrorList {
 	allErrs := field.ErrorList{}
 	allErrs = append(allErrs, ccvalidation.ValidateKubeAPIConfig(*c.KubeAPIConfig)...)
+	allErrs = append(allErrs, ValidateCommonConfig(c.CommonConfig)...)
+	return allErrs
+}
+
+// ValidateCommonConfig validates `c` and returns an errorList if it is invalid
+func ValidateCommonConfig(c *config.CommonConfig) field.ErrorList {
+	allErrs := field.ErrorList{}
+	if c == nil {
+		return allErrs
+	}
+	if c.MetricsAddress != "" {
+		if _, _, err := net.SplitHostPort(c.MetricsAddress); err != nil {
+			allErrs = append(allErrs, field.Invalid(field.NewPath("metricsAddress"), c.MetricsAddress, err.Error()))
+		}
+	}
+	if c.HandoffSocket != "" && !filepath.IsAbs(c.HandoffSocket) {
+		allErrs = append(allErrs, field.Invalid(field.NewPath("handoffSocket"), c.HandoffSocket, "handoffSocket must be an absolute path"))
+	}
+	if !c.ConfigureDummyDevice {
+		return allErrs
+	}
+	if c.DummyDeviceName == "" {
+		allErrs = append(allErrs, field.Required(field.NewPath("dummyDeviceName"), "dummyDeviceName must be set when configureDummyDevice is enabled"))
+	}
+	if ip := net.ParseIP(c.DummyDeviceIP); ip == nil || ip.To4() == nil {
+		allErrs = append(allErrs, field.Invalid(field.NewPath("dummyDeviceIP"), c.DummyDeviceIP, "dummyDeviceIP must be a valid ipv4 address"))
+	}
 	return allErrs
 }
@@ -2,6 +2,8 @@ package app
 
 import (
 	"fmt"
+	"net"
+	"strings"
 
 	"github.com/spf13/cobra"
 	"k8s.io/apimachinery/pkg/util/wait"
@@ -22,8 +24,11 @@ import (
 	"github.com/kubeedge/edgemesh/agent/pkg/chassis"
 	"github.com/kubeedge/edgemesh/agent/pkg/dns"
 	"github.com/kubeedge/edgemesh/agent/pkg/gateway"
+	"github.com/kubeedge/edgemesh/agent/pkg/handoff"
 	"github.com/kubeedge/edgemesh/agent/pkg/proxy"
 	"github.com/kubeedge/edgemesh/common/informers"
+	"github.com/kubeedge/edgemesh/common/modules"
+	meshutil "github.com/kubeedge/edgemesh/common/util"
 )
 
 func NewEdgeMeshAgentCommand() *cobra.Command {
@@ -92,12 +97,57 @@ func Run(cfg *config.EdgeMeshAgentConfig) error {
 	}
 	trace++
 
+	if cfg.CommonConfig.ConfigureDummyDevice {
+		klog.Infof("[%d] Prepare dummy device %s", trace, cfg.CommonConfig.DummyDeviceName)
+		if err := prepareDummyDevice(cfg); err != nil {
+			return err
+		}
+		defer func() {
+			// the new agent keeps using the dummy device after handed off
+			if handoff.HandedOff() {
+				return
+			}
+			if err := meshutil.DeleteDummyDevice(cfg.CommonConfig.DummyDeviceName); err != nil {
+				klog.Errorf("clean dummy device err: %v", err)
+			}
+		}()
+		trace++
+	}
+
+	handoffSocket := cfg.CommonConfig.HandoffSocket
+	if handoffSocket != "" {
+		klog.Infof("[%d] Inherit listening sockets from %s", trace, handoffSocket)
+		if err := handoff.Receive(handoffSocket, handoffIdentity(cfg)); err != nil {
+			// the modules listen by themselves
+			klog.Warningf("inherit listening sockets err: %v", err)
+		}
+		trace++
+	}
+
+	// the metrics listener of the previous agent is inherited like the ones of the
+	// modules, listening by itself fails since the address is still in use
+	if cfg.CommonConfig.MetricsAddress != "" {
+		klog.Infof("[%d] Serve metrics on %s", trace, cfg.CommonConfig.MetricsAddress)
+		if err := serveMetrics(cfg.CommonConfig.MetricsAddress); err != nil {
+			return err
+		}
+		trace++
+	}
+
 	klog.Infof("[%d] Register beehive modules", trace)
 	if errs := registerModules(cfg, ifm); len(errs) > 0 {
 		return fmt.Errorf(util.SpliceErrors(errs))
 	}
 	trace++
 
+	if handoffSocket != "" {
+		klog.Infof("[%d] Serve listening sockets handoff on %s", trace, handoffSocket)
+		if err := handoff.Serve(handoffSocket, handoffIdentity(cfg)); err != nil {
+			return err
+		}
+		trace++
+	}
+
 	// As long as either the proxy module or the gateway module is enabled,
 	// the go-chassis plugins must also be install.
 	if cfg.Modules.EdgeProxyConfig.Enable || cfg.Modules.EdgeGatewayConfig.Enable {
@@ -110,13 +160,72 @@ func Run(cfg *config.EdgeMeshAgentConfig) error {
 	ifm.Start(wait.NeverStop)
 	trace++
 
+	if handoffSocket != "" {
+		// the caches are synced, the agent handing off keeps serving until the
+		// modules are started and claim the inherited sockets
+		go handoff.Ready()
+	}
+
 	klog.Infof("[%d] Start all modules", trace)
 	core.Run()
 
+	// beehive returns once the modules are signaled, wait for their cleanups
+	modules.WaitShutdownTasks()
+
 	klog.Infof("edgemesh-agent exited")
 	return nil
 }
 
+// prepareDummyDevice creates the dummy device and makes edgedns and edgeproxy listen on it
+func prepareDummyDevice(c *config.EdgeMeshAgentConfig) error {
+	name := c.CommonConfig.DummyDeviceName
+	if _, err := meshutil.EnsureDummyDevice(name, c.CommonConfig.DummyDeviceIP); err != nil {
+		return fmt.Errorf("prepare dummy device err: %v", err)
+	}
+	c.Modules.EdgeDNSConfig.ListenInterface = name
+	c.Modules.EdgeProxyConfig.ListenInterface = name
+	return nil
+}
+
+// serveMetrics serves the metrics on the listener inherited from the previous agent
+// or a new one, and stops serving once the listener is handed off to a new agent
+func serveMetrics(addr string) error {
+	name := handoff.MetricsListener(addr)
+	ln, ok := handoff.Listener(name)
+	if !ok {
+		tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+		if err != nil {
+			return fmt.Errorf("resolve metrics address %s err: %v", addr, err)
+		}
+		if ln, err = net.ListenTCP("tcp", tcpAddr); err != nil {
+			return fmt.Errorf("listen metrics address %s err: %v", addr, err)
+		}
+	}
+	handoff.Register(name, ln)
+	meshutil.ServeMetrics(ln)
+	go func() {
+		<-handoff.Done()
+		handoff.Unregister(name)
+		ln.Close()
+	}()
+	return nil
+}
+
+// handoffIdentity identifies the agents able to take over the sockets of each other
+func handoffIdentity(c *config.EdgeMeshAgentConfig) string {
+	var enabled []string
+	if c.Modules.EdgeDNSConfig.Enable {
+		enabled = append(enabled, modules.EdgeDNSModuleName)
+	}
+	if c.Modules.EdgeProxyConfig.Enable {
+		enabled = append(enabled, modules.EdgeProxyModuleName)
+	}
+	if c.Modules.EdgeGatewayConfig.Enable {
+		enabled = append(enabled, modules.EdgeGatewayModuleName)
+	}
+	return strings.Join(enabled, ",")
+}
+
 // registerModules register all the modules started in edgemesh-agent
 func registerModules(c *config.EdgeMeshAgentConfig, ifm *informers.Manager) []error {
 	var errs []error
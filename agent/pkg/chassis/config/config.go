@@ -18,9 +18,18 @@ type Protocol struct {
 	// TCPClientTimeout indicates 4-layer tcp client timeout, the unit is second.
 	// default 2
 	TCPClientTimeout int `json:"tcpClientTimeout,omitempty"`
-	// TCPReconnectTimes indicates 4-layer tcp reconnect times
+	// TCPReconnectTimes indicates 4-layer tcp reconnect times, each attempt dials
+	// an instance the previous attempts haven't failed if there's any
 	// default 3
 	TCPReconnectTimes int `json:"tcpReconnectTimes,omitempty"`
+	// TCPKeepAlivePeriod indicates 4-layer tcp keepalive period, the unit is second.
+	// keepalive is disabled if it's 0 or negative
+	// default 15
+	TCPKeepAlivePeriod int `json:"tcpKeepAlivePeriod,omitempty"`
+	// TCPIdleTimeout indicates how long an idle 4-layer tcp connection is kept, the unit is second.
+	// 0 means never timeout
+	// default 0
+	TCPIdleTimeout int `json:"tcpIdleTimeout,omitempty"`
 }
 
 // LoadBalancer indicates the loadbalance strategy in edgemesh
@@ -29,10 +38,12 @@ type LoadBalancer struct {
 	// default "RoundRobin"
 	DefaultLBStrategy string `json:"defaultLBStrategy,omitempty"`
 	// SupportedLBStrategies indicates supported load balance strategies name
-	// default []string{"RoundRobin", "Random", "ConsistentHash"}
+	// default []string{"RoundRobin", "Random", "ConsistentHash", "LeastConn", "LeastLatency"}
 	SupportedLBStrategies []string `json:"supportLBStrategies,omitempty"`
 	// ConsistentHash indicates the extension of the go-chassis loadbalancer
 	ConsistentHash *ConsistentHash `json:"consistentHash,omitempty"`
+	// Latency indicates the extension of the go-chassis loadbalancer
+	Latency *Latency `json:"latency,omitempty"`
 }
 
 // ConsistentHash strategy is an extension of the go-chassis loadbalancer
@@ -50,21 +61,45 @@ type ConsistentHash struct {
 	Load float64 `json:"load,omitempty"`
 }
 
+// Latency strategy is an extension of the go-chassis loadbalancer, it prefers
+// the instances with the lowest connect latency
+type Latency struct {
+	// ProbeInterval indicates the interval to probe the connect latency of instances,
+	// the unit is second. 0 means only the actual tcp and mqtt dials are measured, and the
+	// instances of http services are picked in turn
+	// default 10
+	ProbeInterval int `json:"probeInterval,omitempty"`
+	// SmoothingFactor indicates the weight of the latest sample in the EWMA of latency, in (0, 1]
+	// default 0.3
+	SmoothingFactor float64 `json:"smoothingFactor,omitempty"`
+	// Tolerance indicates how much higher than the lowest latency, in ratio, an instance
+	// can be picked, so the load is spread among the instances with similar latency
+	// default 0.2
+	Tolerance float64 `json:"tolerance,omitempty"`
+}
+
 func NewGoChassisConfig() *GoChassisConfig {
 	return &GoChassisConfig{
 		Protocol: &Protocol{
-			TCPBufferSize:     8192,
-			TCPClientTimeout:  2,
-			TCPReconnectTimes: 3,
+			TCPBufferSize:      8192,
+			TCPClientTimeout:   2,
+			TCPReconnectTimes:  3,
+			TCPKeepAlivePeriod: 15,
+			TCPIdleTimeout:     0,
 		},
 		LoadBalancer: &LoadBalancer{
 			DefaultLBStrategy:     "RoundRobin",
-			SupportedLBStrategies: []string{"RoundRobin", "Random", "ConsistentHash"},
+			SupportedLBStrategies: []string{"RoundRobin", "Random", "ConsistentHash", "LeastConn", "LeastLatency"},
 			ConsistentHash: &ConsistentHash{
 				PartitionCount:    100,
 				ReplicationFactor: 10,
 				Load:              1.25,
 			},
+			Latency: &Latency{
+				ProbeInterval:   10,
+				SmoothingFactor: 0.3,
+				Tolerance:       0.2,
+			},
 		},
 	}
 }
@@ -25,26 +25,33 @@ var (
 )
 
 type ChassisController struct {
-	podLister k8slisters.PodLister
-	svcLister k8slisters.ServiceLister
-	epLister  k8slisters.EndpointsLister
-	drLister  istiolisters.DestinationRuleLister
+	podLister  k8slisters.PodLister
+	svcLister  k8slisters.ServiceLister
+	epLister   k8slisters.EndpointsLister
+	nodeLister k8slisters.NodeLister
+	drLister   istiolisters.DestinationRuleLister
+	vsLister   istiolisters.VirtualServiceLister
 
-	epInformer cache.SharedIndexInformer
-	drInformer cache.SharedIndexInformer
+	epInformer   cache.SharedIndexInformer
+	nodeInformer cache.SharedIndexInformer
+	drInformer   cache.SharedIndexInformer
 }
 
 func Init(ifm *informers.Manager) {
 	once.Do(func() {
 		APIConn = &ChassisController{
-			podLister:  ifm.GetKubeFactory().Core().V1().Pods().Lister(),
-			svcLister:  ifm.GetKubeFactory().Core().V1().Services().Lister(),
-			epLister:   ifm.GetKubeFactory().Core().V1().Endpoints().Lister(),
-			drLister:   ifm.GetIstioFactory().Networking().V1alpha3().DestinationRules().Lister(),
-			epInformer: ifm.GetKubeFactory().Core().V1().Endpoints().Informer(),
-			drInformer: ifm.GetIstioFactory().Networking().V1alpha3().DestinationRules().Informer(),
+			podLister:    ifm.GetKubeFactory().Core().V1().Pods().Lister(),
+			svcLister:    ifm.GetKubeFactory().Core().V1().Services().Lister(),
+			epLister:     ifm.GetKubeFactory().Core().V1().Endpoints().Lister(),
+			nodeLister:   ifm.GetKubeFactory().Core().V1().Nodes().Lister(),
+			drLister:     ifm.GetIstioFactory().Networking().V1alpha3().DestinationRules().Lister(),
+			vsLister:     ifm.GetIstioFactory().Networking().V1alpha3().VirtualServices().Lister(),
+			epInformer:   ifm.GetKubeFactory().Core().V1().Endpoints().Informer(),
+			nodeInformer: ifm.GetKubeFactory().Core().V1().Nodes().Informer(),
+			drInformer:   ifm.GetIstioFactory().Networking().V1alpha3().DestinationRules().Informer(),
 		}
 		ifm.RegisterInformer(APIConn.epInformer)
+		ifm.RegisterInformer(APIConn.nodeInformer)
 		ifm.RegisterInformer(APIConn.drInformer)
 		ifm.RegisterSyncedFunc(APIConn.onCacheSynced)
 	})
@@ -69,10 +76,18 @@ func (c *ChassisController) GetEpLister() k8slisters.EndpointsLister {
 	return c.epLister
 }
 
+func (c *ChassisController) GetNodeLister() k8slisters.NodeLister {
+	return c.nodeLister
+}
+
 func (c *ChassisController) GetDrLister() istiolisters.DestinationRuleLister {
 	return c.drLister
 }
 
+func (c *ChassisController) GetVsLister() istiolisters.VirtualServiceLister {
+	return c.vsLister
+}
+
 func (c *ChassisController) epUpdate(oldObj, newObj interface{}) {
 	ep, ok := newObj.(*v1.Endpoints)
 	if !ok {
@@ -140,8 +155,22 @@ func (c *ChassisController) drDelete(obj interface{}) {
 	}
 }
 
-func isConsistentHashLB(dr *istioapi.DestinationRule) (ok bool) {
-	switch dr.Spec.TrafficPolicy.LoadBalancer.LbPolicy.(type) {
+// isConsistentHashLB returns true if the destination rule or any of its subsets
+// balances the load by consistent hash
+func isConsistentHashLB(dr *istioapi.DestinationRule) bool {
+	if isConsistentHashPolicy(dr.Spec.TrafficPolicy) {
+		return true
+	}
+	for _, subset := range dr.Spec.Subsets {
+		if isConsistentHashPolicy(subset.GetTrafficPolicy()) {
+			return true
+		}
+	}
+	return false
+}
+
+func isConsistentHashPolicy(policy *apiv1alpha3.TrafficPolicy) (ok bool) {
+	switch policy.GetLoadBalancer().GetLbPolicy().(type) {
 	case *apiv1alpha3.LoadBalancerSettings_ConsistentHash:
 		ok = true
 	default:
@@ -0,0 +1,59 @@
+package controller
+
+import (
+	"fmt"
+
+	apiv1alpha3 "istio.io/api/networking/v1alpha3"
+)
+
+// GetSubset returns the subset of the destination rule bound to the service
+func (c *ChassisController) GetSubset(namespace, name, subset string) (*apiv1alpha3.Subset, error) {
+	dr, err := c.drLister.DestinationRules(namespace).Get(name)
+	if err != nil {
+		return nil, fmt.Errorf("get destination rule %s.%s err: %v", namespace, name, err)
+	}
+	for _, s := range dr.Spec.Subsets {
+		if s.Name == subset {
+			return s, nil
+		}
+	}
+	return nil, fmt.Errorf("subset %s not found in destination rule %s.%s", subset, namespace, name)
+}
+
+// GetTrafficPolicy returns the traffic policy of the service or its subset, the
+// policies specified by the subset override the ones of the destination rule.
+// nil is returned if there's no destination rule bound to the service.
+func (c *ChassisController) GetTrafficPolicy(namespace, name, subset string) *apiv1alpha3.TrafficPolicy {
+	dr, err := c.drLister.DestinationRules(namespace).Get(name)
+	if err != nil {
+		return nil
+	}
+	policy := &apiv1alpha3.TrafficPolicy{}
+	if dr.Spec.TrafficPolicy != nil {
+		*policy = *dr.Spec.TrafficPolicy
+	}
+	if subset == "" {
+		return policy
+	}
+	for _, s := range dr.Spec.Subsets {
+		if s.Name != subset || s.TrafficPolicy == nil {
+			continue
+		}
+		if s.TrafficPolicy.LoadBalancer != nil {
+			policy.LoadBalancer = s.TrafficPolicy.LoadBalancer
+		}
+		if s.TrafficPolicy.ConnectionPool != nil {
+			policy.ConnectionPool = s.TrafficPolicy.ConnectionPool
+		}
+		if s.TrafficPolicy.OutlierDetection != nil {
+			policy.OutlierDetection = s.TrafficPolicy.OutlierDetection
+		}
+		if s.TrafficPolicy.Tls != nil {
+			policy.Tls = s.TrafficPolicy.Tls
+		}
+		if s.TrafficPolicy.PortLevelSettings != nil {
+			policy.PortLevelSettings = s.TrafficPolicy.PortLevelSettings
+		}
+	}
+	return policy
+}
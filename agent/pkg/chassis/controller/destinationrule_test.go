@@ -0,0 +1,66 @@
+package controller
+
+import (
+	"testing"
+
+	apiv1alpha3 "istio.io/api/networking/v1alpha3"
+	istioapi "istio.io/client-go/pkg/apis/networking/v1alpha3"
+	istiolisters "istio.io/client-go/pkg/listers/networking/v1alpha3"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestGetTrafficPolicy(t *testing.T) {
+	roundRobin := &apiv1alpha3.LoadBalancerSettings{
+		LbPolicy: &apiv1alpha3.LoadBalancerSettings_Simple{Simple: apiv1alpha3.LoadBalancerSettings_ROUND_ROBIN},
+	}
+	random := &apiv1alpha3.LoadBalancerSettings{
+		LbPolicy: &apiv1alpha3.LoadBalancerSettings_Simple{Simple: apiv1alpha3.LoadBalancerSettings_RANDOM},
+	}
+	pool := &apiv1alpha3.ConnectionPoolSettings{Tcp: &apiv1alpha3.ConnectionPoolSettings_TCPSettings{MaxConnections: 10}}
+	dr := &istioapi.DestinationRule{
+		ObjectMeta: metav1.ObjectMeta{Name: "firmware", Namespace: "default"},
+		Spec: apiv1alpha3.DestinationRule{
+			Host:          "firmware",
+			TrafficPolicy: &apiv1alpha3.TrafficPolicy{LoadBalancer: roundRobin, ConnectionPool: pool},
+			Subsets: []*apiv1alpha3.Subset{
+				{Name: "v1", Labels: map[string]string{"version": "v1"}},
+				{Name: "v2", Labels: map[string]string{"version": "v2"},
+					TrafficPolicy: &apiv1alpha3.TrafficPolicy{LoadBalancer: random}},
+			},
+		},
+	}
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	if err := indexer.Add(dr); err != nil {
+		t.Fatal(err)
+	}
+	c := &ChassisController{drLister: istiolisters.NewDestinationRuleLister(indexer)}
+
+	if p := c.GetTrafficPolicy("default", "firmware", "v1"); p.LoadBalancer != roundRobin || p.ConnectionPool != pool {
+		t.Errorf("subset without a traffic policy doesn't inherit the one of the destination rule: %v", p)
+	}
+	if p := c.GetTrafficPolicy("default", "firmware", "v2"); p.LoadBalancer != random || p.ConnectionPool != pool {
+		t.Errorf("subset traffic policy doesn't override the load balancer only: %v", p)
+	}
+	if dr.Spec.TrafficPolicy.LoadBalancer != roundRobin {
+		t.Errorf("traffic policy of the destination rule is modified")
+	}
+	if p := c.GetTrafficPolicy("default", "other", ""); p != nil {
+		t.Errorf("got traffic policy %v of a service without destination rule", p)
+	}
+
+	if s, err := c.GetSubset("default", "firmware", "v2"); err != nil || s.Labels["version"] != "v2" {
+		t.Errorf("get subset v2 = %v, %v", s, err)
+	}
+	if _, err := c.GetSubset("default", "firmware", "v3"); err == nil {
+		t.Errorf("got subset v3 that doesn't exist")
+	}
+	if !isConsistentHashLB(&istioapi.DestinationRule{Spec: apiv1alpha3.DestinationRule{
+		Subsets: []*apiv1alpha3.Subset{{Name: "v1", TrafficPolicy: &apiv1alpha3.TrafficPolicy{
+			LoadBalancer: &apiv1alpha3.LoadBalancerSettings{
+				LbPolicy: &apiv1alpha3.LoadBalancerSettings_ConsistentHash{},
+			}}}},
+	}}) {
+		t.Errorf("consistent hash of a subset isn't detected")
+	}
+}
@@ -0,0 +1,100 @@
+package controller
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	istioapi "istio.io/client-go/pkg/apis/networking/v1alpha3"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog/v2"
+)
+
+// MeshGateway is the reserved gateway name of the sidecars in the mesh, a virtual
+// service bound to it or to no gateway applies to the traffic of edgeproxy
+const MeshGateway = "mesh"
+
+// GetMeshVirtualService returns the virtual service routing the mesh traffic to the
+// service, nil is returned if there's none. A virtual service with the exact host of
+// the service takes precedence over a wildcard one, the oldest one wins a tie.
+func (c *ChassisController) GetMeshVirtualService(namespace, name string) *istioapi.VirtualService {
+	vsList, err := c.vsLister.List(labels.Everything())
+	if err != nil {
+		klog.Errorf("list virtual services err: %v", err)
+		return nil
+	}
+	var exact, wildcard []*istioapi.VirtualService
+	for _, vs := range vsList {
+		if !isMeshVirtualService(vs) {
+			continue
+		}
+		for _, host := range vs.Spec.Hosts {
+			if m := matchHost(host, vs.Namespace, namespace, name); m == hostExact {
+				exact = append(exact, vs)
+				break
+			} else if m == hostWildcard {
+				wildcard = append(wildcard, vs)
+				break
+			}
+		}
+	}
+	if len(exact) > 0 {
+		return oldest(exact)
+	}
+	if len(wildcard) > 0 {
+		return oldest(wildcard)
+	}
+	return nil
+}
+
+// isMeshVirtualService returns true if the virtual service applies to the mesh traffic
+func isMeshVirtualService(vs *istioapi.VirtualService) bool {
+	if len(vs.Spec.Gateways) == 0 {
+		return true
+	}
+	for _, gw := range vs.Spec.Gateways {
+		if gw == MeshGateway {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	hostMismatch = iota
+	hostExact
+	hostWildcard
+)
+
+// matchHost matches a host of a virtual service in vsNamespace against a service. A short
+// name is interpreted in the namespace of the virtual service, and a wildcard like
+// "*.default.svc.cluster.local" matches the fully qualified name of the service.
+func matchHost(host, vsNamespace, namespace, name string) int {
+	fqdn := fmt.Sprintf("%s.%s.svc.cluster.local", name, namespace)
+	if strings.HasPrefix(host, "*") {
+		if strings.HasSuffix(fqdn, strings.TrimPrefix(host, "*")) {
+			return hostWildcard
+		}
+		return hostMismatch
+	}
+	switch host {
+	case fqdn, fmt.Sprintf("%s.%s.svc", name, namespace), fmt.Sprintf("%s.%s", name, namespace):
+		return hostExact
+	case name:
+		if vsNamespace == namespace {
+			return hostExact
+		}
+	}
+	return hostMismatch
+}
+
+func oldest(vsList []*istioapi.VirtualService) *istioapi.VirtualService {
+	sort.Slice(vsList, func(i, j int) bool {
+		ti, tj := vsList[i].CreationTimestamp, vsList[j].CreationTimestamp
+		if !ti.Equal(&tj) {
+			return ti.Before(&tj)
+		}
+		return vsList[i].Namespace+"/"+vsList[i].Name < vsList[j].Namespace+"/"+vsList[j].Name
+	})
+	return vsList[0]
+}
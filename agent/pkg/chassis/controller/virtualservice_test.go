@@ -0,0 +1,23 @@
+package controller
+
+import "testing"
+
+func TestMatchHost(t *testing.T) {
+	cases := []struct {
+		host, vsNamespace string
+		want              int
+	}{
+		{host: "firmware", vsNamespace: "edge", want: hostExact},
+		{host: "firmware", vsNamespace: "default", want: hostMismatch},
+		{host: "firmware.edge", vsNamespace: "default", want: hostExact},
+		{host: "firmware.edge.svc.cluster.local", vsNamespace: "default", want: hostExact},
+		{host: "*.edge.svc.cluster.local", vsNamespace: "default", want: hostWildcard},
+		{host: "*.default.svc.cluster.local", vsNamespace: "default", want: hostMismatch},
+		{host: "*", vsNamespace: "default", want: hostWildcard},
+	}
+	for _, c := range cases {
+		if got := matchHost(c.host, c.vsNamespace, "edge", "firmware"); got != c.want {
+			t.Errorf("match host %s in %s = %d, want %d", c.host, c.vsNamespace, got, c.want)
+		}
+	}
+}
@@ -12,7 +12,14 @@ import (
 	chassisconfig "github.com/kubeedge/edgemesh/agent/pkg/chassis/config"
 	"github.com/kubeedge/edgemesh/agent/pkg/chassis/controller"
 	"github.com/kubeedge/edgemesh/agent/pkg/chassis/loadbalancer/consistenthash"
+	"github.com/kubeedge/edgemesh/agent/pkg/chassis/loadbalancer/latency"
+	"github.com/kubeedge/edgemesh/agent/pkg/chassis/loadbalancer/leastconn"
+	"github.com/kubeedge/edgemesh/agent/pkg/chassis/loadbalancer/retry"
+	"github.com/kubeedge/edgemesh/agent/pkg/chassis/loadbalancer/sessionaffinity"
 	_ "github.com/kubeedge/edgemesh/agent/pkg/chassis/panel"
+	_ "github.com/kubeedge/edgemesh/agent/pkg/chassis/protocol/http"
+	_ "github.com/kubeedge/edgemesh/agent/pkg/chassis/protocol/mqtt"
+	_ "github.com/kubeedge/edgemesh/agent/pkg/chassis/protocol/tcp"
 	meshregistry "github.com/kubeedge/edgemesh/agent/pkg/chassis/registry"
 	"github.com/kubeedge/edgemesh/common/informers"
 )
@@ -26,24 +33,36 @@ func Install(c *chassisconfig.GoChassisConfig, ifm *informers.Manager) {
 	// service discovery
 	opt := registry.Options{}
 	registry.DefaultServiceDiscoveryService = meshregistry.NewEdgeServiceDiscovery(opt)
-	// load balance
+	// load balance, session affinity and the exclusion of the endpoints failed by the
+	// previous attempts of a retry apply to all the strategies
 	for _, strategy := range c.LoadBalancer.SupportedLBStrategies {
+		var newStrategy func() loadbalancer.Strategy
 		switch strategy {
 		case loadbalancer.StrategyRoundRobin:
-			loadbalancer.InstallStrategy(strategy, func() loadbalancer.Strategy {
+			newStrategy = func() loadbalancer.Strategy {
 				return &loadbalancer.RoundRobinStrategy{}
-			})
+			}
 		case loadbalancer.StrategyRandom:
-			loadbalancer.InstallStrategy(strategy, func() loadbalancer.Strategy {
+			newStrategy = func() loadbalancer.Strategy {
 				return &loadbalancer.RandomStrategy{}
-			})
+			}
 		case consistenthash.StrategyConsistentHash:
-			loadbalancer.InstallStrategy(strategy, func() loadbalancer.Strategy {
+			newStrategy = func() loadbalancer.Strategy {
 				return &consistenthash.Strategy{}
-			})
+			}
+		case leastconn.StrategyLeastConn:
+			newStrategy = func() loadbalancer.Strategy {
+				return &leastconn.Strategy{}
+			}
+		case latency.StrategyLatency:
+			newStrategy = func() loadbalancer.Strategy {
+				return &latency.Strategy{}
+			}
 		default:
 			klog.Warningf("unsupported strategy name: %s", strategy)
+			continue
 		}
+		loadbalancer.InstallStrategy(strategy, retry.Wrap(sessionaffinity.Wrap(newStrategy)))
 	}
 	// control panel
 	config.GlobalDefinition = &model.GlobalCfg{
@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"bytes"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"net/http"
 	"strings"
@@ -13,22 +14,29 @@ import (
 	"github.com/go-chassis/go-chassis/core/invocation"
 	"github.com/go-chassis/go-chassis/core/registry"
 	apiv1alpha3 "istio.io/api/networking/v1alpha3"
-	istioapi "istio.io/client-go/pkg/apis/networking/v1alpha3"
 	"k8s.io/klog/v2"
 
 	"github.com/kubeedge/edgemesh/agent/pkg/chassis/controller"
 	"github.com/kubeedge/edgemesh/agent/pkg/chassis/loadbalancer/consistenthash/hashring"
+	edgeregistry "github.com/kubeedge/edgemesh/agent/pkg/chassis/registry"
 	"github.com/kubeedge/edgemesh/common/util"
 )
 
 // StrategyConsistentHash load balance strategy
 const StrategyConsistentHash = "ConsistentHash"
 
+// HashKeyMetadata is the invocation metadata key of the hash key provided by
+// a protocol handler, e.g. the client id of mqtt. It takes precedence over the
+// hash key specified in destination rule.
+const HashKeyMetadata = "hashKey"
+
 // Strategy is an extension of the go-chassis loadbalancer
 type Strategy struct {
 	instances []*registry.MicroServiceInstance
 	mtx       sync.Mutex
 	key, ring string
+	// subset is the destination rule subset the instances belong to
+	subset string
 }
 
 // ReceiveData receive data.
@@ -38,20 +46,29 @@ func (s *Strategy) ReceiveData(inv *invocation.Invocation,
 	name, namespace := util.SplitServiceKey(serviceName)
 	s.ring = fmt.Sprintf("%s.%s", namespace, name)
 
-	// find destination rule bound to service
-	dr, err := controller.APIConn.GetDrLister().DestinationRules(namespace).Get(name)
-	if err != nil {
-		klog.Errorf("failed to find destinationRule, reason: %v", err)
+	s.subset = inv.RouteTags.KV[edgeregistry.SubsetTag]
+	// the hash key of a protocol handler doesn't need a destination rule
+	if key, ok := inv.Metadata[HashKeyMetadata].(string); ok {
+		klog.V(4).Infof("get key from metadata: %s", key)
+		s.key = key
+		return
+	}
+
+	// find the traffic policy of the destination rule or the subset bound to service
+	policy := controller.APIConn.GetTrafficPolicy(namespace, name, s.subset)
+	if policy == nil {
+		klog.Errorf("failed to find destinationRule %s.%s", namespace, name)
 		return
 	}
 
 	// get key from request
 	var hashKey string
+	var err error
 	switch inv.Args.(type) {
 	case *http.Request:
-		hashKey, err = s.getKeyFromHTTP(inv, dr)
+		hashKey, err = s.getKeyFromHTTP(inv, policy)
 	case []byte: // tcp
-		hashKey, err = s.getKeyFromTCP(inv, dr)
+		hashKey, err = s.getKeyFromTCP(inv, policy)
 	default:
 		err = fmt.Errorf("can't convert invocation.Args")
 	}
@@ -65,11 +82,21 @@ func (s *Strategy) ReceiveData(inv *invocation.Invocation,
 
 // Pick return instance
 func (s *Strategy) Pick() (*registry.MicroServiceInstance, error) {
+	i := -1
 	hr, ok := hashring.GetHashRing(s.ring)
-	if !ok {
-		return nil, fmt.Errorf("can't find service instance hash ring %s", s.ring)
+	if ok {
+		i = s.pick(hr)
+	} else {
+		// the ring is only created for the services with a consistent hash destination
+		// rule, the hash key of a protocol handler applies to the other services too
+		klog.V(4).Infof("no service instance hash ring %s, hash the key over the instances", s.ring)
+	}
+	if i < 0 && len(s.instances) > 0 {
+		// the ring holds all the instances of the service, the one located may be out
+		// of the subset, or be filtered by the registry, e.g. ejected by the outlier
+		// detection, or excluded by a retry, so hash the key over the instances left
+		i = s.hashInstances()
 	}
-	i := s.pick(hr)
 	if i < 0 {
 		klog.Errorf("can't find a service instance %d", i)
 		return nil, fmt.Errorf("can't find a service instance")
@@ -77,6 +104,14 @@ func (s *Strategy) Pick() (*registry.MicroServiceInstance, error) {
 	return s.instances[i], nil
 }
 
+// hashInstances hashes the key over the instances, it's stable as long as the instances
+// don't change
+func (s *Strategy) hashInstances() int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(s.key))
+	return int(h.Sum32() % uint32(len(s.instances)))
+}
+
 func (s *Strategy) pick(hr *consistent.Consistent) int {
 	member := hr.LocateKey([]byte(s.key))
 	if member == nil {
@@ -100,19 +135,19 @@ func (s *Strategy) pick(hr *consistent.Consistent) int {
 	return -1
 }
 
-func (s *Strategy) getKeyFromHTTP(inv *invocation.Invocation, dr *istioapi.DestinationRule) (string, error) {
+func (s *Strategy) getKeyFromHTTP(inv *invocation.Invocation, policy *apiv1alpha3.TrafficPolicy) (string, error) {
 	req, ok := inv.Args.(*http.Request)
 	if !ok {
 		return "", fmt.Errorf("can't convert to http.Request")
 	}
-	hashKey, err := s.getKey(dr, "http", req, nil)
+	hashKey, err := s.getKey(policy, "http", req, nil)
 	if err != nil {
 		return "", err
 	}
 	return hashKey, nil
 }
 
-func (s *Strategy) getKeyFromTCP(inv *invocation.Invocation, dr *istioapi.DestinationRule) (string, error) {
+func (s *Strategy) getKeyFromTCP(inv *invocation.Invocation, policy *apiv1alpha3.TrafficPolicy) (string, error) {
 	// store tcp header fields
 	req := make(map[string]string)
 	data, ok := inv.Args.([]byte)
@@ -132,17 +167,17 @@ func (s *Strategy) getKeyFromTCP(inv *invocation.Invocation, dr *istioapi.Destin
 		}
 	}
 
-	hashKey, err := s.getKey(dr, "tcp", nil, req)
+	hashKey, err := s.getKey(policy, "tcp", nil, req)
 	if err != nil {
 		return "", err
 	}
 	return hashKey, nil
 }
 
-func (s *Strategy) getKey(dr *istioapi.DestinationRule, proto string,
+func (s *Strategy) getKey(policy *apiv1alpha3.TrafficPolicy, proto string,
 	httpReq *http.Request, tcpReq map[string]string) (string, error) {
 	var hashKey string
-	switch lbPolicy := dr.Spec.TrafficPolicy.LoadBalancer.LbPolicy.(type) {
+	switch lbPolicy := policy.GetLoadBalancer().GetLbPolicy().(type) {
 	case *apiv1alpha3.LoadBalancerSettings_Simple:
 		return "", fmt.Errorf("hashkey can't get in loadBalancerSimple")
 	case *apiv1alpha3.LoadBalancerSettings_ConsistentHash:
@@ -0,0 +1,86 @@
+package consistenthash
+
+import (
+	"context"
+	"testing"
+
+	"github.com/buraksezer/consistent"
+	"github.com/go-chassis/go-chassis/core/invocation"
+	"github.com/go-chassis/go-chassis/core/registry"
+
+	"github.com/kubeedge/edgemesh/agent/pkg/chassis/loadbalancer/consistenthash/hashring"
+)
+
+func newInstances(ips ...string) []*registry.MicroServiceInstance {
+	var instances []*registry.MicroServiceInstance
+	for _, ip := range ips {
+		instances = append(instances, &registry.MicroServiceInstance{ServiceID: "default#mqtt#" + ip})
+	}
+	return instances
+}
+
+func newStrategy(key string, instances []*registry.MicroServiceInstance) *Strategy {
+	inv := invocation.New(context.Background())
+	inv.SetMetadata(HashKeyMetadata, key)
+	s := &Strategy{}
+	s.ReceiveData(inv, instances, "mqtt.default")
+	return s
+}
+
+func TestPickWithoutRing(t *testing.T) {
+	// a service without destination rule has no ring, the hash key of metadata applies
+	instances := newInstances("10.0.0.1", "10.0.0.2", "10.0.0.3")
+	first, err := newStrategy("client-1", instances).Pick()
+	if err != nil {
+		t.Fatalf("pick without ring err: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		if ins, _ := newStrategy("client-1", instances).Pick(); ins != first {
+			t.Fatalf("key is picked to %s and %s", first.ServiceID, ins.ServiceID)
+		}
+	}
+}
+
+type testHasher struct{}
+
+func (testHasher) Sum64(data []byte) uint64 {
+	h := uint64(14695981039346656037)
+	for _, b := range data {
+		h = (h ^ uint64(b)) * 1099511628211
+	}
+	return h
+}
+
+func TestPickEjected(t *testing.T) {
+	ips := []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}
+	hr := consistent.New(nil, consistent.Config{PartitionCount: 7, ReplicationFactor: 20, Load: 1.25, Hasher: testHasher{}})
+	for _, ip := range ips {
+		hr.Add(hashring.ServiceInstance{Namespace: "default", Name: "mqtt", InstanceIP: ip})
+	}
+	hashring.AddOrUpdateHashRing("default.mqtt", hr)
+	defer hashring.DeleteHashRing("default.mqtt")
+
+	instances := newInstances(ips...)
+	chosen, err := newStrategy("client-1", instances).Pick()
+	if err != nil {
+		t.Fatalf("pick err: %v", err)
+	}
+	if want := hr.LocateKey([]byte("client-1")).String(); chosen.ServiceID != want {
+		t.Errorf("picked %s, want %s located by the ring", chosen.ServiceID, want)
+	}
+
+	// the instance located by the ring is ejected, e.g. by the outlier detection
+	var left []*registry.MicroServiceInstance
+	for _, ins := range instances {
+		if ins != chosen {
+			left = append(left, ins)
+		}
+	}
+	ins, err := newStrategy("client-1", left).Pick()
+	if err != nil {
+		t.Fatalf("pick after ejection err: %v", err)
+	}
+	if ins == chosen {
+		t.Errorf("ejected instance %s is picked", ins.ServiceID)
+	}
+}
@@ -0,0 +1,222 @@
+package latency
+
+import (
+	"expvar"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-chassis/go-chassis/core/invocation"
+	"github.com/go-chassis/go-chassis/core/registry"
+	"k8s.io/klog/v2"
+
+	"github.com/kubeedge/edgemesh/agent/pkg/chassis/config"
+)
+
+// StrategyLatency load balance strategy
+const StrategyLatency = "LeastLatency"
+
+// expireAfter is how long the latency of an address is kept since it's last picked
+const expireAfter = 10 * time.Minute
+
+var (
+	stats     = newLatencyStats()
+	probeOnce sync.Once
+)
+
+func init() {
+	expvar.Publish("lb_latency", expvar.Func(func() interface{} {
+		return stats.snapshot()
+	}))
+}
+
+// Observe records the connect latency to addr measured by an actual dial, a failed
+// dial marks addr unhealthy until a successful dial or probe. Only the addresses
+// picked by the strategy are recorded.
+func Observe(addr string, d time.Duration, err error) {
+	stats.observe(addr, d, err)
+}
+
+// Strategy picks the instances with the lowest connect latency, which is measured
+// from the actual dials and the periodical probes and smoothed by EWMA. The instances
+// whose latency is within the tolerance of the lowest one are picked in turn. Only the
+// tcp and mqtt dials are observed, the http requests are sent by the pooled transport
+// of go-chassis, so the http services rely on the probes alone and are picked in turn
+// until the probes measure them.
+type Strategy struct {
+	instances []*registry.MicroServiceInstance
+	protocol  string
+}
+
+// counter makes the candidates picked in turn
+var counter uint64
+
+// ReceiveData receive data
+func (s *Strategy) ReceiveData(inv *invocation.Invocation,
+	instances []*registry.MicroServiceInstance, serviceName string) {
+	s.instances = instances
+	s.protocol = inv.Protocol
+	probeOnce.Do(func() {
+		if interval := config.Chassis.LoadBalancer.Latency.ProbeInterval; interval > 0 {
+			go stats.probe(time.Duration(interval) * time.Second)
+		}
+	})
+}
+
+// Pick return instance
+func (s *Strategy) Pick() (*registry.MicroServiceInstance, error) {
+	if len(s.instances) == 0 {
+		return nil, fmt.Errorf("no instance to pick")
+	}
+	latencies := make([]time.Duration, len(s.instances))
+	healthy := make([]bool, len(s.instances))
+	anyHealthy := false
+	for i, ins := range s.instances {
+		latencies[i], healthy[i] = stats.touch(address(ins, s.protocol))
+		anyHealthy = anyHealthy || healthy[i]
+	}
+
+	// all the instances are candidates if none of them is healthy
+	lowest := time.Duration(-1)
+	for i := range s.instances {
+		if anyHealthy && !healthy[i] {
+			continue
+		}
+		if lowest < 0 || latencies[i] < lowest {
+			lowest = latencies[i]
+		}
+	}
+	threshold := lowest + time.Duration(float64(lowest)*config.Chassis.LoadBalancer.Latency.Tolerance)
+	var candidates []int
+	for i := range s.instances {
+		if anyHealthy && !healthy[i] {
+			continue
+		}
+		if latencies[i] <= threshold {
+			candidates = append(candidates, i)
+		}
+	}
+	n := atomic.AddUint64(&counter, 1)
+	i := candidates[n%uint64(len(candidates))]
+	klog.V(4).Infof("pick instance %s with latency %v, the lowest is %v", s.instances[i].InstanceID, latencies[i], lowest)
+	return s.instances[i], nil
+}
+
+// address returns the address of the instance for the protocol
+func address(ins *registry.MicroServiceInstance, protocol string) string {
+	if addr, ok := ins.EndpointsMap[protocol]; ok {
+		return addr
+	}
+	for _, addr := range ins.EndpointsMap {
+		return addr
+	}
+	return ""
+}
+
+// latencyStat is the latency of an address
+type latencyStat struct {
+	// ewma is the smoothed latency, 0 means not measured yet
+	ewma     time.Duration
+	healthy  bool
+	lastSeen time.Time
+}
+
+type latencyStats struct {
+	mu    sync.Mutex
+	addrs map[string]*latencyStat
+}
+
+func newLatencyStats() *latencyStats {
+	return &latencyStats{
+		addrs: make(map[string]*latencyStat),
+	}
+}
+
+// touch returns the latency and health of addr, and keeps it probed.
+// The addresses not measured yet are preferred, so they get measured soon.
+func (l *latencyStats) touch(addr string) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	stat, ok := l.addrs[addr]
+	if !ok {
+		stat = &latencyStat{healthy: true}
+		l.addrs[addr] = stat
+	}
+	stat.lastSeen = time.Now()
+	return stat.ewma, stat.healthy
+}
+
+func (l *latencyStats) observe(addr string, d time.Duration, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	stat, ok := l.addrs[addr]
+	if !ok {
+		return
+	}
+	if err != nil {
+		stat.healthy = false
+		return
+	}
+	stat.healthy = true
+	if stat.ewma == 0 {
+		stat.ewma = d
+		return
+	}
+	alpha := config.Chassis.LoadBalancer.Latency.SmoothingFactor
+	stat.ewma = time.Duration(alpha*float64(d) + (1-alpha)*float64(stat.ewma))
+}
+
+// probe measures the connect latency of the addresses periodically, the
+// addresses not picked for a while are forgotten
+func (l *latencyStats) probe(interval time.Duration) {
+	timeout := time.Duration(config.Chassis.Protocol.TCPClientTimeout) * time.Second
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		var addrs []string
+		now := time.Now()
+		l.mu.Lock()
+		for addr, stat := range l.addrs {
+			if now.Sub(stat.lastSeen) > expireAfter {
+				delete(l.addrs, addr)
+				continue
+			}
+			addrs = append(addrs, addr)
+		}
+		l.mu.Unlock()
+
+		var wg sync.WaitGroup
+		for _, addr := range addrs {
+			wg.Add(1)
+			go func(addr string) {
+				defer wg.Done()
+				start := time.Now()
+				conn, err := net.DialTimeout("tcp", addr, timeout)
+				if err == nil {
+					conn.Close()
+				} else {
+					klog.V(4).Infof("probe %s err: %v", addr, err)
+				}
+				l.observe(addr, time.Since(start), err)
+			}(addr)
+		}
+		wg.Wait()
+	}
+}
+
+// snapshot returns the latencies in milliseconds, -1 for the unhealthy addresses
+func (l *latencyStats) snapshot() map[string]float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	m := make(map[string]float64, len(l.addrs))
+	for addr, stat := range l.addrs {
+		if !stat.healthy {
+			m[addr] = -1
+			continue
+		}
+		m[addr] = float64(stat.ewma) / float64(time.Millisecond)
+	}
+	return m
+}
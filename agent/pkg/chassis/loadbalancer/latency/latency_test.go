@@ -0,0 +1,53 @@
+package latency
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/go-chassis/go-chassis/core/registry"
+
+	"github.com/kubeedge/edgemesh/agent/pkg/chassis/config"
+)
+
+func TestPick(t *testing.T) {
+	config.InitConfigure(config.NewGoChassisConfig())
+
+	var instances []*registry.MicroServiceInstance
+	for i := 1; i <= 4; i++ {
+		instances = append(instances, &registry.MicroServiceInstance{
+			InstanceID:   fmt.Sprintf("ins-%d", i),
+			EndpointsMap: map[string]string{"tcp": fmt.Sprintf("10.0.0.%d:80", i)},
+		})
+	}
+	s := &Strategy{instances: instances, protocol: "tcp"}
+	// the addresses are known to the stats once picked
+	if _, err := s.Pick(); err != nil {
+		t.Fatal(err)
+	}
+	Observe("10.0.0.1:80", 10*time.Millisecond, nil)
+	Observe("10.0.0.2:80", 11*time.Millisecond, nil)
+	Observe("10.0.0.3:80", 50*time.Millisecond, nil)
+	Observe("10.0.0.4:80", time.Millisecond, fmt.Errorf("connection refused"))
+
+	picked := make(map[string]int)
+	for i := 0; i < 100; i++ {
+		ins, err := s.Pick()
+		if err != nil {
+			t.Fatal(err)
+		}
+		picked[ins.InstanceID]++
+	}
+	if picked["ins-1"] == 0 || picked["ins-2"] == 0 {
+		t.Errorf("instances within tolerance of the lowest latency aren't all picked: %v", picked)
+	}
+	if picked["ins-3"] > 0 || picked["ins-4"] > 0 {
+		t.Errorf("slow or unhealthy instances are picked: %v", picked)
+	}
+
+	// EWMA smooths a single slow sample
+	Observe("10.0.0.1:80", 100*time.Millisecond, nil)
+	if got, _ := stats.touch("10.0.0.1:80"); got >= 50*time.Millisecond {
+		t.Errorf("latency after a slow sample = %v, want smoothed below 50ms", got)
+	}
+}
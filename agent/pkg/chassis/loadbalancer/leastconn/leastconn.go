@@ -0,0 +1,149 @@
+package leastconn
+
+import (
+	"expvar"
+	"fmt"
+	"math/rand"
+	"sync"
+
+	"github.com/go-chassis/go-chassis/core/handler"
+	"github.com/go-chassis/go-chassis/core/invocation"
+	"github.com/go-chassis/go-chassis/core/registry"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// StrategyLeastConn load balance strategy
+	StrategyLeastConn = "LeastConn"
+	// ActiveCounterHandlerName is the name of the handler counting the active connections
+	// and in-flight requests, it must be right after the load balance handler in a chain
+	ActiveCounterHandlerName = "activeCounter"
+)
+
+var counter = newActiveCounter()
+
+func init() {
+	err := handler.RegisterHandler(ActiveCounterHandlerName, func() handler.Handler {
+		return &ActiveCounterHandler{}
+	})
+	if err != nil {
+		klog.Errorf("register active counter handler err: %v", err)
+	}
+	expvar.Publish("lb_active", expvar.Func(func() interface{} {
+		return counter.snapshot()
+	}))
+}
+
+// Begin counts an active connection or request to addr, end must be called once it finishes
+func Begin(addr string) (end func()) {
+	counter.add(addr, 1)
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			counter.add(addr, -1)
+		})
+	}
+}
+
+// ActiveCounterHandler counts the invocation to the picked endpoint as active until
+// the rest of the chain returns. The l4 proxy handler blocks for the lifetime of the
+// connection and the transport handler for the request, so both are counted.
+type ActiveCounterHandler struct{}
+
+// Name name
+func (h *ActiveCounterHandler) Name() string {
+	return ActiveCounterHandlerName
+}
+
+// Handle handle
+func (h *ActiveCounterHandler) Handle(chain *handler.Chain, i *invocation.Invocation, cb invocation.ResponseCallBack) {
+	end := Begin(i.Endpoint)
+	defer end()
+	chain.Next(i, cb)
+}
+
+// Strategy picks the instance with less active connections and requests of two
+// random instances, a.k.a. power of two choices
+type Strategy struct {
+	instances []*registry.MicroServiceInstance
+	protocol  string
+}
+
+// ReceiveData receive data
+func (s *Strategy) ReceiveData(inv *invocation.Invocation,
+	instances []*registry.MicroServiceInstance, serviceName string) {
+	s.instances = instances
+	s.protocol = inv.Protocol
+}
+
+// Pick return instance
+func (s *Strategy) Pick() (*registry.MicroServiceInstance, error) {
+	switch len(s.instances) {
+	case 0:
+		return nil, fmt.Errorf("no instance to pick")
+	case 1:
+		return s.instances[0], nil
+	}
+	i := rand.Intn(len(s.instances))
+	j := rand.Intn(len(s.instances) - 1)
+	if j >= i {
+		j++
+	}
+	ai := counter.get(address(s.instances[i], s.protocol))
+	aj := counter.get(address(s.instances[j], s.protocol))
+	if aj < ai {
+		i = j
+	}
+	klog.V(4).Infof("pick instance %s of two choices with %d and %d active", s.instances[i].InstanceID, ai, aj)
+	return s.instances[i], nil
+}
+
+// address returns the address of the instance for the protocol
+func address(ins *registry.MicroServiceInstance, protocol string) string {
+	if addr, ok := ins.EndpointsMap[protocol]; ok {
+		return addr
+	}
+	for _, addr := range ins.EndpointsMap {
+		return addr
+	}
+	return ""
+}
+
+// activeCounter counts the active connections and requests by address
+type activeCounter struct {
+	mu     sync.Mutex
+	active map[string]int64
+}
+
+func newActiveCounter() *activeCounter {
+	return &activeCounter{
+		active: make(map[string]int64),
+	}
+}
+
+func (c *activeCounter) add(addr string, delta int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := c.active[addr] + delta
+	if n <= 0 {
+		delete(c.active, addr)
+		return
+	}
+	c.active[addr] = n
+}
+
+func (c *activeCounter) get(addr string) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.active[addr]
+}
+
+func (c *activeCounter) snapshot() map[string]int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	m := make(map[string]int64, len(c.active))
+	for addr, n := range c.active {
+		m[addr] = n
+	}
+	return m
+}
@@ -0,0 +1,37 @@
+package leastconn
+
+import (
+	"testing"
+
+	"github.com/go-chassis/go-chassis/core/registry"
+)
+
+func TestPick(t *testing.T) {
+	busy := &registry.MicroServiceInstance{InstanceID: "busy", EndpointsMap: map[string]string{"tcp": "10.0.0.1:80"}}
+	idle := &registry.MicroServiceInstance{InstanceID: "idle", EndpointsMap: map[string]string{"tcp": "10.0.0.2:80"}}
+	s := &Strategy{instances: []*registry.MicroServiceInstance{busy, idle}, protocol: "tcp"}
+
+	var ends []func()
+	for i := 0; i < 3; i++ {
+		ends = append(ends, Begin("10.0.0.1:80"))
+	}
+	// two choices of two instances are always both of them
+	for i := 0; i < 10; i++ {
+		ins, err := s.Pick()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ins != idle {
+			t.Fatalf("picked %s, want the idle instance", ins.InstanceID)
+		}
+	}
+
+	for _, end := range ends {
+		end()
+		// ending twice is harmless
+		end()
+	}
+	if n := counter.get("10.0.0.1:80"); n != 0 {
+		t.Errorf("active = %d after all ended, want 0", n)
+	}
+}
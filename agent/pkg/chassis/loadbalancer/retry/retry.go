@@ -0,0 +1,61 @@
+package retry
+
+import (
+	"github.com/go-chassis/go-chassis/core/invocation"
+	"github.com/go-chassis/go-chassis/core/loadbalancer"
+	"github.com/go-chassis/go-chassis/core/registry"
+	"k8s.io/klog/v2"
+)
+
+// ExcludedMetadata is the invocation metadata key of the endpoints failed by the
+// previous attempts of a retried invocation, they're excluded from the next pick
+const ExcludedMetadata = "excludedEndpoints"
+
+// Exclude excludes the endpoint from the instances picked for inv
+func Exclude(inv *invocation.Invocation, endpoint string) {
+	excluded, _ := inv.Metadata[ExcludedMetadata].(map[string]bool)
+	if excluded == nil {
+		excluded = make(map[string]bool)
+	}
+	excluded[endpoint] = true
+	inv.SetMetadata(ExcludedMetadata, excluded)
+}
+
+// Strategy hands the instances except the excluded ones to the wrapped strategy, so
+// a retry goes to a different instance. All the instances are kept if they're all
+// excluded, then the retry may go to an instance tried before.
+type Strategy struct {
+	strategy loadbalancer.Strategy
+}
+
+// Wrap returns a strategy factory excluding the failed endpoints on top of newStrategy
+func Wrap(newStrategy func() loadbalancer.Strategy) func() loadbalancer.Strategy {
+	return func() loadbalancer.Strategy {
+		return &Strategy{strategy: newStrategy()}
+	}
+}
+
+// ReceiveData receive data
+func (s *Strategy) ReceiveData(inv *invocation.Invocation,
+	instances []*registry.MicroServiceInstance, serviceName string) {
+	excluded, _ := inv.Metadata[ExcludedMetadata].(map[string]bool)
+	if len(excluded) > 0 {
+		var remaining []*registry.MicroServiceInstance
+		for _, ins := range instances {
+			if !excluded[ins.EndpointsMap[inv.Protocol]] {
+				remaining = append(remaining, ins)
+			}
+		}
+		if len(remaining) > 0 {
+			klog.V(4).Infof("%d of %d instances of %s are excluded by the previous attempts",
+				len(instances)-len(remaining), len(instances), serviceName)
+			instances = remaining
+		}
+	}
+	s.strategy.ReceiveData(inv, instances, serviceName)
+}
+
+// Pick return instance
+func (s *Strategy) Pick() (*registry.MicroServiceInstance, error) {
+	return s.strategy.Pick()
+}
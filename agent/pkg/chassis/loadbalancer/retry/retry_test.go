@@ -0,0 +1,33 @@
+package retry
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-chassis/go-chassis/core/invocation"
+	"github.com/go-chassis/go-chassis/core/loadbalancer"
+	"github.com/go-chassis/go-chassis/core/registry"
+)
+
+func TestExclude(t *testing.T) {
+	a := &registry.MicroServiceInstance{InstanceID: "a", EndpointsMap: map[string]string{"tcp": "10.0.0.1:80"}}
+	b := &registry.MicroServiceInstance{InstanceID: "b", EndpointsMap: map[string]string{"tcp": "10.0.0.2:80"}}
+	s := Wrap(func() loadbalancer.Strategy { return &loadbalancer.RoundRobinStrategy{} })()
+
+	inv := invocation.New(context.Background())
+	inv.Protocol = "tcp"
+	Exclude(inv, "10.0.0.1:80")
+	for i := 0; i < 4; i++ {
+		s.ReceiveData(inv, []*registry.MicroServiceInstance{a, b}, "svc")
+		if ins, err := s.Pick(); err != nil || ins != b {
+			t.Fatalf("picked %v, %v, want the instance not excluded", ins, err)
+		}
+	}
+
+	// all the instances are kept if they're all excluded
+	Exclude(inv, "10.0.0.2:80")
+	s.ReceiveData(inv, []*registry.MicroServiceInstance{a, b}, "svc")
+	if _, err := s.Pick(); err != nil {
+		t.Errorf("pick err: %v", err)
+	}
+}
@@ -0,0 +1,186 @@
+package sessionaffinity
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/go-chassis/go-chassis/core/invocation"
+	"github.com/go-chassis/go-chassis/core/loadbalancer"
+	"github.com/go-chassis/go-chassis/core/registry"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+
+	"github.com/kubeedge/edgemesh/agent/pkg/chassis/controller"
+	"github.com/kubeedge/edgemesh/common/util"
+)
+
+// ClientIPMetadata is the invocation metadata key of the client ip provided by
+// a protocol handler, it's used to pin the client to an instance when the
+// session affinity of the service is ClientIP
+const ClientIPMetadata = "clientIP"
+
+// sweepInterval is the interval to remove the expired affinities
+const sweepInterval = time.Minute
+
+var table = newAffinityTable()
+
+// SetClientIP sets the ip of addr as the client ip of inv
+func SetClientIP(inv *invocation.Invocation, addr net.Addr) {
+	if addr == nil {
+		return
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return
+	}
+	inv.SetMetadata(ClientIPMetadata, host)
+}
+
+// Strategy pins a client ip to the instance picked by the wrapped strategy for
+// the timeout of the service's session affinity, any strategy is supported
+type Strategy struct {
+	strategy  loadbalancer.Strategy
+	instances []*registry.MicroServiceInstance
+	// key is the service and client ip, empty if session affinity is disabled
+	key     string
+	timeout time.Duration
+}
+
+// Wrap returns a strategy factory applying session affinity on top of newStrategy
+func Wrap(newStrategy func() loadbalancer.Strategy) func() loadbalancer.Strategy {
+	return func() loadbalancer.Strategy {
+		return &Strategy{strategy: newStrategy()}
+	}
+}
+
+// ReceiveData receive data
+func (s *Strategy) ReceiveData(inv *invocation.Invocation,
+	instances []*registry.MicroServiceInstance, serviceName string) {
+	s.strategy.ReceiveData(inv, instances, serviceName)
+	s.instances = instances
+
+	clientIP, ok := inv.Metadata[ClientIPMetadata].(string)
+	if !ok || clientIP == "" {
+		return
+	}
+	timeout, ok := getTimeout(serviceName)
+	if !ok {
+		return
+	}
+	// the service name contains the port, the affinity is per service port like kube-proxy
+	s.key = serviceName + "|" + clientIP
+	s.timeout = timeout
+}
+
+// Pick return instance
+func (s *Strategy) Pick() (*registry.MicroServiceInstance, error) {
+	if s.key == "" {
+		return s.strategy.Pick()
+	}
+	if ins := table.get(s.key, s.instances); ins != nil {
+		klog.V(4).Infof("session affinity %s picks instance %s", s.key, ins.InstanceID)
+		return ins, nil
+	}
+	ins, err := s.strategy.Pick()
+	if err != nil {
+		return nil, err
+	}
+	table.set(s.key, ins.InstanceID, s.timeout)
+	return ins, nil
+}
+
+// getTimeout returns the session affinity timeout if the service's session affinity is ClientIP
+func getTimeout(serviceName string) (time.Duration, bool) {
+	name, namespace := util.SplitServiceKey(serviceName)
+	svc, err := controller.APIConn.GetSvcLister().Services(namespace).Get(name)
+	if err != nil {
+		klog.V(4).Infof("get service %s.%s err: %v", namespace, name, err)
+		return 0, false
+	}
+	if svc.Spec.SessionAffinity != v1.ServiceAffinityClientIP {
+		return 0, false
+	}
+	timeout := v1.DefaultClientIPServiceAffinitySeconds
+	if c := svc.Spec.SessionAffinityConfig; c != nil && c.ClientIP != nil && c.ClientIP.TimeoutSeconds != nil {
+		timeout = *c.ClientIP.TimeoutSeconds
+	}
+	return time.Duration(timeout) * time.Second, true
+}
+
+// affinity is the instance pinned to a client
+type affinity struct {
+	instanceID string
+	lastUsed   time.Time
+	timeout    time.Duration
+}
+
+func (a *affinity) expired(now time.Time) bool {
+	return now.Sub(a.lastUsed) > a.timeout
+}
+
+// affinityTable records the affinities by service and client ip
+type affinityTable struct {
+	mu        sync.Mutex
+	entries   map[string]*affinity
+	sweepOnce sync.Once
+}
+
+func newAffinityTable() *affinityTable {
+	return &affinityTable{
+		entries: make(map[string]*affinity),
+	}
+}
+
+// get returns the pinned instance if it's still alive in instances, and refreshes the affinity
+func (t *affinityTable) get(key string, instances []*registry.MicroServiceInstance) *registry.MicroServiceInstance {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	a, ok := t.entries[key]
+	if !ok {
+		return nil
+	}
+	now := time.Now()
+	if a.expired(now) {
+		delete(t.entries, key)
+		return nil
+	}
+	for _, ins := range instances {
+		if ins.InstanceID == a.instanceID {
+			a.lastUsed = now
+			return ins
+		}
+	}
+	// the instance is gone, pick another one
+	delete(t.entries, key)
+	return nil
+}
+
+func (t *affinityTable) set(key, instanceID string, timeout time.Duration) {
+	t.sweepOnce.Do(func() {
+		go t.sweep()
+	})
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.entries[key] = &affinity{
+		instanceID: instanceID,
+		lastUsed:   time.Now(),
+		timeout:    timeout,
+	}
+}
+
+// sweep removes the expired affinities periodically
+func (t *affinityTable) sweep() {
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		now := time.Now()
+		t.mu.Lock()
+		for key, a := range t.entries {
+			if a.expired(now) {
+				delete(t.entries, key)
+			}
+		}
+		t.mu.Unlock()
+	}
+}
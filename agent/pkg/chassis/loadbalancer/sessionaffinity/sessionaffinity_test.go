@@ -0,0 +1,47 @@
+package sessionaffinity
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-chassis/go-chassis/core/registry"
+)
+
+func TestAffinityTable(t *testing.T) {
+	instances := []*registry.MicroServiceInstance{
+		{InstanceID: "default.nginx|10.0.0.1.80"},
+		{InstanceID: "default.nginx|10.0.0.2.80"},
+	}
+	key := "nginx.default.svc.cluster.local:80||192.168.1.10"
+
+	tbl := newAffinityTable()
+	if ins := tbl.get(key, instances); ins != nil {
+		t.Fatalf("got %s before pinned", ins.InstanceID)
+	}
+	tbl.set(key, instances[1].InstanceID, 50*time.Millisecond)
+	if ins := tbl.get(key, instances); ins == nil || ins != instances[1] {
+		t.Fatalf("got %v, want the pinned instance", ins)
+	}
+
+	// the affinity is refreshed by get
+	time.Sleep(30 * time.Millisecond)
+	if ins := tbl.get(key, instances); ins != instances[1] {
+		t.Fatalf("got %v, want the pinned instance", ins)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if ins := tbl.get(key, instances); ins != instances[1] {
+		t.Fatalf("got %v, want the pinned instance after refreshed", ins)
+	}
+
+	// expired
+	time.Sleep(80 * time.Millisecond)
+	if ins := tbl.get(key, instances); ins != nil {
+		t.Fatalf("got %s after expired", ins.InstanceID)
+	}
+
+	// the pinned instance is gone
+	tbl.set(key, instances[1].InstanceID, time.Minute)
+	if ins := tbl.get(key, instances[:1]); ins != nil {
+		t.Fatalf("got %s after the pinned instance is gone", ins.InstanceID)
+	}
+}
@@ -8,21 +8,42 @@ import (
 	"github.com/kubeedge/edgemesh/agent/pkg/chassis/config"
 	"github.com/kubeedge/edgemesh/agent/pkg/chassis/controller"
 	"github.com/kubeedge/edgemesh/agent/pkg/chassis/loadbalancer/consistenthash"
+	"github.com/kubeedge/edgemesh/agent/pkg/chassis/loadbalancer/leastconn"
 )
 
-// GetStrategyName returns load balance strategy name
-func GetStrategyName(namespace, name string) string {
+// StrategyAnnotation is the destination rule annotation used to select a load balance
+// strategy beyond the ones of istio, e.g. "LeastLatency". It takes precedence over the
+// load balancer settings of the destination rule.
+const StrategyAnnotation = "edgemesh.kubeedge.io/lb-strategy"
+
+// GetStrategyName returns load balance strategy name, the load balancer settings of
+// the subset take precedence over the ones of the destination rule
+func GetStrategyName(namespace, name, subset string) string {
+	return GetStrategyNameOrDefault(namespace, name, subset, config.Chassis.LoadBalancer.DefaultLBStrategy)
+}
+
+// GetStrategyNameOrDefault returns load balance strategy name like GetStrategyName, but
+// defaultStrategy is used if the destination rule doesn't set any strategy, e.g. the
+// protocols with their own default strategy
+func GetStrategyNameOrDefault(namespace, name, subset, defaultStrategy string) string {
 	var strategyName string
-	// get default lb strategy from config file
-	defaultStrategy := config.Chassis.LoadBalancer.DefaultLBStrategy
 	// find destination rule bound to service
 	dr, err := controller.APIConn.GetDrLister().DestinationRules(namespace).Get(name)
 	if err != nil {
-		klog.Warningf("DestinationRule \"%s.%s\" not found, use default strategy [%s] from config file", namespace, name, defaultStrategy)
+		klog.Warningf("DestinationRule \"%s.%s\" not found, use default strategy [%s]", namespace, name, defaultStrategy)
 		return defaultStrategy
 	}
 
-	switch lbPolicy := dr.Spec.TrafficPolicy.LoadBalancer.LbPolicy.(type) {
+	if strategy, ok := dr.Annotations[StrategyAnnotation]; ok {
+		if _, err := loadbalancer.GetStrategyPlugin(strategy); err == nil {
+			klog.Infof("loadbalance strategy: %s", strategy)
+			return strategy
+		}
+		klog.Warningf("strategy %s of DestinationRule \"%s.%s\" is not supported", strategy, namespace, name)
+	}
+
+	policy := controller.APIConn.GetTrafficPolicy(namespace, name, subset)
+	switch lbPolicy := policy.GetLoadBalancer().GetLbPolicy().(type) {
 	case *apiv1alpha3.LoadBalancerSettings_Simple:
 		strategyName = getSimpleLB(lbPolicy.Simple.String())
 	case *apiv1alpha3.LoadBalancerSettings_ConsistentHash:
@@ -40,6 +61,8 @@ func getSimpleLB(simpleLb string) string {
 		simpleLb = loadbalancer.StrategyRoundRobin
 	case "RANDOM":
 		simpleLb = loadbalancer.StrategyRandom
+	case "LEAST_CONN":
+		simpleLb = leastconn.StrategyLeastConn
 	default:
 		klog.Warningf("strategy not support %s, use default strategy: RoundRobin", simpleLb)
 		simpleLb = config.Chassis.LoadBalancer.DefaultLBStrategy
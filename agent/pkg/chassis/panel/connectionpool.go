@@ -0,0 +1,195 @@
+package panel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chassis/go-chassis/core/common"
+	"github.com/go-chassis/go-chassis/core/handler"
+	"github.com/go-chassis/go-chassis/core/invocation"
+	"github.com/go-chassis/go-chassis/third_party/forked/afex/hystrix-go/hystrix"
+	apiv1alpha3 "istio.io/api/networking/v1alpha3"
+	"k8s.io/klog/v2"
+
+	"github.com/kubeedge/edgemesh/agent/pkg/chassis/config"
+	"github.com/kubeedge/edgemesh/agent/pkg/chassis/controller"
+	"github.com/kubeedge/edgemesh/agent/pkg/chassis/registry"
+	"github.com/kubeedge/edgemesh/common/util"
+)
+
+// ConnectionPoolHandlerName is the name of the handler enforcing the connection pool
+// limits of the destination rule, it must be before the load balance handler in a chain
+const ConnectionPoolHandlerName = "connectionPool"
+
+// ErrOverflow is returned if the connection pool of the service overflows
+var ErrOverflow = errors.New("connection pool overflow")
+
+// pools are the connection pools by service and subset
+var pools sync.Map
+
+func init() {
+	err := handler.RegisterHandler(ConnectionPoolHandlerName, func() handler.Handler {
+		return &ConnectionPoolHandler{}
+	})
+	if err != nil {
+		klog.Errorf("register connection pool handler err: %v", err)
+	}
+}
+
+// GetCircuitBreaker returns the key of the connection pool of the invocation, and the
+// max concurrent requests by the max connections of the connection pool
+func (ep *EdgePanel) GetCircuitBreaker(inv invocation.Invocation, serviceType string) (string, hystrix.CommandConfig) {
+	key, settings := getConnectionPool(&inv)
+	return key, hystrix.CommandConfig{
+		MaxConcurrentRequests: int(settings.GetTcp().GetMaxConnections()),
+	}
+}
+
+// serviceOf returns the service, port and subset an invocation is destined to
+func serviceOf(inv *invocation.Invocation) (namespace, name string, port int, subset string) {
+	host := inv.MicroServiceName
+	if i := strings.LastIndex(host, ":"); i >= 0 {
+		port, _ = strconv.Atoi(host[i+1:])
+		host = host[:i]
+	}
+	name, namespace = util.SplitServiceKey(host)
+	return namespace, name, port, inv.RouteTags.KV[registry.SubsetTag]
+}
+
+// getConnectionPool returns the key of the connection pool the invocation belongs to
+// and its settings, nil if the service has no connection pool
+func getConnectionPool(inv *invocation.Invocation) (string, *apiv1alpha3.ConnectionPoolSettings) {
+	namespace, name, port, subset := serviceOf(inv)
+	key := fmt.Sprintf("%s.%s", namespace, name)
+	if subset != "" {
+		key += "|" + subset
+	}
+	return key, GetConnectionPool(namespace, name, port, subset)
+}
+
+// GetConnectionPool returns the connection pool settings of the service port or its
+// subset, the settings of the port override the ones of the service
+func GetConnectionPool(namespace, name string, port int, subset string) *apiv1alpha3.ConnectionPoolSettings {
+	policy := controller.APIConn.GetTrafficPolicy(namespace, name, subset)
+	for _, pls := range policy.GetPortLevelSettings() {
+		if int(pls.GetPort().GetNumber()) == port && pls.ConnectionPool != nil {
+			return pls.ConnectionPool
+		}
+	}
+	return policy.GetConnectionPool()
+}
+
+// ConnectionPoolHandler limits the concurrent connections and requests of a service or
+// its subset. A tcp invocation is a connection and is rejected once maxConnections is
+// reached. A http invocation is a request, it waits at most connectTimeout in a queue of
+// http1MaxPendingRequests once maxConnections requests are in flight, and is rejected
+// if the queue is full. The slot is held until the rest of the chain returns.
+type ConnectionPoolHandler struct{}
+
+// Name name
+func (h *ConnectionPoolHandler) Name() string {
+	return ConnectionPoolHandlerName
+}
+
+// Handle handle
+func (h *ConnectionPoolHandler) Handle(chain *handler.Chain, i *invocation.Invocation, cb invocation.ResponseCallBack) {
+	key, settings := getConnectionPool(i)
+	maxActive := int(settings.GetTcp().GetMaxConnections())
+	if maxActive <= 0 {
+		chain.Next(i, cb)
+		return
+	}
+	maxPending := 0
+	if i.Protocol == common.ProtocolRest {
+		// pending requests are unlimited by default
+		maxPending = -1
+		if n := settings.GetHttp().GetHttp1MaxPendingRequests(); n > 0 {
+			maxPending = int(n)
+		}
+	}
+	wait := util.ProtoDuration(settings.GetTcp().GetConnectTimeout())
+	if wait <= 0 {
+		wait = time.Duration(config.Chassis.Protocol.TCPClientTimeout) * time.Second
+	}
+	ctx := i.Ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx, cancel := context.WithTimeout(ctx, wait)
+	defer cancel()
+
+	v, _ := pools.LoadOrStore(key, &pool{})
+	p := v.(*pool)
+	if err := p.acquire(ctx, maxActive, maxPending); err != nil {
+		klog.Warningf("%s of %s rejected by connection pool of %s: %v", i.Protocol, i.MicroServiceName, key, err)
+		if cbErr := cb(&invocation.Response{Err: ErrOverflow}); cbErr != nil {
+			klog.V(4).Infof("connection pool overflow callback err: %v", cbErr)
+		}
+		return
+	}
+	defer p.release()
+	chain.Next(i, cb)
+}
+
+// pool counts the active connections or requests of a connection pool, the ones
+// exceeding the limit wait in a fifo queue
+type pool struct {
+	mu      sync.Mutex
+	active  int
+	waiters []chan struct{}
+}
+
+// acquire takes a slot of the pool. It waits for a released slot if maxActive slots
+// are taken and less than maxPending ones are waiting, a negative maxPending means no
+// limit. The slot must be released once done.
+func (p *pool) acquire(ctx context.Context, maxActive, maxPending int) error {
+	p.mu.Lock()
+	if p.active < maxActive {
+		p.active++
+		p.mu.Unlock()
+		return nil
+	}
+	if maxPending >= 0 && len(p.waiters) >= maxPending {
+		p.mu.Unlock()
+		return fmt.Errorf("%d active and %d pending", p.active, len(p.waiters))
+	}
+	ch := make(chan struct{})
+	p.waiters = append(p.waiters, ch)
+	p.mu.Unlock()
+
+	select {
+	case <-ch:
+		return nil
+	case <-ctx.Done():
+	}
+	p.mu.Lock()
+	for i, w := range p.waiters {
+		if w == ch {
+			p.waiters = append(p.waiters[:i], p.waiters[i+1:]...)
+			p.mu.Unlock()
+			return fmt.Errorf("pending timeout: %v", ctx.Err())
+		}
+	}
+	p.mu.Unlock()
+	// the slot is handed over while timing out, give it back
+	p.release()
+	return fmt.Errorf("pending timeout: %v", ctx.Err())
+}
+
+// release releases a slot, it's handed over to the first waiter if any
+func (p *pool) release() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.waiters) > 0 {
+		ch := p.waiters[0]
+		p.waiters = p.waiters[1:]
+		close(ch)
+		return
+	}
+	p.active--
+}
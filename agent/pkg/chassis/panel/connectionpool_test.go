@@ -0,0 +1,52 @@
+package panel
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestPool(t *testing.T) {
+	p := &pool{}
+	ctx := context.Background()
+	if err := p.acquire(ctx, 1, 0); err != nil {
+		t.Fatalf("acquire the free slot err: %v", err)
+	}
+	// no pending allowed, e.g. tcp connections
+	if err := p.acquire(ctx, 1, 0); err == nil {
+		t.Fatalf("acquire without pending should overflow")
+	}
+
+	// the pending one gets the slot once it's released
+	acquired := make(chan error, 1)
+	go func() {
+		acquired <- p.acquire(ctx, 1, 1)
+	}()
+	for {
+		p.mu.Lock()
+		n := len(p.waiters)
+		p.mu.Unlock()
+		if n == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := p.acquire(ctx, 1, 1); err == nil {
+		t.Fatalf("acquire with a full queue should overflow")
+	}
+	p.release()
+	if err := <-acquired; err != nil {
+		t.Fatalf("pending acquire err: %v", err)
+	}
+
+	// the pending one times out
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if err := p.acquire(timeoutCtx, 1, -1); err == nil {
+		t.Fatalf("pending acquire should time out")
+	}
+	p.release()
+	if p.active != 0 || len(p.waiters) != 0 {
+		t.Errorf("pool = %d active %d pending, want empty", p.active, len(p.waiters))
+	}
+}
@@ -0,0 +1,216 @@
+package panel
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"time"
+
+	"github.com/go-chassis/go-chassis/core/config/model"
+	"github.com/go-chassis/go-chassis/core/invocation"
+	apiv1alpha3 "istio.io/api/networking/v1alpha3"
+	"k8s.io/klog/v2"
+
+	"github.com/kubeedge/edgemesh/agent/pkg/chassis/controller"
+	"github.com/kubeedge/edgemesh/common/util"
+)
+
+const (
+	// HTTPFaultMetadata is the invocation metadata key of the fault of the http route
+	// the request is routed to
+	HTTPFaultMetadata = "httpFault"
+	// TCPFaultAnnotation is the service annotation to inject faults to the tcp connections
+	// of the service, e.g. "delay=2s,delayPercent=50,abortPercent=0.1,abortAfterBytes=1024".
+	// A connection is delayed before connecting the server, and an aborted connection is
+	// reset once abortAfterBytes bytes are relayed, right away if it's 0. The percents
+	// default to 100 if the fault is set.
+	TCPFaultAnnotation = "edgemesh.kubeedge.io/tcp-fault"
+)
+
+// Delay delays the requests or connections by the percent in range 0..100
+type Delay struct {
+	Percent    float64
+	FixedDelay time.Duration
+}
+
+// Abort aborts the requests or connections by the percent in range 0..100
+type Abort struct {
+	Percent    float64
+	HTTPStatus int
+}
+
+// Fault is the fault injected to the requests or connections, unlike model.Fault the
+// percents are floats, so a small one like 0.1 isn't rounded
+type Fault struct {
+	Delay Delay
+	Abort Abort
+}
+
+// TCPFault is the fault injected to the tcp connections of a service
+type TCPFault struct {
+	Delay Delay
+	// Abort aborts the connections by the percent, the http status is unused
+	Abort Abort
+	// AbortAfterBytes is the number of bytes relayed before an aborted connection is reset
+	AbortAfterBytes int64
+}
+
+// GetFaultInjection returns the fault of GetFault with the percents rounded, a positive
+// one is at least 1
+func (ep *EdgePanel) GetFaultInjection(inv invocation.Invocation) model.Fault {
+	f := GetFault(&inv)
+	return model.Fault{
+		Delay: model.Delay{Percent: roundPercent(f.Delay.Percent), FixedDelay: f.Delay.FixedDelay},
+		Abort: model.Abort{Percent: roundPercent(f.Abort.Percent), HTTPStatus: f.Abort.HTTPStatus},
+	}
+}
+
+// GetFault returns the fault of the http route for http invocations, and the fault of
+// the service annotation for tcp invocations
+func GetFault(inv *invocation.Invocation) Fault {
+	if f, ok := inv.Metadata[HTTPFaultMetadata].(*apiv1alpha3.HTTPFaultInjection); ok {
+		return httpFault(f)
+	}
+	if inv.Protocol == "tcp" {
+		namespace, name, _, _ := serviceOf(inv)
+		if f := GetTCPFault(namespace, name); f != nil {
+			return Fault{Delay: f.Delay, Abort: f.Abort}
+		}
+	}
+	return Fault{}
+}
+
+// httpFault converts the fault of a http route, the fault without percentage applies to
+// all the requests. The grpc status of the abort isn't supported and is ignored.
+func httpFault(f *apiv1alpha3.HTTPFaultInjection) Fault {
+	var fault Fault
+	if d := f.GetDelay(); d != nil {
+		if delay := util.ProtoDuration(d.GetFixedDelay()); delay > 0 {
+			fault.Delay = Delay{
+				Percent:    percent(d.GetPercentage(), d.GetPercent()),
+				FixedDelay: delay,
+			}
+		}
+	}
+	if a := f.GetAbort(); a != nil {
+		if status := int(a.GetHttpStatus()); status >= 200 && status < 600 {
+			fault.Abort = Abort{
+				Percent:    percent(a.GetPercentage(), 100),
+				HTTPStatus: status,
+			}
+		}
+	}
+	return fault
+}
+
+// percent returns the percentage of a fault in range 0..100. The fallback, e.g. the
+// deprecated integer percent, is used if the percentage isn't set.
+func percent(p *apiv1alpha3.Percent, fallback int32) float64 {
+	if p == nil {
+		if fallback <= 0 || fallback > 100 {
+			return 100
+		}
+		return float64(fallback)
+	}
+	v := p.GetValue()
+	if v <= 0 || math.IsNaN(v) {
+		return 0
+	}
+	return math.Min(100, v)
+}
+
+// roundPercent rounds a percent, a positive one is at least 1
+func roundPercent(v float64) int {
+	if v <= 0 {
+		return 0
+	}
+	return int(math.Max(1, math.Min(100, math.Round(v))))
+}
+
+// GetTCPFault returns the tcp fault of the service, nil if it isn't set or invalid
+func GetTCPFault(namespace, name string) *TCPFault {
+	svc, err := controller.APIConn.GetSvcLister().Services(namespace).Get(name)
+	if err != nil {
+		return nil
+	}
+	value, ok := svc.Annotations[TCPFaultAnnotation]
+	if !ok {
+		return nil
+	}
+	f, err := parseTCPFault(value)
+	if err != nil {
+		klog.Errorf("parse tcp fault of svc %s.%s err: %v", namespace, name, err)
+		return nil
+	}
+	return f
+}
+
+// parseTCPFault parses the value of TCPFaultAnnotation
+func parseTCPFault(value string) (*TCPFault, error) {
+	f := &TCPFault{}
+	delayPercent, abortPercent := -1.0, -1.0
+	err := util.ParseOptions(value, "tcp fault", func(key, v string) (err error) {
+		switch key {
+		case "delay":
+			f.Delay.FixedDelay, err = time.ParseDuration(v)
+		case "delayPercent":
+			delayPercent, err = parsePercent(v)
+		case "abortPercent":
+			abortPercent, err = parsePercent(v)
+		case "abortAfterBytes":
+			f.AbortAfterBytes, err = strconv.ParseInt(v, 10, 64)
+			if err == nil && f.AbortAfterBytes < 0 {
+				err = fmt.Errorf("negative bytes")
+			}
+		default:
+			err = util.ErrUnknownOption
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if f.Delay.FixedDelay > 0 {
+		f.Delay.Percent = 100
+		if delayPercent >= 0 {
+			f.Delay.Percent = delayPercent
+		}
+	}
+	// abortAfterBytes alone aborts all the connections
+	if abortPercent >= 0 {
+		f.Abort.Percent = abortPercent
+	} else if f.AbortAfterBytes > 0 {
+		f.Abort.Percent = 100
+	}
+	return f, nil
+}
+
+func parsePercent(v string) (float64, error) {
+	p, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, err
+	}
+	if !(p >= 0 && p <= 100) {
+		return 0, fmt.Errorf("percent must be in range 0..100")
+	}
+	return p, nil
+}
+
+// hit returns true by the chance of percent
+func hit(percent float64) bool {
+	return percent >= 100 || (percent > 0 && rand.Float64()*100 < percent)
+}
+
+// Delayed returns the delay to inject by the percent of the delay, 0 if it isn't applied
+func Delayed(d Delay) time.Duration {
+	if d.FixedDelay > 0 && hit(d.Percent) {
+		return d.FixedDelay
+	}
+	return 0
+}
+
+// Aborted returns true if the abort is applied by its percent
+func Aborted(a Abort) bool {
+	return hit(a.Percent)
+}
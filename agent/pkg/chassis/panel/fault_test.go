@@ -0,0 +1,68 @@
+package panel
+
+import (
+	"testing"
+	"time"
+
+	apiv1alpha3 "istio.io/api/networking/v1alpha3"
+)
+
+func TestParseTCPFault(t *testing.T) {
+	f, err := parseTCPFault("delay=2s, delayPercent=50, abortAfterBytes=1024")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Delay.FixedDelay != 2*time.Second || f.Delay.Percent != 50 {
+		t.Errorf("delay = %+v, want 2s of 50%%", f.Delay)
+	}
+	// abortAfterBytes alone aborts all the connections
+	if f.AbortAfterBytes != 1024 || f.Abort.Percent != 100 {
+		t.Errorf("abort = %+v after %d bytes, want 100%% after 1024 bytes", f.Abort, f.AbortAfterBytes)
+	}
+
+	for _, value := range []string{"delay=2", "abortPercent=101", "abortPercent=NaN", "abortAfterBytes=-1"} {
+		if _, err = parseTCPFault(value); err == nil {
+			t.Errorf("parse %q should fail", value)
+		}
+	}
+}
+
+func TestHit(t *testing.T) {
+	if hit(0) || !hit(100) {
+		t.Errorf("hit of 0%% or 100%% isn't certain")
+	}
+	// 0.1% hits about 100 times of 100000, it would be 1000 times if rounded to 1%
+	hits := 0
+	for i := 0; i < 100000; i++ {
+		if hit(0.1) {
+			hits++
+		}
+	}
+	if hits > 300 {
+		t.Errorf("0.1%% hits %d times of 100000", hits)
+	}
+}
+
+func TestHTTPFault(t *testing.T) {
+	f := httpFault(&apiv1alpha3.HTTPFaultInjection{
+		Abort: &apiv1alpha3.HTTPFaultInjection_Abort{
+			ErrorType:  &apiv1alpha3.HTTPFaultInjection_Abort_HttpStatus{HttpStatus: 503},
+			Percentage: &apiv1alpha3.Percent{Value: 0.1},
+		},
+	})
+	if f.Abort.HTTPStatus != 503 || f.Abort.Percent != 0.1 {
+		t.Errorf("abort = %+v, want 503 of 0.1%%", f.Abort)
+	}
+	if f.Delay.FixedDelay != 0 {
+		t.Errorf("delay = %+v, want none", f.Delay)
+	}
+	// the fault without percentage applies to all the requests
+	f = httpFault(&apiv1alpha3.HTTPFaultInjection{
+		Abort: &apiv1alpha3.HTTPFaultInjection_Abort{
+			ErrorType: &apiv1alpha3.HTTPFaultInjection_Abort_HttpStatus{HttpStatus: 500},
+		},
+	})
+	if !Aborted(f.Abort) {
+		t.Errorf("abort without percentage isn't applied")
+	}
+}
@@ -2,27 +2,15 @@ package panel
 
 import (
 	"github.com/go-chassis/go-chassis/control"
-	"github.com/go-chassis/go-chassis/core/config/model"
 	"github.com/go-chassis/go-chassis/core/invocation"
-	"github.com/go-chassis/go-chassis/third_party/forked/afex/hystrix-go/hystrix"
 )
 
 type EdgePanel struct {
 }
 
-func (ep *EdgePanel) GetCircuitBreaker(inv invocation.Invocation, serviceType string) (string, hystrix.CommandConfig) {
-	return "", hystrix.CommandConfig{}
-}
-
 func (ep *EdgePanel) GetLoadBalancing(inv invocation.Invocation) control.LoadBalancingConfig {
 	return control.LoadBalancingConfig{}
 }
-func (ep *EdgePanel) GetRateLimiting(inv invocation.Invocation, serviceType string) control.RateLimitingConfig {
-	return control.RateLimitingConfig{}
-}
-func (ep *EdgePanel) GetFaultInjection(inv invocation.Invocation) model.Fault {
-	return model.Fault{}
-}
 func (ep *EdgePanel) GetEgressRule() []control.EgressConfig {
 	return []control.EgressConfig{}
 }
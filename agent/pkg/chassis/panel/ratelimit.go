@@ -0,0 +1,283 @@
+package panel
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chassis/go-chassis/control"
+	"github.com/go-chassis/go-chassis/core/invocation"
+	"k8s.io/klog/v2"
+
+	"github.com/kubeedge/edgemesh/agent/pkg/chassis/controller"
+	"github.com/kubeedge/edgemesh/agent/pkg/chassis/loadbalancer/sessionaffinity"
+	"github.com/kubeedge/edgemesh/common/util"
+)
+
+const (
+	// RateLimitAnnotation is the service annotation to limit the rate of the http requests
+	// and tcp connections of the service, e.g. "qps=100,burst=200,perClientIP=true". The
+	// burst defaults to qps, and the limit applies to each client ip if perClientIP is true.
+	RateLimitAnnotation = "edgemesh.kubeedge.io/rate-limit"
+	// RouteRateLimitAnnotation is the virtual service annotation to limit the rate of the
+	// requests of its named http routes, e.g. "canary:qps=10;v1:qps=100,perClientIP=true".
+	// The route limits apply in addition to the limit of the destination service.
+	RouteRateLimitAnnotation = "edgemesh.kubeedge.io/route-rate-limits"
+	// RouteMetadata is the invocation metadata key of the http route the request is routed
+	// to, in the form of namespace/virtualservice/route
+	RouteMetadata = "httpRoute"
+)
+
+// bucketSweepInterval is the interval to remove the idle token buckets, e.g. the ones of
+// the clients gone
+const bucketSweepInterval = time.Minute
+
+var (
+	buckets   sync.Map
+	sweepMu   sync.Mutex
+	lastSweep time.Time
+)
+
+// rateLimit is a token bucket limit
+type rateLimit struct {
+	qps         float64
+	burst       int
+	perClientIP bool
+}
+
+// parseRateLimit parses a rate limit of RateLimitAnnotation
+func parseRateLimit(value string) (rateLimit, error) {
+	var limit rateLimit
+	err := util.ParseOptions(value, "rate limit", func(key, v string) (err error) {
+		switch key {
+		case "qps":
+			limit.qps, err = strconv.ParseFloat(v, 64)
+			if err == nil && (limit.qps <= 0 || math.IsInf(limit.qps, 0)) {
+				err = fmt.Errorf("qps must be positive")
+			}
+		case "burst":
+			limit.burst, err = strconv.Atoi(v)
+			if err == nil && limit.burst <= 0 {
+				err = fmt.Errorf("burst must be positive")
+			}
+		case "perClientIP":
+			limit.perClientIP, err = strconv.ParseBool(v)
+		default:
+			err = util.ErrUnknownOption
+		}
+		return err
+	})
+	if err != nil {
+		return limit, err
+	}
+	if limit.qps == 0 {
+		return limit, fmt.Errorf("qps is required")
+	}
+	if limit.burst == 0 {
+		limit.burst = int(math.Max(1, math.Ceil(limit.qps)))
+	}
+	return limit, nil
+}
+
+// parseRouteRateLimits parses the value of RouteRateLimitAnnotation to the rate limits
+// by route name
+func parseRouteRateLimits(value string) (map[string]rateLimit, error) {
+	limits := make(map[string]rateLimit)
+	for _, item := range strings.Split(value, ";") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		pair := strings.SplitN(item, ":", 2)
+		if len(pair) != 2 || strings.TrimSpace(pair[0]) == "" {
+			return nil, fmt.Errorf("invalid route rate limit %q", item)
+		}
+		limit, err := parseRateLimit(pair[1])
+		if err != nil {
+			return nil, err
+		}
+		limits[strings.TrimSpace(pair[0])] = limit
+	}
+	return limits, nil
+}
+
+// GetRateLimiting returns the rate limit of the destination service of the invocation
+func (ep *EdgePanel) GetRateLimiting(inv invocation.Invocation, serviceType string) control.RateLimitingConfig {
+	key, limit, ok := serviceRateLimit(&inv)
+	if !ok {
+		return control.RateLimitingConfig{}
+	}
+	return control.RateLimitingConfig{
+		Key:     key,
+		Enabled: true,
+		Rate:    int(math.Ceil(limit.qps)),
+	}
+}
+
+// serviceRateLimit returns the rate limit of the destination service and its key
+func serviceRateLimit(inv *invocation.Invocation) (string, rateLimit, bool) {
+	namespace, name, _, _ := serviceOf(inv)
+	svc, err := controller.APIConn.GetSvcLister().Services(namespace).Get(name)
+	if err != nil {
+		return "", rateLimit{}, false
+	}
+	value, ok := svc.Annotations[RateLimitAnnotation]
+	if !ok {
+		return "", rateLimit{}, false
+	}
+	key := fmt.Sprintf("%s.%s", namespace, name)
+	limit, err := parseRateLimit(value)
+	if err != nil {
+		klog.Errorf("parse rate limit of svc %s err: %v", key, err)
+		return "", rateLimit{}, false
+	}
+	return key, limit, true
+}
+
+// routeRateLimit returns the rate limit of the http route of the invocation and its key
+func routeRateLimit(inv *invocation.Invocation) (string, rateLimit, bool) {
+	route, _ := inv.Metadata[RouteMetadata].(string)
+	names := strings.SplitN(route, "/", 3)
+	if len(names) != 3 {
+		return "", rateLimit{}, false
+	}
+	vs, err := controller.APIConn.GetVsLister().VirtualServices(names[0]).Get(names[1])
+	if err != nil {
+		return "", rateLimit{}, false
+	}
+	value, ok := vs.Annotations[RouteRateLimitAnnotation]
+	if !ok {
+		return "", rateLimit{}, false
+	}
+	limits, err := parseRouteRateLimits(value)
+	if err != nil {
+		klog.Errorf("parse route rate limits of virtual service %s.%s err: %v", names[0], names[1], err)
+		return "", rateLimit{}, false
+	}
+	limit, ok := limits[names[2]]
+	return route, limit, ok
+}
+
+// Allow returns true if the http request or tcp connection of the invocation is allowed
+// by the rate limits of its destination service and http route. It takes a token from
+// each of the limits only if all of them have one, so it's called once per request or
+// connection, not per attempt.
+func Allow(inv *invocation.Invocation) bool {
+	clientIP, _ := inv.Metadata[sessionaffinity.ClientIPMetadata].(string)
+	now := time.Now()
+	sweepBuckets(now)
+	var names []string
+	var limited []*tokenBucket
+	// the route bucket is always locked before the service one, so they don't deadlock
+	if key, limit, ok := routeRateLimit(inv); ok {
+		names = append(names, "route "+key)
+		limited = append(limited, getBucket(key, limit, clientIP, now))
+	}
+	if key, limit, ok := serviceRateLimit(inv); ok {
+		names = append(names, "svc "+key)
+		limited = append(limited, getBucket(key, limit, clientIP, now))
+	}
+	if i := takeAll(limited, now); i >= 0 {
+		klog.V(4).Infof("%s of %s from %s is rate limited by %s", inv.Protocol, inv.MicroServiceName, clientIP, names[i])
+		return false
+	}
+	return true
+}
+
+// getBucket returns the bucket of the limit, the bucket is recreated if the limit changes,
+// and it's per client ip if the limit asks for it
+func getBucket(key string, limit rateLimit, clientIP string, now time.Time) *tokenBucket {
+	bucketKey := fmt.Sprintf("%s|%g|%d", key, limit.qps, limit.burst)
+	if limit.perClientIP {
+		bucketKey += "|" + clientIP
+	}
+	v, ok := buckets.Load(bucketKey)
+	if !ok {
+		v, _ = buckets.LoadOrStore(bucketKey, newTokenBucket(limit.qps, limit.burst, now))
+	}
+	return v.(*tokenBucket)
+}
+
+// takeAll takes a token from each of the buckets if all of them have one, otherwise it
+// returns the index of the first bucket without token and takes nothing
+func takeAll(limited []*tokenBucket, now time.Time) int {
+	for _, b := range limited {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+	}
+	for i, b := range limited {
+		if !b.refill(now) {
+			return i
+		}
+	}
+	for _, b := range limited {
+		b.tokens--
+	}
+	return -1
+}
+
+// sweepBuckets removes the buckets idle for bucketSweepInterval, it runs every interval
+func sweepBuckets(now time.Time) {
+	sweepMu.Lock()
+	if now.Sub(lastSweep) < bucketSweepInterval {
+		sweepMu.Unlock()
+		return
+	}
+	lastSweep = now
+	sweepMu.Unlock()
+	buckets.Range(func(key, value interface{}) bool {
+		if value.(*tokenBucket).idle(now) >= bucketSweepInterval {
+			buckets.Delete(key)
+		}
+		return true
+	})
+}
+
+// tokenBucket is filled with qps tokens per second up to burst tokens
+type tokenBucket struct {
+	mu     sync.Mutex
+	qps    float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(qps float64, burst int, now time.Time) *tokenBucket {
+	return &tokenBucket{
+		qps:    qps,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   now,
+	}
+}
+
+// take takes a token if there's any
+func (b *tokenBucket) take(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.refill(now) {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// refill fills the tokens elapsed since last time, and returns true if there's a token.
+// b.mu must be held.
+func (b *tokenBucket) refill(now time.Time) bool {
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = math.Min(b.burst, b.tokens+elapsed.Seconds()*b.qps)
+		b.last = now
+	}
+	return b.tokens >= 1
+}
+
+// idle returns the duration since the bucket was last taken
+func (b *tokenBucket) idle(now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return now.Sub(b.last)
+}
@@ -0,0 +1,83 @@
+package panel
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	limit, err := parseRateLimit("qps=0.5, perClientIP=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limit.qps != 0.5 || limit.burst != 1 || !limit.perClientIP {
+		t.Errorf("rate limit = %+v", limit)
+	}
+	for _, value := range []string{"", "burst=10", "qps=0", "qps=10,burst=0"} {
+		if _, err = parseRateLimit(value); err == nil {
+			t.Errorf("parse %q should fail", value)
+		}
+	}
+
+	limits, err := parseRouteRateLimits("canary:qps=10,burst=20; v1:qps=100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(limits) != 2 || limits["canary"].burst != 20 || limits["v1"].qps != 100 {
+		t.Errorf("route rate limits = %+v", limits)
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	b := newTokenBucket(2, 2, now)
+	if !b.take(now) || !b.take(now) {
+		t.Fatalf("burst tokens aren't available")
+	}
+	if b.take(now) {
+		t.Fatalf("token taken beyond the burst")
+	}
+	// 2 tokens per second
+	if !b.take(now.Add(500 * time.Millisecond)) {
+		t.Errorf("token isn't refilled")
+	}
+	if b.take(now.Add(500 * time.Millisecond)) {
+		t.Errorf("token refilled too fast")
+	}
+	// refilled up to the burst only
+	later := now.Add(time.Hour)
+	for i := 0; i < 2; i++ {
+		if !b.take(later) {
+			t.Fatalf("token %d isn't refilled", i)
+		}
+	}
+	if b.take(later) {
+		t.Errorf("tokens refilled beyond the burst")
+	}
+}
+
+func TestTakePerClientIP(t *testing.T) {
+	limit := rateLimit{qps: 1, burst: 1, perClientIP: true}
+	now := time.Now()
+	if !getBucket("default.nginx", limit, "10.0.0.1", now).take(now) || !getBucket("default.nginx", limit, "10.0.0.2", now).take(now) {
+		t.Fatalf("clients don't have their own buckets")
+	}
+	if getBucket("default.nginx", limit, "10.0.0.1", now).take(now) {
+		t.Errorf("client isn't limited")
+	}
+}
+
+func TestTakeAll(t *testing.T) {
+	now := time.Now()
+	route, svc := newTokenBucket(1, 2, now), newTokenBucket(1, 1, now)
+	if takeAll([]*tokenBucket{route, svc}, now) != -1 {
+		t.Fatalf("tokens of both buckets aren't taken")
+	}
+	// the service bucket is empty, so the route bucket keeps its token
+	if i := takeAll([]*tokenBucket{route, svc}, now); i != 1 {
+		t.Fatalf("limited by bucket %d, want 1", i)
+	}
+	if !route.take(now) {
+		t.Errorf("token of the route bucket is taken by a limited request")
+	}
+}
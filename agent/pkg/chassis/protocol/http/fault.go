@@ -0,0 +1,33 @@
+package http
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"github.com/kubeedge/edgemesh/agent/pkg/chassis/panel"
+)
+
+// injectFault delays and aborts the request by the fault of the http route. It returns true if the request is aborted and the
+// response is written, the request mustn't be forwarded then.
+func (p *HTTP) injectFault(req *http.Request) bool {
+	if p.httpRoute.GetFault() == nil {
+		return false
+	}
+	inv := p.newInvocation(context.Background(), req, nil)
+	fault := panel.GetFault(inv)
+	if delay := panel.Delayed(fault.Delay); delay > 0 {
+		klog.V(4).Infof("inject delay %v to %s %s of svc %s.%s", delay, req.Method, req.URL, p.SvcNamespace, p.SvcName)
+		time.Sleep(delay)
+	}
+	if fault.Abort.HTTPStatus == 0 || !panel.Aborted(fault.Abort) {
+		return false
+	}
+	klog.V(4).Infof("inject abort %d to %s %s of svc %s.%s", fault.Abort.HTTPStatus, req.Method, req.URL, p.SvcNamespace, p.SvcName)
+	if err := p.responseError(fault.Abort.HTTPStatus, "fault filter abort"); err != nil {
+		klog.Errorf("write http response err: %v", err)
+	}
+	return true
+}
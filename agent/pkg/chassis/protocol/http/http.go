@@ -24,10 +24,9 @@ import (
 	"fmt"
 	"github.com/kubeedge/edgemesh/agent/pkg/chassis/controller"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
-	"regexp"
-	"strings"
 
 	"github.com/go-chassis/go-chassis/core/common"
 	"github.com/go-chassis/go-chassis/core/handler"
@@ -36,10 +35,39 @@ import (
 	istioapi "istio.io/client-go/pkg/apis/networking/v1alpha3"
 	"k8s.io/klog/v2"
 
+	"github.com/kubeedge/edgemesh/agent/pkg/chassis/loadbalancer/leastconn"
+	"github.com/kubeedge/edgemesh/agent/pkg/chassis/loadbalancer/retry"
+	"github.com/kubeedge/edgemesh/agent/pkg/chassis/loadbalancer/sessionaffinity"
 	"github.com/kubeedge/edgemesh/agent/pkg/chassis/loadbalancer/util"
+	"github.com/kubeedge/edgemesh/agent/pkg/chassis/panel"
+	"github.com/kubeedge/edgemesh/agent/pkg/chassis/protocol"
 	"github.com/kubeedge/edgemesh/agent/pkg/chassis/protocol/tcp"
+	"github.com/kubeedge/edgemesh/agent/pkg/chassis/registry"
 )
 
+// maxRedirectDrain is the max bytes of the body of a redirected request drained to keep
+// the connection
+const maxRedirectDrain = 256 << 10
+
+func init() {
+	err := protocol.Register(protocol.ProtocolHTTP, newHTTP)
+	if err != nil {
+		klog.Errorf("register http protocol err: %v", err)
+	}
+}
+
+func newHTTP(opts *protocol.Options) (protocol.Protocol, error) {
+	return &HTTP{
+		Conn:           opts.Conn,
+		VirtualService: opts.VirtualService,
+		SvcName:        opts.SvcName,
+		SvcNamespace:   opts.SvcNamespace,
+		Port:           opts.Port,
+		External:       opts.External,
+		Subset:         opts.Subset,
+	}, nil
+}
+
 // HTTP http
 type HTTP struct {
 	Conn           net.Conn
@@ -49,10 +77,28 @@ type HTTP struct {
 	Port           int
 	Req            *http.Request
 	Resp           *http.Response
+	// External indicates the connection comes from outside the cluster
+	External bool
+	// Subset is the subset of the destination rule the request is routed to
+	Subset string
+
+	// the http route and destination the request is routed to, and the match request
+	// of the route matching the request
+	httpRoute  *apiv1alpha3.HTTPRoute
+	routeMatch *apiv1alpha3.HTTPMatchRequest
+	routeDest  *apiv1alpha3.HTTPRouteDestination
+	// closeConn indicates the connection is closed after the response, since it has
+	// served maxRequestsPerConnection requests of the connection pool
+	closeConn bool
 }
 
 // Process process
 func (p *HTTP) Process() {
+	// the service and port the connection is destined to, the requests matching no http
+	// route of a mesh virtual service are forwarded to them
+	svcName, svcNamespace, port, subset := p.SvcName, p.SvcNamespace, p.Port, p.Subset
+	// the number of requests served by the connection
+	requests := 0
 	for {
 		// parse http request
 		req, err := http.ReadRequest(bufio.NewReader(p.Conn))
@@ -75,7 +121,8 @@ func (p *HTTP) Process() {
 
 		// route
 		if p.VirtualService != nil {
-			err = p.route(req.RequestURI)
+			p.SvcName, p.SvcNamespace, p.Port, p.Subset = svcName, svcNamespace, port, subset
+			err = p.route(req, port)
 			if err != nil {
 				klog.Errorf("route by http request uri err: %v", err)
 				err = p.Conn.Close()
@@ -84,6 +131,26 @@ func (p *HTTP) Process() {
 				}
 				return
 			}
+			// redirect the request without forwarding it
+			if p.httpRoute.GetRedirect() != nil {
+				if err = p.redirect(req); err != nil || p.closeConn {
+					if err != nil {
+						klog.Errorf("redirect http request err: %v", err)
+					}
+					err = p.Conn.Close()
+					if err != nil {
+						klog.Errorf("close conn err: %v", err)
+					}
+					return
+				}
+				continue
+			}
+			if err = rewriteRequest(req, p.httpRoute.GetRewrite(), p.routeMatch); err != nil {
+				klog.Errorf("rewrite http request err: %v", err)
+			}
+			for _, ops := range p.requestHeaderOperations() {
+				applyHeaderOperations(req.Header, ops)
+			}
 		}
 
 		// websocket
@@ -104,6 +171,8 @@ func (p *HTTP) Process() {
 				SvcName:      p.SvcName,
 				Port:         p.Port,
 				UpgradeReq:   reqBytes,
+				External:     p.External,
+				Subset:       p.Subset,
 			}
 			websocket.Process()
 			return
@@ -112,20 +181,8 @@ func (p *HTTP) Process() {
 		// http: Request.RequestURI can't be set in client requests, just reset it
 		req.RequestURI = ""
 
-		// create invocation
-		inv := invocation.New(context.Background())
-
-		// set invocation
-		inv.MicroServiceName = fmt.Sprintf("%s.%s.svc.cluster.local:%d", p.SvcName, p.SvcNamespace, p.Port)
-		inv.SourceServiceID = ""
-		inv.Protocol = "rest"
-
-		inv.Strategy = util.GetStrategyName(p.SvcNamespace, p.SvcName)
-		inv.Args = req
-		inv.Reply = &http.Response{}
-
 		// create handler chain
-		c, err := handler.CreateChain(common.Consumer, "http", handler.Loadbalance, handler.Transport)
+		c, err := handler.CreateChain(common.Consumer, "http", panel.ConnectionPoolHandlerName, handler.Loadbalance, leastconn.ActiveCounterHandlerName, handler.Transport)
 		if err != nil {
 			klog.Errorf("create handler chain error: %v", err)
 			err = p.Conn.Close()
@@ -135,52 +192,102 @@ func (p *HTTP) Process() {
 			return
 		}
 
+		// the upstream connections are pooled by the transport, so the requests per
+		// connection of the connection pool limit the requests of the client connection
+		requests++
+		maxRequests := panel.GetConnectionPool(p.SvcNamespace, p.SvcName, p.Port, p.Subset).GetHttp().GetMaxRequestsPerConnection()
+		p.closeConn = maxRequests > 0 && requests >= int(maxRequests)
+
 		// start to handle
 		p.Req = req
-		c.Next(inv, p.responseCallback)
+		p.invoke(c, req)
+		if p.closeConn {
+			klog.V(4).Infof("close conn from %s after %d requests", p.Conn.RemoteAddr(), requests)
+			err = p.Conn.Close()
+			if err != nil {
+				klog.Errorf("close conn err: %v", err)
+			}
+			return
+		}
 	}
 }
 
-func uriMatch(sm *apiv1alpha3.StringMatch, reqURI string) bool {
-	if (sm.GetExact() != "" && sm.GetExact() == reqURI) || (sm.GetPrefix() != "" && strings.HasPrefix(reqURI, sm.GetPrefix())) {
-		return true
+// newInvocation creates an invocation of the request excluding the endpoints failed by
+// previous attempts, ctx bounds the invocation
+func (p *HTTP) newInvocation(ctx context.Context, req *http.Request, failed []string) *invocation.Invocation {
+	// create invocation
+	inv := invocation.New(ctx)
+
+	// set invocation
+	inv.MicroServiceName = fmt.Sprintf("%s.%s.svc.cluster.local:%d", p.SvcName, p.SvcNamespace, p.Port)
+	inv.SourceServiceID = ""
+	if p.External {
+		inv.SourceServiceID = registry.ExternalConsumerID
 	}
-	if rg := sm.GetRegex(); rg != "" {
-		uriPattern, err := regexp.Compile(rg)
-		if err != nil {
-			klog.Errorf("string match regex compile err: %v", err)
-		}
-		if uriPattern.Match([]byte(reqURI)) {
-			return true
-		}
+	inv.Protocol = "rest"
+
+	inv.RouteTags = registry.SubsetTags(p.Subset)
+	inv.Strategy = util.GetStrategyName(p.SvcNamespace, p.SvcName, p.Subset)
+	inv.Args = req.WithContext(ctx)
+	inv.Reply = &http.Response{}
+	sessionaffinity.SetClientIP(inv, p.Conn.RemoteAddr())
+	if fault := p.httpRoute.GetFault(); fault != nil {
+		inv.SetMetadata(panel.HTTPFaultMetadata, fault)
 	}
-	return false
+	if name := p.httpRoute.GetName(); name != "" && p.VirtualService != nil {
+		inv.SetMetadata(panel.RouteMetadata, fmt.Sprintf("%s/%s/%s", p.VirtualService.Namespace, p.VirtualService.Name, name))
+	}
+	for _, ep := range failed {
+		retry.Exclude(inv, ep)
+	}
+	return inv
 }
 
-// route updates service meta
-func (p *HTTP) route(requestURI string) error {
+// route updates service meta by the first http route matching the request, port is the
+// port the connection is destined to, used if the destination doesn't specify one. The
+// request matching no route is forwarded to the service it's destined to if it comes from
+// the mesh, since the mesh virtual service applies to all the requests of the service.
+func (p *HTTP) route(req *http.Request, port int) error {
 	if p.VirtualService == nil {
 		return errors.New("virtual service nil")
 	}
+	p.httpRoute, p.routeMatch, p.routeDest = nil, nil, nil
 	for _, httpRoute := range p.VirtualService.Spec.Http {
-		for _, httpMatchRequest := range httpRoute.Match {
-			if ok := uriMatch(httpMatchRequest.Uri, requestURI); ok && len(httpRoute.Route) > 0 {
-				svcName := httpRoute.Route[0].Destination.Host
-				svcNamespace := p.VirtualService.Namespace
-				// find a service
-				key := fmt.Sprintf("%s.%s", svcNamespace, svcName)
-				if _, err := controller.APIConn.GetSvcLister().Services(svcNamespace).Get(svcName); err != nil {
-					return fmt.Errorf("service bound to the destination %s does not exist, reason: %v", key, err)
-				}
-				klog.Infof("destination svc is %s", key)
-				p.SvcName = svcName
-				p.SvcNamespace = svcNamespace
-				p.Port = int(httpRoute.Route[0].Destination.Port.Number)
-				return nil
-			}
+		if len(httpRoute.Route) == 0 && httpRoute.Redirect == nil {
+			continue
+		}
+		match, ok := p.httpRouteMatch(httpRoute, req, port)
+		if !ok {
+			continue
+		}
+		p.httpRoute, p.routeMatch, p.routeDest = httpRoute, match, nil
+		if httpRoute.Redirect != nil {
+			return nil
 		}
+		// pick a destination by weight per request, e.g. canary release
+		dest := protocol.PickHTTPDestination(httpRoute.Route)
+		svcName, svcNamespace := protocol.DestinationService(dest.Destination.Host, p.VirtualService.Namespace)
+		// find a service
+		key := fmt.Sprintf("%s.%s", svcNamespace, svcName)
+		if _, err := controller.APIConn.GetSvcLister().Services(svcNamespace).Get(svcName); err != nil {
+			return fmt.Errorf("service bound to the destination %s does not exist, reason: %v", key, err)
+		}
+		klog.Infof("destination svc is %s", key)
+		p.SvcName = svcName
+		p.SvcNamespace = svcNamespace
+		p.Port = port
+		if n := dest.Destination.GetPort().GetNumber(); n != 0 {
+			p.Port = int(n)
+		}
+		p.Subset = dest.Destination.Subset
+		p.routeDest = dest
+		return nil
 	}
-	return fmt.Errorf("no match svc found for uri %s", requestURI)
+	if !p.External {
+		klog.V(4).Infof("no http route matches %s %s, forward it to svc %s.%s", req.Method, req.RequestURI, p.SvcNamespace, p.SvcName)
+		return nil
+	}
+	return fmt.Errorf("no match svc found for %s %s", req.Method, req.RequestURI)
 }
 
 // responseCallback process invocation response
@@ -207,6 +314,12 @@ func (p *HTTP) responseCallback(data *invocation.Response) error {
 		}
 		return fmt.Errorf(errMsg)
 	}
+	for _, ops := range p.responseHeaderOperations() {
+		applyHeaderOperations(resp.Header, ops)
+	}
+	if p.closeConn {
+		resp.Close = true
+	}
 	respBytes, err := httpResponseToBytes(resp)
 	if err != nil {
 		errMsg = "http response to bytes failed"
@@ -223,14 +336,52 @@ func (p *HTTP) responseCallback(data *invocation.Response) error {
 	return nil
 }
 
+// allow returns true if the request is allowed by the rate limits, otherwise 429 is
+// written to http conn
+func (p *HTTP) allow(req *http.Request) bool {
+	if panel.Allow(p.newInvocation(context.Background(), req, nil)) {
+		return true
+	}
+	if err := p.responseError(http.StatusTooManyRequests, "local rate limited"); err != nil {
+		klog.Errorf("write http response err: %v", err)
+	}
+	return false
+}
+
+// redirect writes the response redirecting the request to http conn. The request body
+// is drained to read the next request of the connection, the connection is closed after
+// the response if the body exceeds maxRedirectDrain.
+func (p *HTTP) redirect(req *http.Request) error {
+	_, err := io.CopyN(ioutil.Discard, req.Body, maxRedirectDrain)
+	p.closeConn = err != io.EOF
+	resp := redirectResponse(req, p.httpRoute.Redirect, p.requestScheme())
+	resp.Close = p.closeConn
+	for _, ops := range p.responseHeaderOperations() {
+		applyHeaderOperations(resp.Header, ops)
+	}
+	klog.V(4).Infof("redirect %s to %s", req.RequestURI, resp.Header.Get("Location"))
+	respBytes, err := httpResponseToBytes(resp)
+	if err != nil {
+		return err
+	}
+	_, err = p.Conn.Write(respBytes)
+	return err
+}
+
 // responseUnavailable return 503 to http conn
 func (p *HTTP) responseUnavailable(errMsg string) error {
+	return p.responseError(http.StatusServiceUnavailable, errMsg)
+}
+
+// responseError return the error status to http conn
+func (p *HTTP) responseError(code int, errMsg string) error {
 	resp := &http.Response{
-		Status:     fmt.Sprintf("%d %s", http.StatusServiceUnavailable, errMsg),
-		StatusCode: http.StatusServiceUnavailable,
+		Status:     fmt.Sprintf("%d %s", code, errMsg),
+		StatusCode: code,
 		Proto:      p.Req.Proto,
 		Request:    p.Req,
 		Header:     make(http.Header),
+		Close:      p.closeConn,
 	}
 	respBytes, err := httpResponseToBytes(resp)
 	if err != nil {
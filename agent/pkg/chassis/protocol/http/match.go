@@ -0,0 +1,163 @@
+package http
+
+import (
+	"crypto/tls"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+
+	apiv1alpha3 "istio.io/api/networking/v1alpha3"
+	"k8s.io/klog/v2"
+
+	"github.com/kubeedge/edgemesh/agent/pkg/chassis/controller"
+)
+
+// regexCache caches the compiled regex of the string matches, a regex failing to
+// compile is cached as nil so it's reported once and never matches
+var regexCache sync.Map
+
+func compileRegex(expr string) *regexp.Regexp {
+	if re, ok := regexCache.Load(expr); ok {
+		return re.(*regexp.Regexp)
+	}
+	// the regex of istio must match the whole string
+	re, err := regexp.Compile("^(?:" + expr + ")$")
+	if err != nil {
+		klog.Errorf("string match regex %s compile err: %v", expr, err)
+		re = nil
+	}
+	regexCache.Store(expr, re)
+	return re
+}
+
+// stringMatch returns true if s matches the string match, a nil string match or one
+// without match type matches any string
+func stringMatch(sm *apiv1alpha3.StringMatch, s string, ignoreCase bool) bool {
+	if sm == nil {
+		return true
+	}
+	switch m := sm.MatchType.(type) {
+	case *apiv1alpha3.StringMatch_Exact:
+		if ignoreCase {
+			return strings.EqualFold(m.Exact, s)
+		}
+		return m.Exact == s
+	case *apiv1alpha3.StringMatch_Prefix:
+		if ignoreCase {
+			return strings.HasPrefix(strings.ToLower(s), strings.ToLower(m.Prefix))
+		}
+		return strings.HasPrefix(s, m.Prefix)
+	case *apiv1alpha3.StringMatch_Regex:
+		expr := m.Regex
+		if ignoreCase {
+			expr = "(?i)" + expr
+		}
+		re := compileRegex(expr)
+		return re != nil && re.MatchString(s)
+	}
+	return true
+}
+
+// headerValue returns the value of the header of the request, the pseudo headers of
+// http2 are mapped to the fields of the request
+func headerValue(req *http.Request, name string) (string, bool) {
+	switch strings.ToLower(name) {
+	case ":authority", "host":
+		return req.Host, req.Host != ""
+	case ":method":
+		return req.Method, true
+	case ":path":
+		return req.RequestURI, true
+	}
+	values, ok := req.Header[http.CanonicalHeaderKey(name)]
+	if !ok || len(values) == 0 {
+		return "", false
+	}
+	return values[0], true
+}
+
+// requestPath returns the path of the request uri without the query
+func requestPath(req *http.Request) string {
+	if i := strings.IndexByte(req.RequestURI, '?'); i >= 0 {
+		return req.RequestURI[:i]
+	}
+	return req.RequestURI
+}
+
+// requestScheme returns https if the connection is terminated by tls, e.g. edgegateway
+func (p *HTTP) requestScheme() string {
+	if _, ok := p.Conn.(*tls.Conn); ok {
+		return "https"
+	}
+	return "http"
+}
+
+// httpMatch returns true if the request matches all the conditions of the match request.
+// The source labels and source namespace conditions aren't supported and are ignored.
+func (p *HTTP) httpMatch(m *apiv1alpha3.HTTPMatchRequest, req *http.Request, port int) bool {
+	if !stringMatch(m.Uri, requestPath(req), m.IgnoreUriCase) {
+		return false
+	}
+	if !stringMatch(m.Method, req.Method, false) || !stringMatch(m.Scheme, p.requestScheme(), false) {
+		return false
+	}
+	if !stringMatch(m.Authority, req.Host, false) {
+		return false
+	}
+	if m.Port != 0 && int(m.Port) != port {
+		return false
+	}
+	if !p.gatewayMatch(m.Gateways) {
+		return false
+	}
+	for name, sm := range m.Headers {
+		value, ok := headerValue(req, name)
+		if !ok || !stringMatch(sm, value, false) {
+			return false
+		}
+	}
+	for name, sm := range m.WithoutHeaders {
+		if value, ok := headerValue(req, name); ok && stringMatch(sm, value, false) {
+			return false
+		}
+	}
+	if len(m.QueryParams) > 0 {
+		query := req.URL.Query()
+		for name, sm := range m.QueryParams {
+			values, ok := query[name]
+			if !ok || !stringMatch(sm, values[0], false) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// gatewayMatch returns true if the gateways of a match condition apply to the request,
+// the traffic of edgegateway comes from the gateway the virtual service is bound to
+func (p *HTTP) gatewayMatch(gateways []string) bool {
+	if len(gateways) == 0 {
+		return true
+	}
+	for _, gw := range gateways {
+		if (gw == controller.MeshGateway) != p.External {
+			return true
+		}
+	}
+	return false
+}
+
+// httpRouteMatch returns the first match request of the http route the request matches
+// and true, a route without match requests matches all the requests
+func (p *HTTP) httpRouteMatch(httpRoute *apiv1alpha3.HTTPRoute, req *http.Request, port int) (*apiv1alpha3.HTTPMatchRequest, bool) {
+	if len(httpRoute.Match) == 0 {
+		return nil, true
+	}
+	for _, m := range httpRoute.Match {
+		if p.httpMatch(m, req, port) {
+			return m, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,99 @@
+package http
+
+import (
+	"bufio"
+	"net/http"
+	"strings"
+	"testing"
+
+	apiv1alpha3 "istio.io/api/networking/v1alpha3"
+	istioapi "istio.io/client-go/pkg/apis/networking/v1alpha3"
+)
+
+func exact(s string) *apiv1alpha3.StringMatch {
+	return &apiv1alpha3.StringMatch{MatchType: &apiv1alpha3.StringMatch_Exact{Exact: s}}
+}
+
+func prefix(s string) *apiv1alpha3.StringMatch {
+	return &apiv1alpha3.StringMatch{MatchType: &apiv1alpha3.StringMatch_Prefix{Prefix: s}}
+}
+
+func regex(s string) *apiv1alpha3.StringMatch {
+	return &apiv1alpha3.StringMatch{MatchType: &apiv1alpha3.StringMatch_Regex{Regex: s}}
+}
+
+func TestHTTPMatch(t *testing.T) {
+	raw := "POST /Firmware/v2?arch=arm64&channel=beta HTTP/1.1\r\n" +
+		"Host: firmware.edge\r\n" +
+		"X-Canary: true\r\n" +
+		"\r\n"
+	req, err := http.ReadRequest(bufio.NewReader(strings.NewReader(raw)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &HTTP{}
+
+	cases := []struct {
+		name  string
+		match *apiv1alpha3.HTTPMatchRequest
+		want  bool
+	}{
+		{name: "empty", match: &apiv1alpha3.HTTPMatchRequest{}, want: true},
+		{name: "uri prefix", match: &apiv1alpha3.HTTPMatchRequest{Uri: prefix("/Firmware")}, want: true},
+		{name: "uri exact ignores query", match: &apiv1alpha3.HTTPMatchRequest{Uri: exact("/Firmware/v2")}, want: true},
+		{name: "uri case", match: &apiv1alpha3.HTTPMatchRequest{Uri: prefix("/firmware")}, want: false},
+		{name: "ignore uri case", match: &apiv1alpha3.HTTPMatchRequest{Uri: prefix("/firmware"), IgnoreUriCase: true}, want: true},
+		{name: "uri regex matches whole path", match: &apiv1alpha3.HTTPMatchRequest{Uri: regex("/Firmware")}, want: false},
+		{name: "invalid regex", match: &apiv1alpha3.HTTPMatchRequest{Uri: regex("/Firmware/(")}, want: false},
+		{name: "method", match: &apiv1alpha3.HTTPMatchRequest{Method: exact("GET")}, want: false},
+		{name: "authority", match: &apiv1alpha3.HTTPMatchRequest{Authority: prefix("firmware")}, want: true},
+		{name: "scheme", match: &apiv1alpha3.HTTPMatchRequest{Scheme: exact("https")}, want: false},
+		{name: "header", match: &apiv1alpha3.HTTPMatchRequest{Headers: map[string]*apiv1alpha3.StringMatch{"x-canary": exact("true")}}, want: true},
+		{name: "missing header", match: &apiv1alpha3.HTTPMatchRequest{Headers: map[string]*apiv1alpha3.StringMatch{"x-user": prefix("")}}, want: false},
+		{name: "without header", match: &apiv1alpha3.HTTPMatchRequest{WithoutHeaders: map[string]*apiv1alpha3.StringMatch{"x-canary": exact("true")}}, want: false},
+		{name: "query params", match: &apiv1alpha3.HTTPMatchRequest{QueryParams: map[string]*apiv1alpha3.StringMatch{"arch": regex("arm.*"), "channel": exact("beta")}}, want: true},
+		{name: "all conditions", match: &apiv1alpha3.HTTPMatchRequest{Uri: prefix("/Firmware"), Method: exact("POST"), Headers: map[string]*apiv1alpha3.StringMatch{"x-canary": exact("false")}}, want: false},
+		{name: "port", match: &apiv1alpha3.HTTPMatchRequest{Port: 8080}, want: false},
+		{name: "gateway", match: &apiv1alpha3.HTTPMatchRequest{Gateways: []string{"edgegateway"}}, want: false},
+		{name: "mesh gateway", match: &apiv1alpha3.HTTPMatchRequest{Gateways: []string{"mesh"}}, want: true},
+	}
+	for _, c := range cases {
+		if got := p.httpMatch(c.match, req, 80); got != c.want {
+			t.Errorf("%s: match = %v, want %v", c.name, got, c.want)
+		}
+	}
+
+	// match requests of a route are ORed
+	route := &apiv1alpha3.HTTPRoute{Match: []*apiv1alpha3.HTTPMatchRequest{{Method: exact("GET")}, {Method: exact("POST")}}}
+	if m, ok := p.httpRouteMatch(route, req, 80); !ok || m != route.Match[1] {
+		t.Errorf("route doesn't match any of its match requests")
+	}
+}
+
+func TestRouteUnmatched(t *testing.T) {
+	req, err := http.ReadRequest(bufio.NewReader(strings.NewReader("GET /status HTTP/1.1\r\nHost: firmware.edge\r\n\r\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	vs := &istioapi.VirtualService{}
+	vs.Namespace = "edge"
+	vs.Spec.Http = []*apiv1alpha3.HTTPRoute{{
+		Match: []*apiv1alpha3.HTTPMatchRequest{{Uri: prefix("/firmware")}},
+		Route: []*apiv1alpha3.HTTPRouteDestination{{Destination: &apiv1alpha3.Destination{Host: "firmware-v2"}}},
+	}}
+
+	// the mesh requests matching no route are forwarded to the original service
+	p := &HTTP{VirtualService: vs, SvcName: "firmware", SvcNamespace: "edge", Port: 80, Subset: "v1"}
+	if err := p.route(req, 80); err != nil {
+		t.Fatalf("route mesh request err: %v", err)
+	}
+	if p.SvcName != "firmware" || p.SvcNamespace != "edge" || p.Port != 80 || p.Subset != "v1" || p.httpRoute != nil {
+		t.Errorf("unmatched mesh request is routed to %s.%s:%d %q", p.SvcNamespace, p.SvcName, p.Port, p.Subset)
+	}
+
+	// the external requests must match a route
+	p = &HTTP{VirtualService: vs, External: true}
+	if err := p.route(req, 80); err == nil {
+		t.Errorf("unmatched external request is routed")
+	}
+}
@@ -0,0 +1,233 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/go-chassis/go-chassis/core/handler"
+	"github.com/go-chassis/go-chassis/core/invocation"
+	apiv1alpha3 "istio.io/api/networking/v1alpha3"
+	"k8s.io/klog/v2"
+
+	"github.com/kubeedge/edgemesh/agent/pkg/chassis/registry"
+	"github.com/kubeedge/edgemesh/common/util"
+)
+
+const (
+	// defaultRetryOn is the retry conditions of a retry policy without retryOn
+	defaultRetryOn = "connect-failure,refused-stream,503"
+	// retryBackOff is the base interval between two attempts, it doubles per retry
+	retryBackOff = 25 * time.Millisecond
+	// maxRetryBackOff is the max interval between two attempts
+	maxRetryBackOff = 250 * time.Millisecond
+)
+
+// retryPolicy is the retry policy of a http route
+type retryPolicy struct {
+	// attempts is the number of retries after the first attempt
+	attempts      int
+	perTryTimeout time.Duration
+	retryOn       map[string]bool
+	statusCodes   map[int]bool
+}
+
+// newRetryPolicy returns the retry policy of the http retry, a nil one retries nothing.
+// The conditions of retryOn are a comma separated list of 5xx, gateway-error, reset,
+// connect-failure, refused-stream, retriable-4xx and http status codes.
+func newRetryPolicy(r *apiv1alpha3.HTTPRetry) retryPolicy {
+	policy := retryPolicy{
+		attempts:      int(r.GetAttempts()),
+		perTryTimeout: util.ProtoDuration(r.GetPerTryTimeout()),
+		retryOn:       make(map[string]bool),
+		statusCodes:   make(map[int]bool),
+	}
+	retryOn := r.GetRetryOn()
+	if retryOn == "" {
+		retryOn = defaultRetryOn
+	}
+	for _, cond := range strings.Split(retryOn, ",") {
+		cond = strings.TrimSpace(cond)
+		if code, err := strconv.Atoi(cond); err == nil {
+			policy.statusCodes[code] = true
+		} else if cond != "" {
+			policy.retryOn[cond] = true
+		}
+	}
+	return policy
+}
+
+// retriable returns true if the response of an attempt matches the retry conditions,
+// timeout indicates the attempt exceeds the per try timeout
+func (rp retryPolicy) retriable(resp *invocation.Response, timeout bool) bool {
+	if timeout {
+		return rp.retryOn["5xx"] || rp.retryOn["gateway-error"]
+	}
+	if resp.Err != nil {
+		if rp.retryOn["5xx"] {
+			return true
+		}
+		if isConnectFailure(resp.Err) {
+			// the request isn't sent, so it's safe to retry on refused stream too
+			return rp.retryOn["connect-failure"] || rp.retryOn["refused-stream"]
+		}
+		return rp.retryOn["reset"] && isReset(resp.Err)
+	}
+	r, ok := resp.Result.(*http.Response)
+	if !ok {
+		return false
+	}
+	switch code := r.StatusCode; {
+	case rp.statusCodes[code]:
+		return true
+	case code >= 500 && rp.retryOn["5xx"]:
+		return true
+	case (code == http.StatusBadGateway || code == http.StatusServiceUnavailable ||
+		code == http.StatusGatewayTimeout) && rp.retryOn["gateway-error"]:
+		return true
+	case code == http.StatusConflict && rp.retryOn["retriable-4xx"]:
+		return true
+	}
+	return false
+}
+
+// reportOutlier reports the outcome of an attempt to the outlier detection, the errors
+// without response and the timeouts are gateway errors like 502, 503 and 504
+func (p *HTTP) reportOutlier(inv *invocation.Invocation, resp *invocation.Response, timeout bool) {
+	if inv.Endpoint == "" {
+		// no instance is picked
+		return
+	}
+	if timeout || resp.Err != nil {
+		registry.ReportError(p.SvcNamespace, p.SvcName, p.Subset, inv.Endpoint, true)
+		return
+	}
+	r, ok := resp.Result.(*http.Response)
+	if !ok || r.StatusCode < 500 {
+		registry.ReportSuccess(p.SvcNamespace, p.SvcName, p.Subset, inv.Endpoint)
+		return
+	}
+	gateway := r.StatusCode == http.StatusBadGateway || r.StatusCode == http.StatusServiceUnavailable ||
+		r.StatusCode == http.StatusGatewayTimeout
+	registry.ReportError(p.SvcNamespace, p.SvcName, p.Subset, inv.Endpoint, gateway)
+}
+
+// isConnectFailure returns true if the error is caused by dialing the server
+func isConnectFailure(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// isReset returns true if the connection is reset or closed before the response
+func isReset(err error) bool {
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// isIdempotent returns true if the request of the method can be retried safely
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace,
+		http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// invoke invokes the request by the chain and writes the response to http conn. An
+// idempotent request is retried on another instance by the retry policy of the route,
+// and all the attempts are bounded by the timeout of the route.
+func (p *HTTP) invoke(c *handler.Chain, req *http.Request) {
+	if !p.allow(req) || p.injectFault(req) {
+		return
+	}
+	ctx := context.Background()
+	if timeout := util.ProtoDuration(p.httpRoute.GetTimeout()); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	policy := newRetryPolicy(p.httpRoute.GetRetries())
+	if policy.attempts > 0 && !isIdempotent(req.Method) {
+		klog.V(4).Infof("%s request isn't idempotent, no retry", req.Method)
+		policy.attempts = 0
+	}
+	// buffer the body to replay it to the retries
+	var body []byte
+	if policy.attempts > 0 && req.Body != nil && req.Body != http.NoBody {
+		var err error
+		if body, err = ioutil.ReadAll(req.Body); err != nil {
+			klog.Errorf("read http request body err: %v", err)
+			if err = p.responseError(http.StatusBadRequest, "read request body failed"); err != nil {
+				klog.Errorf("write http response err: %v", err)
+			}
+			return
+		}
+	}
+
+	var failed []string
+	for attempt := 0; ; attempt++ {
+		if body != nil {
+			req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+		tryCtx, cancel := context.WithCancel(ctx)
+		if policy.perTryTimeout > 0 {
+			tryCtx, cancel = context.WithTimeout(ctx, policy.perTryTimeout)
+		}
+		inv := p.newInvocation(tryCtx, req, failed)
+		// the response is written by the callback, so the slot of the connection pool and
+		// the active count of the instance are held until its body is streamed
+		retry, called := false, false
+		finish := func(resp *invocation.Response) {
+			timeout := tryCtx.Err() == context.DeadlineExceeded
+			p.reportOutlier(inv, resp, timeout)
+			if attempt < policy.attempts && ctx.Err() == nil && policy.retriable(resp, timeout) {
+				if r, ok := resp.Result.(*http.Response); ok && r.Body != nil {
+					r.Body.Close()
+				}
+				retry = true
+				return
+			}
+			var err error
+			if timeout || ctx.Err() == context.DeadlineExceeded {
+				err = p.responseError(http.StatusGatewayTimeout, "upstream request timeout")
+			} else {
+				err = p.responseCallback(resp)
+			}
+			if err != nil {
+				klog.Errorf("handle http response err: %v", err)
+			}
+		}
+		c.Next(inv, func(r *invocation.Response) error {
+			called = true
+			finish(r)
+			return r.Err
+		})
+		if !called {
+			finish(&invocation.Response{Err: errors.New("no response")})
+		}
+		// the body of the response is read by the callback, so cancel the context after it
+		cancel()
+		if !retry {
+			return
+		}
+		if inv.Endpoint != "" {
+			failed = append(failed, inv.Endpoint)
+		}
+		backOff := retryBackOff << uint(attempt)
+		if backOff > maxRetryBackOff {
+			backOff = maxRetryBackOff
+		}
+		klog.Warningf("retry %s %s of svc %s.%s, attempt %d failed on %s",
+			req.Method, req.URL, p.SvcNamespace, p.SvcName, attempt+1, inv.Endpoint)
+		time.Sleep(time.Duration(rand.Int63n(int64(backOff))) + backOff/2)
+	}
+}
@@ -0,0 +1,57 @@
+package http
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"testing"
+
+	"github.com/go-chassis/go-chassis/core/invocation"
+	apiv1alpha3 "istio.io/api/networking/v1alpha3"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	if p := newRetryPolicy(nil); p.attempts != 0 {
+		t.Errorf("nil retry has %d attempts", p.attempts)
+	}
+	p := newRetryPolicy(&apiv1alpha3.HTTPRetry{
+		Attempts: 3,
+		RetryOn:  "gateway-error, connect-failure,429",
+	})
+	if p.attempts != 3 || p.perTryTimeout != 0 || !p.statusCodes[429] {
+		t.Errorf("policy = %+v", p)
+	}
+
+	status := func(code int) *invocation.Response {
+		return &invocation.Response{Result: &http.Response{StatusCode: code}}
+	}
+	dialErr := &url.Error{Op: "Get", URL: "http://10.0.0.1", Err: &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}}
+	resetErr := &url.Error{Op: "Get", URL: "http://10.0.0.1", Err: &net.OpError{Op: "read", Err: syscall.ECONNRESET}}
+	cases := []struct {
+		name    string
+		resp    *invocation.Response
+		timeout bool
+		want    bool
+	}{
+		{name: "ok", resp: status(200), want: false},
+		{name: "gateway error", resp: status(503), want: true},
+		{name: "internal error", resp: status(500), want: false},
+		{name: "status code", resp: status(429), want: true},
+		{name: "connect failure", resp: &invocation.Response{Err: dialErr}, want: true},
+		{name: "reset", resp: &invocation.Response{Err: resetErr}, want: false},
+		{name: "per try timeout", resp: &invocation.Response{Err: errors.New("canceled")}, timeout: true, want: true},
+	}
+	for _, c := range cases {
+		if got := p.retriable(c.resp, c.timeout); got != c.want {
+			t.Errorf("%s: retriable = %v, want %v", c.name, got, c.want)
+		}
+	}
+	if !newRetryPolicy(&apiv1alpha3.HTTPRetry{Attempts: 1, RetryOn: "reset"}).retriable(&invocation.Response{Err: resetErr}, false) {
+		t.Errorf("reset isn't retried on reset")
+	}
+	if isIdempotent(http.MethodPost) || !isIdempotent(http.MethodGet) {
+		t.Errorf("only idempotent methods can be retried")
+	}
+}
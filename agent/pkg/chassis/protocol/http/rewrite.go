@@ -0,0 +1,103 @@
+package http
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	apiv1alpha3 "istio.io/api/networking/v1alpha3"
+)
+
+// rewriteRequest rewrites the uri and authority of the request before it's forwarded.
+// The uri replaces the prefix matched by the match request, or the whole path if the
+// request isn't matched by a prefix.
+func rewriteRequest(req *http.Request, rewrite *apiv1alpha3.HTTPRewrite, match *apiv1alpha3.HTTPMatchRequest) error {
+	if rewrite == nil {
+		return nil
+	}
+	if rewrite.Uri != "" {
+		path, query := requestPath(req), ""
+		if i := strings.IndexByte(req.RequestURI, '?'); i >= 0 {
+			query = req.RequestURI[i:]
+		}
+		if prefix := match.GetUri().GetPrefix(); prefix != "" && len(path) >= len(prefix) {
+			path = rewrite.Uri + path[len(prefix):]
+		} else {
+			path = rewrite.Uri
+		}
+		u, err := url.ParseRequestURI(path + query)
+		if err != nil {
+			return fmt.Errorf("rewrite uri %s err: %v", path+query, err)
+		}
+		req.RequestURI = path + query
+		req.URL = u
+	}
+	if rewrite.Authority != "" {
+		req.Host = rewrite.Authority
+	}
+	return nil
+}
+
+// redirectResponse returns the response redirecting the request, the scheme, authority
+// and path of the request are kept unless the redirect replaces them
+func redirectResponse(req *http.Request, redirect *apiv1alpha3.HTTPRedirect, scheme string) *http.Response {
+	authority := req.Host
+	if redirect.Authority != "" {
+		authority = redirect.Authority
+	}
+	uri := req.RequestURI
+	if redirect.Uri != "" {
+		uri = redirect.Uri
+		if i := strings.IndexByte(req.RequestURI, '?'); i >= 0 && !strings.Contains(uri, "?") {
+			uri += req.RequestURI[i:]
+		}
+	}
+	code := int(redirect.RedirectCode)
+	if code == 0 {
+		code = http.StatusMovedPermanently
+	}
+	header := make(http.Header)
+	header.Set("Location", fmt.Sprintf("%s://%s%s", scheme, authority, uri))
+	return &http.Response{
+		StatusCode: code,
+		Proto:      req.Proto,
+		ProtoMajor: req.ProtoMajor,
+		ProtoMinor: req.ProtoMinor,
+		Request:    req,
+		Header:     header,
+	}
+}
+
+// applyHeaderOperations removes, sets and then adds the headers
+func applyHeaderOperations(header http.Header, ops *apiv1alpha3.Headers_HeaderOperations) {
+	if ops == nil {
+		return
+	}
+	for _, name := range ops.Remove {
+		header.Del(name)
+	}
+	for name, value := range ops.Set {
+		header.Set(name, value)
+	}
+	for name, value := range ops.Add {
+		header.Add(name, value)
+	}
+}
+
+// requestHeaderOperations returns the request header operations of the route and its
+// destination, the ones of the destination are applied later so they take precedence
+func (p *HTTP) requestHeaderOperations() []*apiv1alpha3.Headers_HeaderOperations {
+	return []*apiv1alpha3.Headers_HeaderOperations{
+		p.httpRoute.GetHeaders().GetRequest(),
+		p.routeDest.GetHeaders().GetRequest(),
+	}
+}
+
+// responseHeaderOperations returns the response header operations of the route and its destination
+func (p *HTTP) responseHeaderOperations() []*apiv1alpha3.Headers_HeaderOperations {
+	return []*apiv1alpha3.Headers_HeaderOperations{
+		p.httpRoute.GetHeaders().GetResponse(),
+		p.routeDest.GetHeaders().GetResponse(),
+	}
+}
@@ -0,0 +1,113 @@
+package http
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	apiv1alpha3 "istio.io/api/networking/v1alpha3"
+	istioapi "istio.io/client-go/pkg/apis/networking/v1alpha3"
+)
+
+func newRequest(t *testing.T, uri string) *http.Request {
+	raw := "GET " + uri + " HTTP/1.1\r\nHost: firmware.edge\r\nX-Debug: 1\r\n\r\n"
+	req, err := http.ReadRequest(bufio.NewReader(strings.NewReader(raw)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+func TestRewriteRequest(t *testing.T) {
+	req := newRequest(t, "/api/v1/images?arch=arm64")
+	match := &apiv1alpha3.HTTPMatchRequest{Uri: prefix("/api/v1")}
+	rewrite := &apiv1alpha3.HTTPRewrite{Uri: "/v1", Authority: "firmware-v1"}
+	if err := rewriteRequest(req, rewrite, match); err != nil {
+		t.Fatal(err)
+	}
+	if req.RequestURI != "/v1/images?arch=arm64" || req.URL.Path != "/v1/images" || req.URL.RawQuery != "arch=arm64" {
+		t.Errorf("rewrite prefix got %s, %v", req.RequestURI, req.URL)
+	}
+	if req.Host != "firmware-v1" {
+		t.Errorf("rewrite authority got %s", req.Host)
+	}
+
+	// the whole path is replaced if it isn't matched by a prefix
+	req = newRequest(t, "/healthz")
+	if err := rewriteRequest(req, &apiv1alpha3.HTTPRewrite{Uri: "/status"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if req.RequestURI != "/status" {
+		t.Errorf("rewrite path got %s", req.RequestURI)
+	}
+}
+
+func TestRedirectResponse(t *testing.T) {
+	req := newRequest(t, "/old?id=1")
+	resp := redirectResponse(req, &apiv1alpha3.HTTPRedirect{Uri: "/new"}, "https")
+	if resp.StatusCode != http.StatusMovedPermanently {
+		t.Errorf("redirect code = %d, want 301", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Location"); got != "https://firmware.edge/new?id=1" {
+		t.Errorf("redirect location = %s", got)
+	}
+	resp = redirectResponse(req, &apiv1alpha3.HTTPRedirect{Authority: "mirror.edge", RedirectCode: 302}, "http")
+	if resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != "http://mirror.edge/old?id=1" {
+		t.Errorf("redirect got %d %s", resp.StatusCode, resp.Header.Get("Location"))
+	}
+}
+
+func TestRedirectDrainsBody(t *testing.T) {
+	vs := &istioapi.VirtualService{}
+	vs.Spec.Http = []*apiv1alpha3.HTTPRoute{{Redirect: &apiv1alpha3.HTTPRedirect{Uri: "/new"}}}
+	client, server := net.Pipe()
+	defer client.Close()
+	done := make(chan struct{})
+	go func() {
+		(&HTTP{Conn: server, VirtualService: vs}).Process()
+		close(done)
+	}()
+
+	post := func(size int) *http.Response {
+		go func() {
+			raw := "POST /old HTTP/1.1\r\nHost: firmware.edge\r\nContent-Length: " + strconv.Itoa(size) + "\r\n\r\n"
+			client.Write(append([]byte(raw), make([]byte, size)...))
+		}()
+		resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+		if err != nil {
+			t.Fatalf("read redirect response err: %v", err)
+		}
+		ioutil.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusMovedPermanently {
+			t.Fatalf("redirect code = %d, want 301", resp.StatusCode)
+		}
+		return resp
+	}
+	// the connection is kept after the small body is drained
+	if resp := post(1024); resp.Close {
+		t.Errorf("connection is closed after a small body")
+	}
+	if resp := post(maxRedirectDrain + 1); !resp.Close {
+		t.Errorf("connection is kept after a large body")
+	}
+	<-done
+}
+
+func TestApplyHeaderOperations(t *testing.T) {
+	header := http.Header{"X-Debug": {"1"}, "X-Version": {"v1"}}
+	applyHeaderOperations(header, &apiv1alpha3.Headers_HeaderOperations{
+		Remove: []string{"x-debug"},
+		Set:    map[string]string{"x-version": "v2"},
+		Add:    map[string]string{"x-version": "canary"},
+	})
+	if _, ok := header["X-Debug"]; ok {
+		t.Errorf("header x-debug isn't removed")
+	}
+	if got := header["X-Version"]; len(got) != 2 || got[0] != "v2" || got[1] != "canary" {
+		t.Errorf("header x-version = %v, want [v2 canary]", got)
+	}
+}
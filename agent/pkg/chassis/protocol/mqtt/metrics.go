@@ -0,0 +1,109 @@
+package mqtt
+
+import (
+	"expvar"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// statsRetention is how long the metrics of a disconnected client are kept
+const statsRetention = time.Hour
+
+// clientStats is the connection metrics of a mqtt client
+type clientStats struct {
+	// 64-bit fields are accessed atomically, keep them at the beginning
+	// for the alignment on 32-bit platforms
+	ActiveConnections int64 `json:"activeConnections"`
+	TotalConnections  int64 `json:"totalConnections"`
+	BytesReceived     int64 `json:"bytesReceived"`
+	BytesSent         int64 `json:"bytesSent"`
+	PacketsReceived   int64 `json:"packetsReceived"`
+	PacketsSent       int64 `json:"packetsSent"`
+	PublishReceived   int64 `json:"publishReceived"`
+	PublishSent       int64 `json:"publishSent"`
+	LastConnected     int64 `json:"lastConnected"`
+	LastDisconnected  int64 `json:"lastDisconnected"`
+}
+
+var (
+	statsMu sync.Mutex
+	stats   = make(map[string]*clientStats)
+)
+
+func init() {
+	// served by the metrics server of edgemesh-agent
+	expvar.Publish("mqtt_clients", expvar.Func(snapshotStats))
+}
+
+// statsKey returns the metrics key of a client connected to a service
+func statsKey(namespace, name, clientID string) string {
+	return fmt.Sprintf("%s.%s/%s", name, namespace, clientID)
+}
+
+// acquireStats returns the metrics of a client and records a new connection
+func acquireStats(key string) *clientStats {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	now := time.Now()
+	for k, s := range stats {
+		if atomic.LoadInt64(&s.ActiveConnections) == 0 &&
+			now.Sub(time.Unix(atomic.LoadInt64(&s.LastDisconnected), 0)) > statsRetention {
+			delete(stats, k)
+		}
+	}
+	s, ok := stats[key]
+	if !ok {
+		s = &clientStats{}
+		stats[key] = s
+	}
+	atomic.AddInt64(&s.ActiveConnections, 1)
+	atomic.AddInt64(&s.TotalConnections, 1)
+	atomic.StoreInt64(&s.LastConnected, now.Unix())
+	return s
+}
+
+// release records the client connection is closed
+func (s *clientStats) release() {
+	atomic.AddInt64(&s.ActiveConnections, -1)
+	atomic.StoreInt64(&s.LastDisconnected, time.Now().Unix())
+}
+
+func (s *clientStats) received(p *packet) {
+	atomic.AddInt64(&s.BytesReceived, int64(p.size()))
+	atomic.AddInt64(&s.PacketsReceived, 1)
+	if p.packetType() == packetPublish {
+		atomic.AddInt64(&s.PublishReceived, 1)
+	}
+}
+
+func (s *clientStats) sent(p *packet) {
+	atomic.AddInt64(&s.BytesSent, int64(p.size()))
+	atomic.AddInt64(&s.PacketsSent, 1)
+	if p.packetType() == packetPublish {
+		atomic.AddInt64(&s.PublishSent, 1)
+	}
+}
+
+// snapshotStats returns a copy of the metrics of all clients
+func snapshotStats() interface{} {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	snapshot := make(map[string]clientStats, len(stats))
+	for k, s := range stats {
+		snapshot[k] = clientStats{
+			ActiveConnections: atomic.LoadInt64(&s.ActiveConnections),
+			TotalConnections:  atomic.LoadInt64(&s.TotalConnections),
+			BytesReceived:     atomic.LoadInt64(&s.BytesReceived),
+			BytesSent:         atomic.LoadInt64(&s.BytesSent),
+			PacketsReceived:   atomic.LoadInt64(&s.PacketsReceived),
+			PacketsSent:       atomic.LoadInt64(&s.PacketsSent),
+			PublishReceived:   atomic.LoadInt64(&s.PublishReceived),
+			PublishSent:       atomic.LoadInt64(&s.PublishSent),
+			LastConnected:     atomic.LoadInt64(&s.LastConnected),
+			LastDisconnected:  atomic.LoadInt64(&s.LastDisconnected),
+		}
+	}
+	return snapshot
+}
@@ -0,0 +1,696 @@
+package mqtt
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-chassis/go-chassis/core/common"
+	"github.com/go-chassis/go-chassis/core/handler"
+	"github.com/go-chassis/go-chassis/core/invocation"
+	"github.com/go-chassis/go-chassis/core/loadbalancer"
+	"k8s.io/klog/v2"
+
+	"github.com/kubeedge/edgemesh/agent/pkg/chassis/config"
+	"github.com/kubeedge/edgemesh/agent/pkg/chassis/controller"
+	"github.com/kubeedge/edgemesh/agent/pkg/chassis/loadbalancer/consistenthash"
+	"github.com/kubeedge/edgemesh/agent/pkg/chassis/loadbalancer/latency"
+	"github.com/kubeedge/edgemesh/agent/pkg/chassis/loadbalancer/leastconn"
+	"github.com/kubeedge/edgemesh/agent/pkg/chassis/loadbalancer/retry"
+	"github.com/kubeedge/edgemesh/agent/pkg/chassis/loadbalancer/sessionaffinity"
+	"github.com/kubeedge/edgemesh/agent/pkg/chassis/loadbalancer/util"
+	"github.com/kubeedge/edgemesh/agent/pkg/chassis/panel"
+	"github.com/kubeedge/edgemesh/agent/pkg/chassis/protocol"
+	"github.com/kubeedge/edgemesh/agent/pkg/chassis/protocol/tcp"
+	"github.com/kubeedge/edgemesh/agent/pkg/chassis/registry"
+)
+
+// ProtocolMQTT is the protocol name of mqtt ports
+const ProtocolMQTT = "mqtt"
+
+// connectTimeout is how long to wait for the CONNECT packet of a new connection
+const connectTimeout = 10 * time.Second
+
+func init() {
+	err := protocol.Register(ProtocolMQTT, newMQTT)
+	if err != nil {
+		klog.Errorf("register mqtt protocol err: %v", err)
+	}
+}
+
+func newMQTT(opts *protocol.Options) (protocol.Protocol, error) {
+	return &MQTT{
+		Conn:         opts.Conn,
+		SvcNamespace: opts.SvcNamespace,
+		SvcName:      opts.SvcName,
+		Port:         opts.Port,
+	}, nil
+}
+
+// MQTT proxies mqtt 3.1, 3.1.1 and 5 connections. The client id in CONNECT is used
+// as the hash key of the ConsistentHash strategy, and packets can be routed to other
+// services by topic prefix, see TopicRoutesAnnotation. The broker connections go
+// through the handler chain of the tcp proxy, so the rate limits, the connection pool,
+// the tcp fault and the outlier detection of the services apply to them as well.
+type MQTT struct {
+	Conn         net.Conn
+	SvcNamespace string
+	SvcName      string
+	Port         int
+
+	// resetAfter is the number of bytes relayed before the connection is reset by an
+	// injected abort, no reset if it isn't positive
+	resetAfter int64
+}
+
+// Process process
+func (p *MQTT) Process() {
+	// the connection attempts beyond the rate limits are closed
+	self := target{namespace: p.SvcNamespace, name: p.SvcName, port: p.Port}
+	if !panel.Allow(newInvocation(self, p.Conn, "", nil)) {
+		err := p.Conn.Close()
+		if err != nil {
+			klog.Errorf("close conn err: %v", err)
+		}
+		return
+	}
+	if p.injectFault() {
+		return
+	}
+
+	s, err := p.newSession()
+	if err != nil {
+		klog.Errorf("mqtt proxy of %s.%s:%d err: %v", p.SvcName, p.SvcNamespace, p.Port, err)
+		err = p.Conn.Close()
+		if err != nil {
+			klog.Errorf("close conn err: %v", err)
+		}
+		return
+	}
+	defer s.close()
+	s.serve()
+}
+
+// injectFault delays the connection and decides whether to abort it by the tcp fault of
+// the service like the tcp proxy. It returns true if the connection is reset right away.
+func (p *MQTT) injectFault() bool {
+	fault := panel.GetTCPFault(p.SvcNamespace, p.SvcName)
+	if fault == nil {
+		return false
+	}
+	if delay := panel.Delayed(fault.Delay); delay > 0 {
+		klog.V(4).Infof("inject delay %v to connection from %s of svc %s.%s", delay, p.Conn.RemoteAddr(), p.SvcNamespace, p.SvcName)
+		time.Sleep(delay)
+	}
+	if !panel.Aborted(fault.Abort) {
+		return false
+	}
+	klog.V(4).Infof("inject abort after %d bytes to connection from %s of svc %s.%s",
+		fault.AbortAfterBytes, p.Conn.RemoteAddr(), p.SvcNamespace, p.SvcName)
+	if fault.AbortAfterBytes == 0 {
+		tcp.Reset(p.Conn)
+		return true
+	}
+	p.resetAfter = fault.AbortAfterBytes
+	return false
+}
+
+// faultConn resets the client connection by an injected abort once resetAfter bytes
+// are relayed through it in both directions
+type faultConn struct {
+	net.Conn
+	resetAfter int64
+	relayed    int64
+}
+
+func (c *faultConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.relay(n)
+	return n, err
+}
+
+func (c *faultConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.relay(n)
+	return n, err
+}
+
+func (c *faultConn) relay(n int) {
+	if n <= 0 {
+		return
+	}
+	relayed := atomic.AddInt64(&c.relayed, int64(n))
+	if relayed < c.resetAfter {
+		return
+	}
+	if relayed-int64(n) < c.resetAfter {
+		klog.Infof("mqtt connection from %s reset by injected abort after %d bytes", c.RemoteAddr(), c.resetAfter)
+	}
+	tcp.Reset(c.Conn)
+}
+
+// upstream is a connection to a broker
+type upstream struct {
+	target target
+	conn   net.Conn
+	// mu serializes the writes to conn
+	mu sync.Mutex
+}
+
+func (u *upstream) write(p *packet) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	_, err := p.writeTo(u.conn)
+	return err
+}
+
+// serverPacket is a packet id allocated by a broker
+type serverPacket struct {
+	upstream *upstream
+	id       uint16
+}
+
+// session bridges a client connection to the brokers it is routed to
+type session struct {
+	client net.Conn
+	reader *bufio.Reader
+	// clientMu serializes the writes to client
+	clientMu sync.Mutex
+
+	connect *packet
+	info    *connectInfo
+	hashKey string
+	stats   *clientStats
+	routes  []topicRoute
+	primary *upstream
+	// aliases maps the topic aliases of mqtt 5 to upstreams, only accessed by serve
+	aliases map[uint16]*upstream
+
+	mu        sync.Mutex
+	upstreams map[target]*upstream
+	// clientPackets records the upstreams of client packets in flight by packet id,
+	// so the PUBREL of a qos 2 flow reaches the same broker as its PUBLISH
+	clientPackets map[uint16]*upstream
+	// serverPackets maps the packet ids sent to client to the brokers' packet ids,
+	// the packet ids of different brokers may conflict when topic routes exist
+	serverPackets map[uint16]serverPacket
+	nextID        uint16
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func (p *MQTT) newSession() (*session, error) {
+	client := net.Conn(p.Conn)
+	if p.resetAfter > 0 {
+		client = &faultConn{Conn: p.Conn, resetAfter: p.resetAfter}
+	}
+	s := &session{
+		client:        client,
+		reader:        bufio.NewReader(client),
+		aliases:       make(map[uint16]*upstream),
+		upstreams:     make(map[target]*upstream),
+		clientPackets: make(map[uint16]*upstream),
+		serverPackets: make(map[uint16]serverPacket),
+		closed:        make(chan struct{}),
+	}
+
+	// the first packet sent from client must be CONNECT
+	if err := p.Conn.SetReadDeadline(time.Now().Add(connectTimeout)); err != nil {
+		return nil, fmt.Errorf("set read deadline err: %v", err)
+	}
+	connect, err := readPacket(s.reader)
+	if err != nil {
+		return nil, fmt.Errorf("read CONNECT packet err: %v", err)
+	}
+	if err = p.Conn.SetReadDeadline(time.Time{}); err != nil {
+		return nil, fmt.Errorf("reset read deadline err: %v", err)
+	}
+	info, err := parseConnect(connect)
+	if err != nil {
+		return nil, fmt.Errorf("parse CONNECT packet err: %v", err)
+	}
+	s.connect = connect
+	s.info = info
+	// a client may leave the client id empty and let the broker assign one
+	s.hashKey = info.clientID
+	if s.hashKey == "" {
+		s.hashKey, _, _ = net.SplitHostPort(p.Conn.RemoteAddr().String())
+	}
+
+	self := target{namespace: p.SvcNamespace, name: p.SvcName, port: p.Port}
+	svc, err := controller.APIConn.GetSvcLister().Services(p.SvcNamespace).Get(p.SvcName)
+	if err != nil {
+		return nil, fmt.Errorf("get service %s.%s err: %v", p.SvcNamespace, p.SvcName, err)
+	}
+	if value, ok := svc.Annotations[TopicRoutesAnnotation]; ok {
+		s.routes, err = parseTopicRoutes(value, p.SvcNamespace, p.Port)
+		if err != nil {
+			return nil, fmt.Errorf("parse topic routes of service %s.%s err: %v", p.SvcNamespace, p.SvcName, err)
+		}
+	}
+
+	s.primary, err = s.dial(self)
+	if err != nil {
+		return nil, err
+	}
+	s.upstreams[self] = s.primary
+	s.stats = acquireStats(statsKey(p.SvcNamespace, p.SvcName, s.hashKey))
+	s.stats.received(connect)
+	klog.Infof("mqtt client %q connected to %s", info.clientID, self)
+	return s, nil
+}
+
+// serve relays the packets of client until the connection is closed
+func (s *session) serve() {
+	go s.relayUpstream(s.primary)
+	for {
+		p, err := readPacket(s.reader)
+		if err != nil {
+			if err != io.EOF && !s.isClosed() {
+				klog.Warningf("read packet from mqtt client %q err: %v", s.info.clientID, err)
+			}
+			return
+		}
+		s.stats.received(p)
+		if p.packetType() == packetDisconnect {
+			s.broadcast(p)
+			return
+		}
+		if err = s.handleClientPacket(p); err != nil {
+			klog.Errorf("relay packet of mqtt client %q err: %v", s.info.clientID, err)
+			return
+		}
+	}
+}
+
+func (s *session) handleClientPacket(p *packet) error {
+	switch p.packetType() {
+	case packetPublish:
+		info, err := parsePublish(p, s.info.version)
+		if err != nil {
+			return err
+		}
+		u, err := s.routePublish(info)
+		if err != nil {
+			return err
+		}
+		if info.qos > 0 {
+			s.mu.Lock()
+			s.clientPackets[info.packetID] = u
+			s.mu.Unlock()
+		}
+		return u.write(p)
+	case packetPubrel:
+		id, err := packetID(p)
+		if err != nil {
+			return err
+		}
+		s.mu.Lock()
+		u, ok := s.clientPackets[id]
+		s.mu.Unlock()
+		if !ok {
+			u = s.primary
+		}
+		return u.write(p)
+	case packetPuback, packetPubrec, packetPubcomp:
+		// acknowledgements of the packets sent from brokers
+		u := s.primary
+		if s.routes != nil {
+			id, err := packetID(p)
+			if err != nil {
+				return err
+			}
+			s.mu.Lock()
+			sp, ok := s.serverPackets[id]
+			if ok && p.packetType() != packetPubrec {
+				delete(s.serverPackets, id)
+			}
+			s.mu.Unlock()
+			if ok {
+				u = sp.upstream
+				setPacketID(p, 0, sp.id)
+			}
+		}
+		return u.write(p)
+	case packetSubscribe, packetUnsubscribe:
+		// the packet ids of SUBACK and UNSUBACK can't be shared by several brokers, so a
+		// packet with filters routed to different services is rejected, the client
+		// should send them in separate packets
+		id, filters, err := parseFilters(p, s.info.version)
+		if err != nil {
+			return err
+		}
+		t := s.routeTarget(filters[0])
+		for _, filter := range filters[1:] {
+			if s.routeTarget(filter) != t {
+				return s.rejectFilters(p, id, filters)
+			}
+		}
+		u, err := s.route(filters[0])
+		if err != nil {
+			return err
+		}
+		return u.write(p)
+	case packetPingreq:
+		// keep all the broker connections alive, only the PINGRESP of primary is replied
+		return s.broadcast(p)
+	default:
+		return s.primary.write(p)
+	}
+}
+
+// routePublish returns the upstream of a PUBLISH packet, a packet of mqtt 5 may
+// carry an empty topic and refer to it by the topic alias
+func (s *session) routePublish(info *publishInfo) (*upstream, error) {
+	if info.topic == "" && info.alias != 0 {
+		if u, ok := s.aliases[info.alias]; ok {
+			return u, nil
+		}
+		return s.primary, nil
+	}
+	u, err := s.route(info.topic)
+	if err != nil {
+		return nil, err
+	}
+	if info.alias != 0 {
+		s.aliases[info.alias] = u
+	}
+	return u, nil
+}
+
+// routeTarget returns the target a topic is routed to
+func (s *session) routeTarget(topic string) target {
+	if t, ok := matchRoute(s.routes, topic); ok {
+		return t
+	}
+	return s.primary.target
+}
+
+// rejectFilters fails all the topic filters of a SUBSCRIBE or UNSUBSCRIBE packet
+func (s *session) rejectFilters(p *packet, id uint16, filters []string) error {
+	klog.Warningf("topic filters %q of mqtt client %q span several routes, rejected", filters, s.info.clientID)
+	ack, err := failureAck(p, s.info.version, id, len(filters))
+	if err != nil {
+		return err
+	}
+	return s.writeClient(ack)
+}
+
+// route returns the upstream of a topic, the broker connection is set up on demand
+func (s *session) route(topic string) (*upstream, error) {
+	t, ok := matchRoute(s.routes, topic)
+	if !ok {
+		return s.primary, nil
+	}
+	// upstreams are only added by serve, so it's safe to dial without the lock
+	s.mu.Lock()
+	u, ok := s.upstreams[t]
+	s.mu.Unlock()
+	if ok {
+		return u, nil
+	}
+	u, err := s.dial(t)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	s.upstreams[t] = u
+	s.mu.Unlock()
+	if s.isClosed() {
+		u.conn.Close()
+		return nil, fmt.Errorf("session closed")
+	}
+	klog.Infof("mqtt client %q routed topic %q to %s", s.info.clientID, topic, t)
+	go s.relayUpstream(u)
+	return u, nil
+}
+
+// broadcast writes a packet to all the upstreams
+func (s *session) broadcast(p *packet) error {
+	s.mu.Lock()
+	upstreams := make([]*upstream, 0, len(s.upstreams))
+	for _, u := range s.upstreams {
+		upstreams = append(upstreams, u)
+	}
+	s.mu.Unlock()
+	var lastErr error
+	for _, u := range upstreams {
+		if err := u.write(p); err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// relayUpstream relays the packets from a broker to client
+func (s *session) relayUpstream(u *upstream) {
+	defer s.close()
+	primary := u == s.primary
+	r := bufio.NewReader(u.conn)
+	for first := true; ; first = false {
+		p, err := readPacket(r)
+		if err != nil {
+			if err != io.EOF && !s.isClosed() {
+				klog.Warningf("read packet from mqtt broker %s err: %v", u.target, err)
+			}
+			return
+		}
+		if first && !primary {
+			// the client has been acknowledged by primary
+			if p.packetType() != packetConnack || len(p.body) < 2 || p.body[1] != 0 {
+				klog.Errorf("mqtt broker %s refused client %q", u.target, s.info.clientID)
+				return
+			}
+			continue
+		}
+		drop, err := s.handleServerPacket(u, p)
+		if err != nil {
+			klog.Errorf("relay packet from mqtt broker %s err: %v", u.target, err)
+			return
+		}
+		if drop {
+			continue
+		}
+		if err = s.writeClient(p); err != nil {
+			if !s.isClosed() {
+				klog.Warningf("write packet to mqtt client %q err: %v", s.info.clientID, err)
+			}
+			return
+		}
+	}
+}
+
+// handleServerPacket updates the packet ids of a packet from broker, drop is true
+// if the packet shouldn't be sent to client
+func (s *session) handleServerPacket(u *upstream, p *packet) (drop bool, err error) {
+	switch p.packetType() {
+	case packetPingresp:
+		return u != s.primary, nil
+	case packetPuback, packetPubcomp:
+		id, err := packetID(p)
+		if err != nil {
+			return false, err
+		}
+		s.mu.Lock()
+		if s.clientPackets[id] == u {
+			delete(s.clientPackets, id)
+		}
+		s.mu.Unlock()
+	case packetPublish:
+		if s.routes == nil {
+			return false, nil
+		}
+		info, err := parsePublish(p, s.info.version)
+		if err != nil {
+			return false, err
+		}
+		if info.qos == 0 {
+			return false, nil
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		id, err := s.allocPacketID()
+		if err != nil {
+			return false, err
+		}
+		s.serverPackets[id] = serverPacket{upstream: u, id: info.packetID}
+		setPacketID(p, info.idOffset, id)
+	case packetPubrel:
+		if s.routes == nil {
+			return false, nil
+		}
+		id, err := packetID(p)
+		if err != nil {
+			return false, err
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for local, sp := range s.serverPackets {
+			if sp.upstream == u && sp.id == id {
+				setPacketID(p, 0, local)
+				break
+			}
+		}
+	}
+	return false, nil
+}
+
+// allocPacketID allocates a packet id for packets sent to client, s.mu must be held
+func (s *session) allocPacketID() (uint16, error) {
+	for i := 0; i < 65535; i++ {
+		s.nextID++
+		if s.nextID == 0 {
+			s.nextID = 1
+		}
+		if _, ok := s.serverPackets[s.nextID]; !ok {
+			return s.nextID, nil
+		}
+	}
+	return 0, fmt.Errorf("no packet id available")
+}
+
+func (s *session) writeClient(p *packet) error {
+	s.clientMu.Lock()
+	defer s.clientMu.Unlock()
+	if _, err := p.writeTo(s.client); err != nil {
+		return err
+	}
+	s.stats.sent(p)
+	return nil
+}
+
+// dial connects a broker of the target by the handler chain of the tcp proxy and sends
+// the CONNECT packet to it, another instance is picked if the picked one fails to connect.
+// The connection pool slot and the active count of the broker are held by the chain until
+// the session is closed.
+func (s *session) dial(t target) (*upstream, error) {
+	c, err := handler.CreateChain(common.Consumer, ProtocolMQTT, panel.ConnectionPoolHandlerName, handler.Loadbalance, leastconn.ActiveCounterHandlerName, tcp.L4ProxyHandlerName)
+	if err != nil {
+		return nil, fmt.Errorf("create handler chain error: %v", err)
+	}
+	attempts := config.Chassis.Protocol.TCPReconnectTimes
+	if attempts < 1 {
+		attempts = 1
+	}
+	var failed []string
+	for attempt := 1; ; attempt++ {
+		inv := newInvocation(t, s.client, s.hashKey, failed)
+		u, err := s.dialOnce(c, inv, t)
+		if err == nil {
+			return u, nil
+		}
+		if err == panel.ErrOverflow || inv.Endpoint == "" || attempt >= attempts {
+			return nil, fmt.Errorf("dial mqtt broker of %s err: %v", t, err)
+		}
+		klog.Warningf("dial mqtt broker %s of %s err: %v, retry another instance", inv.Endpoint, t, err)
+		failed = append(failed, inv.Endpoint)
+	}
+}
+
+// dialOnce runs the chain in a goroutine, whose callback dials the picked endpoint and
+// blocks until the session is closed, so the chain tracks the lifetime of the upstream
+func (s *session) dialOnce(c *handler.Chain, inv *invocation.Invocation, t target) (*upstream, error) {
+	type result struct {
+		u   *upstream
+		err error
+	}
+	// the chain may return without calling back, then the result below is taken
+	results := make(chan result, 2)
+	go func() {
+		c.Next(inv, func(r *invocation.Response) error {
+			u, err := s.dialEndpoint(r, t)
+			results <- result{u: u, err: err}
+			if err != nil {
+				return err
+			}
+			<-s.closed
+			return nil
+		})
+		results <- result{err: fmt.Errorf("no endpoint picked")}
+	}()
+	r := <-results
+	return r.u, r.err
+}
+
+// dialEndpoint dials the endpoint picked by the chain and sends the CONNECT packet to it
+func (s *session) dialEndpoint(r *invocation.Response, t target) (*upstream, error) {
+	if r.Err != nil {
+		return nil, r.Err
+	}
+	ep, ok := r.Result.(string)
+	if !ok {
+		return nil, fmt.Errorf("result %v not string type", r.Result)
+	}
+	clientTimeout := time.Second * time.Duration(config.Chassis.Protocol.TCPClientTimeout)
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", ep, clientTimeout)
+	latency.Observe(ep, time.Since(start), err)
+	if err != nil {
+		registry.ReportError(t.namespace, t.name, "", ep, true)
+		return nil, err
+	}
+	registry.ReportSuccess(t.namespace, t.name, "", ep)
+	if _, err = s.connect.writeTo(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("write CONNECT packet to %s err: %v", ep, err)
+	}
+	return &upstream{target: t, conn: conn}, nil
+}
+
+func (s *session) isClosed() bool {
+	select {
+	case <-s.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// close closes the client and all the broker connections
+func (s *session) close() {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		if err := s.client.Close(); err != nil {
+			klog.Errorf("close conn err: %v", err)
+		}
+		s.mu.Lock()
+		for _, u := range s.upstreams {
+			if err := u.conn.Close(); err != nil {
+				klog.Errorf("close conn err: %v", err)
+			}
+		}
+		s.mu.Unlock()
+		s.stats.release()
+		klog.Infof("mqtt client %q disconnected", s.info.clientID)
+	})
+}
+
+// newInvocation creates an invocation to the target excluding the endpoints failed by
+// previous attempts. The ConsistentHash strategy is used unless the destination rule sets
+// another one, so a client keeps connecting to the same broker holding its session.
+func newInvocation(t target, client net.Conn, hashKey string, failed []string) *invocation.Invocation {
+	defaultStrategy := consistenthash.StrategyConsistentHash
+	if _, err := loadbalancer.GetStrategyPlugin(defaultStrategy); err != nil {
+		klog.Warningf("strategy %s isn't supported, mqtt client sessions may move between brokers", defaultStrategy)
+		defaultStrategy = config.Chassis.LoadBalancer.DefaultLBStrategy
+	}
+	inv := invocation.New(context.Background())
+	inv.MicroServiceName = fmt.Sprintf("%s.%s.svc.cluster.local:%d", t.name, t.namespace, t.port)
+	inv.SourceServiceID = ""
+	inv.Protocol = "tcp"
+	inv.Strategy = util.GetStrategyNameOrDefault(t.namespace, t.name, "", defaultStrategy)
+	if hashKey != "" {
+		inv.SetMetadata(consistenthash.HashKeyMetadata, hashKey)
+	}
+	sessionaffinity.SetClientIP(inv, client.RemoteAddr())
+	for _, ep := range failed {
+		retry.Exclude(inv, ep)
+	}
+	return inv
+}
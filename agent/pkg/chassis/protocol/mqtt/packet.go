@@ -0,0 +1,365 @@
+package mqtt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// mqtt control packet types
+const (
+	packetConnect     = 1
+	packetConnack     = 2
+	packetPublish     = 3
+	packetPuback      = 4
+	packetPubrec      = 5
+	packetPubrel      = 6
+	packetPubcomp     = 7
+	packetSubscribe   = 8
+	packetSuback      = 9
+	packetUnsubscribe = 10
+	packetUnsuback    = 11
+	packetPingreq     = 12
+	packetPingresp    = 13
+	packetDisconnect  = 14
+	packetAuth        = 15
+)
+
+// mqtt protocol levels
+const (
+	version31  = 3
+	version311 = 4
+	version5   = 5
+)
+
+// maxPacketSize limits the memory used by a single packet, the protocol allows up to
+// 256MB but edge workloads never come close to it, a larger packet fails the session
+const maxPacketSize = 16 << 20
+
+// reasonFailure is the return code of SUBACK failing a topic filter, it's also the
+// reason code of unspecified error of mqtt 5
+const reasonFailure = 0x80
+
+var errMalformed = errors.New("malformed mqtt packet")
+
+// packet is a mqtt control packet
+type packet struct {
+	header byte
+	// body is the variable header and payload
+	body []byte
+}
+
+func (p *packet) packetType() byte {
+	return p.header >> 4
+}
+
+// size returns the bytes of the packet on the wire
+func (p *packet) size() int {
+	n := len(p.body)
+	size := 2
+	for n >= 128 {
+		n /= 128
+		size++
+	}
+	return size + len(p.body)
+}
+
+// readPacket reads a control packet from r
+func readPacket(r *bufio.Reader) (*packet, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	length, err := readVarInt(r)
+	if err != nil {
+		return nil, err
+	}
+	if length > maxPacketSize {
+		return nil, fmt.Errorf("mqtt packet size %d exceeds the limit %d", length, maxPacketSize)
+	}
+	// the buffer grows as the body arrives, so a forged length doesn't allocate up front
+	body, err := ioutil.ReadAll(io.LimitReader(r, int64(length)))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) < length {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return &packet{header: header, body: body}, nil
+}
+
+// writeTo writes the packet to w
+func (p *packet) writeTo(w io.Writer) (int, error) {
+	buf := make([]byte, 0, p.size())
+	buf = append(buf, p.header)
+	n := len(p.body)
+	for {
+		b := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			b |= 0x80
+		}
+		buf = append(buf, b)
+		if n == 0 {
+			break
+		}
+	}
+	buf = append(buf, p.body...)
+	return w.Write(buf)
+}
+
+func readVarInt(r io.ByteReader) (int, error) {
+	var value, multiplier = 0, 1
+	for i := 0; i < 4; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		value += int(b&0x7f) * multiplier
+		if b&0x80 == 0 {
+			return value, nil
+		}
+		multiplier *= 128
+	}
+	return 0, errMalformed
+}
+
+// decoder decodes the fields of a packet body
+type decoder struct {
+	buf []byte
+	pos int
+}
+
+func (d *decoder) byte() (byte, error) {
+	if d.pos+1 > len(d.buf) {
+		return 0, errMalformed
+	}
+	b := d.buf[d.pos]
+	d.pos++
+	return b, nil
+}
+
+func (d *decoder) uint16() (uint16, error) {
+	if d.pos+2 > len(d.buf) {
+		return 0, errMalformed
+	}
+	v := binary.BigEndian.Uint16(d.buf[d.pos:])
+	d.pos += 2
+	return v, nil
+}
+
+func (d *decoder) skip(n int) error {
+	if n < 0 || d.pos+n > len(d.buf) {
+		return errMalformed
+	}
+	d.pos += n
+	return nil
+}
+
+func (d *decoder) string() (string, error) {
+	n, err := d.uint16()
+	if err != nil {
+		return "", err
+	}
+	if d.pos+int(n) > len(d.buf) {
+		return "", errMalformed
+	}
+	s := string(d.buf[d.pos : d.pos+int(n)])
+	d.pos += int(n)
+	return s, nil
+}
+
+func (d *decoder) ReadByte() (byte, error) {
+	return d.byte()
+}
+
+// properties decodes mqtt 5 properties and returns the topic alias if any
+func (d *decoder) properties() (alias uint16, err error) {
+	length, err := readVarInt(d)
+	if err != nil {
+		return 0, err
+	}
+	end := d.pos + length
+	if end > len(d.buf) {
+		return 0, errMalformed
+	}
+	for d.pos < end {
+		id, err := d.byte()
+		if err != nil {
+			return 0, err
+		}
+		switch id {
+		case 0x01, 0x17, 0x19, 0x24, 0x25, 0x28, 0x29, 0x2A:
+			err = d.skip(1)
+		case 0x23:
+			alias, err = d.uint16()
+		case 0x13, 0x21, 0x22:
+			err = d.skip(2)
+		case 0x02, 0x11, 0x18, 0x27:
+			err = d.skip(4)
+		case 0x0B:
+			_, err = readVarInt(d)
+		case 0x03, 0x08, 0x09, 0x12, 0x15, 0x16, 0x1A, 0x1C, 0x1F:
+			// utf-8 strings and binary data share the same encoding
+			_, err = d.string()
+		case 0x26:
+			if _, err = d.string(); err == nil {
+				_, err = d.string()
+			}
+		default:
+			err = fmt.Errorf("unknown mqtt property 0x%x", id)
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	if d.pos != end {
+		return 0, errMalformed
+	}
+	return alias, nil
+}
+
+// connectInfo is the information in a CONNECT packet
+type connectInfo struct {
+	version  byte
+	clientID string
+}
+
+// parseConnect parses a CONNECT packet of mqtt 3.1, 3.1.1 or 5
+func parseConnect(p *packet) (*connectInfo, error) {
+	if p.packetType() != packetConnect {
+		return nil, fmt.Errorf("expect CONNECT packet, got type %d", p.packetType())
+	}
+	d := &decoder{buf: p.body}
+	name, err := d.string()
+	if err != nil {
+		return nil, err
+	}
+	if name != "MQTT" && name != "MQIsdp" {
+		return nil, fmt.Errorf("unknown protocol name %q", name)
+	}
+	info := &connectInfo{}
+	if info.version, err = d.byte(); err != nil {
+		return nil, err
+	}
+	switch info.version {
+	case version31, version311, version5:
+	default:
+		return nil, fmt.Errorf("unsupported mqtt protocol level %d", info.version)
+	}
+	// connect flags and keep alive
+	if err = d.skip(3); err != nil {
+		return nil, err
+	}
+	if info.version == version5 {
+		if _, err = d.properties(); err != nil {
+			return nil, err
+		}
+	}
+	if info.clientID, err = d.string(); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// publishInfo is the information in a PUBLISH packet
+type publishInfo struct {
+	topic    string
+	qos      byte
+	packetID uint16
+	// idOffset is the offset of the packet id in the body
+	idOffset int
+	alias    uint16
+}
+
+// parsePublish parses a PUBLISH packet
+func parsePublish(p *packet, version byte) (*publishInfo, error) {
+	d := &decoder{buf: p.body}
+	info := &publishInfo{qos: (p.header >> 1) & 0x03}
+	var err error
+	if info.topic, err = d.string(); err != nil {
+		return nil, err
+	}
+	if info.qos > 0 {
+		info.idOffset = d.pos
+		if info.packetID, err = d.uint16(); err != nil {
+			return nil, err
+		}
+	}
+	if version == version5 {
+		if info.alias, err = d.properties(); err != nil {
+			return nil, err
+		}
+	}
+	return info, nil
+}
+
+// parseFilters returns the packet id and the topic filters of a SUBSCRIBE or UNSUBSCRIBE
+// packet
+func parseFilters(p *packet, version byte) (uint16, []string, error) {
+	d := &decoder{buf: p.body}
+	id, err := d.uint16()
+	if err != nil {
+		return 0, nil, err
+	}
+	if version == version5 {
+		if _, err = d.properties(); err != nil {
+			return 0, nil, err
+		}
+	}
+	var filters []string
+	for d.pos < len(d.buf) {
+		filter, err := d.string()
+		if err != nil {
+			return 0, nil, err
+		}
+		// subscription options
+		if p.packetType() == packetSubscribe {
+			if err = d.skip(1); err != nil {
+				return 0, nil, err
+			}
+		}
+		filters = append(filters, filter)
+	}
+	if len(filters) == 0 {
+		return 0, nil, errMalformed
+	}
+	return id, filters, nil
+}
+
+// failureAck returns the SUBACK or UNSUBACK packet failing all the n topic filters of
+// a SUBSCRIBE or UNSUBSCRIBE packet, the UNSUBACK of mqtt 3 has no reason codes so it
+// can't fail the filters
+func failureAck(p *packet, version byte, id uint16, n int) (*packet, error) {
+	ackType := byte(packetSuback)
+	if p.packetType() == packetUnsubscribe {
+		if version != version5 {
+			return nil, fmt.Errorf("UNSUBSCRIBE of mqtt protocol level %d can't fail", version)
+		}
+		ackType = packetUnsuback
+	}
+	body := make([]byte, 2, 3+n)
+	binary.BigEndian.PutUint16(body, id)
+	if version == version5 {
+		// no properties
+		body = append(body, 0)
+	}
+	for i := 0; i < n; i++ {
+		body = append(body, reasonFailure)
+	}
+	return &packet{header: ackType << 4, body: body}, nil
+}
+
+// packetID returns the packet id of an acknowledgement, SUBSCRIBE or UNSUBSCRIBE packet
+func packetID(p *packet) (uint16, error) {
+	d := &decoder{buf: p.body}
+	return d.uint16()
+}
+
+// setPacketID rewrites the packet id at offset of the body
+func setPacketID(p *packet, offset int, id uint16) {
+	binary.BigEndian.PutUint16(p.body[offset:], id)
+}
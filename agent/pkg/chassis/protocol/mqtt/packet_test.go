@@ -0,0 +1,177 @@
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestParseConnect(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    []byte
+		want    *connectInfo
+		wantErr bool
+	}{
+		{
+			"mqtt 3.1.1",
+			[]byte{0, 4, 'M', 'Q', 'T', 'T', 4, 0x02, 0, 60, 0, 3, 'a', 'b', 'c'},
+			&connectInfo{version: version311, clientID: "abc"},
+			false,
+		},
+		{
+			"mqtt 3.1",
+			[]byte{0, 6, 'M', 'Q', 'I', 's', 'd', 'p', 3, 0x02, 0, 60, 0, 1, 'a'},
+			&connectInfo{version: version31, clientID: "a"},
+			false,
+		},
+		{
+			"mqtt 5 with properties",
+			[]byte{0, 4, 'M', 'Q', 'T', 'T', 5, 0x02, 0, 60, 5, 0x11, 0, 0, 0, 10, 0, 3, 'a', 'b', 'c'},
+			&connectInfo{version: version5, clientID: "abc"},
+			false,
+		},
+		{
+			"empty client id",
+			[]byte{0, 4, 'M', 'Q', 'T', 'T', 4, 0x02, 0, 60, 0, 0},
+			&connectInfo{version: version311, clientID: ""},
+			false,
+		},
+		{
+			"truncated",
+			[]byte{0, 4, 'M', 'Q', 'T', 'T', 4, 0x02, 0, 60, 0, 3, 'a'},
+			nil,
+			true,
+		},
+		{
+			"unknown protocol",
+			[]byte{0, 4, 'H', 'T', 'T', 'P', 4, 0x02, 0, 60, 0, 1, 'a'},
+			nil,
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseConnect(&packet{header: packetConnect << 4, body: tt.body})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseConnect() err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseConnect() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadWritePacket(t *testing.T) {
+	// PUBLISH qos 1 of mqtt 5 with topic alias 2
+	p := &packet{
+		header: packetPublish<<4 | 0x02,
+		body:   append([]byte{0, 3, 'a', '/', 'b', 0, 7, 3, 0x23, 0, 2}, bytes.Repeat([]byte{'x'}, 200)...),
+	}
+	buf := new(bytes.Buffer)
+	n, err := p.writeTo(buf)
+	if err != nil || n != p.size() {
+		t.Fatalf("writeTo() = (%d, %v), want (%d, nil)", n, err, p.size())
+	}
+	got, err := readPacket(bufio.NewReader(buf))
+	if err != nil {
+		t.Fatalf("readPacket() err: %v", err)
+	}
+	if !reflect.DeepEqual(got, p) {
+		t.Fatalf("readPacket() = %+v, want %+v", got, p)
+	}
+
+	info, err := parsePublish(got, version5)
+	if err != nil {
+		t.Fatalf("parsePublish() err: %v", err)
+	}
+	want := &publishInfo{topic: "a/b", qos: 1, packetID: 7, idOffset: 5, alias: 2}
+	if !reflect.DeepEqual(info, want) {
+		t.Errorf("parsePublish() = %+v, want %+v", info, want)
+	}
+	setPacketID(got, info.idOffset, 9)
+	if info, _ = parsePublish(got, version5); info.packetID != 9 {
+		t.Errorf("packet id = %d after setPacketID, want 9", info.packetID)
+	}
+}
+
+func TestTopicRoutes(t *testing.T) {
+	routes, err := parseTopicRoutes("sensors/=sensor-broker, sensors/temp/=temp-broker.iot:1884", "default", 1883)
+	if err != nil {
+		t.Fatalf("parseTopicRoutes() err: %v", err)
+	}
+	tests := []struct {
+		topic  string
+		want   target
+		wantOK bool
+	}{
+		{"sensors/temp/1", target{namespace: "iot", name: "temp-broker", port: 1884}, true},
+		{"sensors/humidity/1", target{namespace: "default", name: "sensor-broker", port: 1883}, true},
+		{"cmd/1", target{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := matchRoute(routes, tt.topic)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("matchRoute(%q) = (%v, %v), want (%v, %v)", tt.topic, got, ok, tt.want, tt.wantOK)
+		}
+	}
+
+	for _, value := range []string{"sensors/", "sensors/=", "=broker", "a/=broker:abc", "a/=a.b.c"} {
+		if _, err := parseTopicRoutes(value, "default", 1883); err == nil {
+			t.Errorf("parseTopicRoutes(%q) expects an error", value)
+		}
+	}
+}
+
+func TestParseFilters(t *testing.T) {
+	// SUBSCRIBE of mqtt 5 with packet id 7, no properties and two filters
+	sub := &packet{
+		header: packetSubscribe<<4 | 0x02,
+		body:   []byte{0, 7, 0, 0, 3, 'a', '/', 'b', 1, 0, 1, 'c', 0},
+	}
+	id, filters, err := parseFilters(sub, version5)
+	if err != nil || id != 7 || !reflect.DeepEqual(filters, []string{"a/b", "c"}) {
+		t.Fatalf("parseFilters() = (%d, %q, %v)", id, filters, err)
+	}
+	ack, err := failureAck(sub, version5, id, len(filters))
+	if err != nil {
+		t.Fatalf("failureAck() err: %v", err)
+	}
+	if want := (&packet{header: packetSuback << 4, body: []byte{0, 7, 0, 0x80, 0x80}}); !reflect.DeepEqual(ack, want) {
+		t.Errorf("failureAck() = %+v, want %+v", ack, want)
+	}
+
+	// UNSUBSCRIBE of mqtt 3.1.1 with packet id 9 and two filters
+	unsub := &packet{
+		header: packetUnsubscribe<<4 | 0x02,
+		body:   []byte{0, 9, 0, 1, 'a', 0, 1, 'c'},
+	}
+	id, filters, err = parseFilters(unsub, version311)
+	if err != nil || id != 9 || !reflect.DeepEqual(filters, []string{"a", "c"}) {
+		t.Fatalf("parseFilters() = (%d, %q, %v)", id, filters, err)
+	}
+	if _, err = failureAck(unsub, version311, id, len(filters)); err == nil {
+		t.Errorf("failureAck() of mqtt 3.1.1 UNSUBSCRIBE expects an error")
+	}
+
+	for _, body := range [][]byte{{0, 7}, {0, 7, 0, 3, 'a'}, {0, 7, 0, 1, 'a'}} {
+		if _, _, err = parseFilters(&packet{header: packetSubscribe<<4 | 0x02, body: body}, version311); err == nil {
+			t.Errorf("parseFilters(%v) expects an error", body)
+		}
+	}
+}
+
+func TestReadPacketLimit(t *testing.T) {
+	// PUBLISH declaring 256MB but carrying 3 bytes
+	r := bufio.NewReader(bytes.NewReader([]byte{packetPublish << 4, 0xff, 0xff, 0xff, 0x7f, 0, 1, 'a'}))
+	if _, err := readPacket(r); err == nil {
+		t.Errorf("readPacket() of a packet over the size limit expects an error")
+	}
+	// PUBLISH declaring 10 bytes but carrying 3 bytes
+	r = bufio.NewReader(bytes.NewReader([]byte{packetPublish << 4, 10, 0, 1, 'a'}))
+	if _, err := readPacket(r); err == nil {
+		t.Errorf("readPacket() of a truncated packet expects an error")
+	}
+}
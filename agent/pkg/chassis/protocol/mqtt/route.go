@@ -0,0 +1,85 @@
+package mqtt
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// TopicRoutesAnnotation is the service annotation to route mqtt topics to other services
+// by topic prefix, e.g. "sensors/=sensor-broker,cmd/=cmd-broker.iot:1884". A target
+// is in the form of name[.namespace][:port], the namespace defaults to the namespace
+// of the annotated service, and the port defaults to the port being proxied.
+// Topics matching no prefix are routed to the annotated service itself.
+const TopicRoutesAnnotation = "edgemesh.kubeedge.io/mqtt-topic-routes"
+
+// target is a service port that mqtt packets are routed to
+type target struct {
+	namespace string
+	name      string
+	port      int
+}
+
+func (t target) String() string {
+	return fmt.Sprintf("%s.%s:%d", t.name, t.namespace, t.port)
+}
+
+// topicRoute routes topics with the prefix to the target
+type topicRoute struct {
+	prefix string
+	target target
+}
+
+// parseTopicRoutes parses the value of TopicRoutesAnnotation, the routes are
+// sorted by prefix length in descending order so the longest prefix wins
+func parseTopicRoutes(value, namespace string, port int) ([]topicRoute, error) {
+	var routes []topicRoute
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		pair := strings.SplitN(item, "=", 2)
+		if len(pair) != 2 || pair[0] == "" || pair[1] == "" {
+			return nil, fmt.Errorf("invalid topic route %q", item)
+		}
+		t := target{namespace: namespace, port: port}
+		svc := pair[1]
+		if i := strings.LastIndex(svc, ":"); i >= 0 {
+			p, err := strconv.Atoi(svc[i+1:])
+			if err != nil || p <= 0 || p > 65535 {
+				return nil, fmt.Errorf("invalid port of topic route %q", item)
+			}
+			t.port = p
+			svc = svc[:i]
+		}
+		names := strings.Split(svc, ".")
+		switch len(names) {
+		case 1:
+			t.name = names[0]
+		case 2:
+			t.name, t.namespace = names[0], names[1]
+		default:
+			return nil, fmt.Errorf("invalid service of topic route %q", item)
+		}
+		if t.name == "" || t.namespace == "" {
+			return nil, fmt.Errorf("invalid service of topic route %q", item)
+		}
+		routes = append(routes, topicRoute{prefix: pair[0], target: t})
+	}
+	sort.SliceStable(routes, func(i, j int) bool {
+		return len(routes[i].prefix) > len(routes[j].prefix)
+	})
+	return routes, nil
+}
+
+// matchRoute returns the target of topic, ok is false if no route matches
+func matchRoute(routes []topicRoute, topic string) (t target, ok bool) {
+	for _, r := range routes {
+		if strings.HasPrefix(topic, r.prefix) {
+			return r.target, true
+		}
+	}
+	return target{}, false
+}
@@ -0,0 +1,71 @@
+package protocol
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	istioapi "istio.io/client-go/pkg/apis/networking/v1alpha3"
+)
+
+// Options is the arguments to create a Protocol for a connection
+type Options struct {
+	Conn         net.Conn
+	SvcNamespace string
+	SvcName      string
+	Port         int
+	// VirtualService is set when the destination is routed by a virtual service,
+	// e.g. the http traffic of edgegateway
+	VirtualService *istioapi.VirtualService
+	// External indicates the connection comes from outside the cluster, e.g. edgegateway,
+	// so the externalTrafficPolicy of the service applies
+	External bool
+	// Subset is the subset of the destination rule that narrows the instances of the
+	// service, e.g. v1 or v2 of a service routed by a virtual service
+	Subset string
+}
+
+// NewProtocolFunc creates a Protocol to process a connection
+type NewProtocolFunc func(opts *Options) (Protocol, error)
+
+var (
+	protocolsMu sync.RWMutex
+	protocols   = make(map[string]NewProtocolFunc)
+)
+
+// Register registers a protocol handler under name, the name is matched against
+// the appProtocol or the prefix of the port name, case insensitively.
+// It's expected to be called in the init function of the handler package.
+func Register(name string, f NewProtocolFunc) error {
+	name = strings.ToLower(name)
+	if name == "" || f == nil {
+		return fmt.Errorf("invalid protocol handler %q", name)
+	}
+	protocolsMu.Lock()
+	defer protocolsMu.Unlock()
+	if _, ok := protocols[name]; ok {
+		return fmt.Errorf("protocol handler %s already registered", name)
+	}
+	protocols[name] = f
+	return nil
+}
+
+// IsRegistered returns true if a protocol handler is registered under name
+func IsRegistered(name string) bool {
+	protocolsMu.RLock()
+	defer protocolsMu.RUnlock()
+	_, ok := protocols[strings.ToLower(name)]
+	return ok
+}
+
+// New creates a Protocol by the handler registered under name
+func New(name string, opts *Options) (Protocol, error) {
+	protocolsMu.RLock()
+	f, ok := protocols[strings.ToLower(name)]
+	protocolsMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("protocol: %s is not supported yet", name)
+	}
+	return f(opts)
+}
@@ -0,0 +1,106 @@
+package protocol
+
+import (
+	"math/rand"
+	"strings"
+
+	apiv1alpha3 "istio.io/api/networking/v1alpha3"
+	istioapi "istio.io/client-go/pkg/apis/networking/v1alpha3"
+
+	"github.com/kubeedge/edgemesh/agent/pkg/chassis/controller"
+)
+
+// PickHTTPDestination picks a destination of a http route by weight
+func PickHTTPDestination(dests []*apiv1alpha3.HTTPRouteDestination) *apiv1alpha3.HTTPRouteDestination {
+	i := pickByWeight(len(dests), func(i int) int32 {
+		return dests[i].Weight
+	})
+	if i < 0 {
+		return nil
+	}
+	return dests[i]
+}
+
+// PickDestination picks a destination of a tcp or tls route by weight
+func PickDestination(dests []*apiv1alpha3.RouteDestination) *apiv1alpha3.RouteDestination {
+	i := pickByWeight(len(dests), func(i int) int32 {
+		return dests[i].Weight
+	})
+	if i < 0 {
+		return nil
+	}
+	return dests[i]
+}
+
+// MatchTCPRoute returns the first tcp route of the virtual service matching the port
+// of the mesh traffic, nil is returned if there's none. A route without match
+// conditions matches all the traffic.
+func MatchTCPRoute(vs *istioapi.VirtualService, port int) *apiv1alpha3.TCPRoute {
+	for _, route := range vs.Spec.Tcp {
+		if len(route.Route) == 0 {
+			continue
+		}
+		if len(route.Match) == 0 {
+			return route
+		}
+		for _, m := range route.Match {
+			if (m.Port == 0 || int(m.Port) == port) && matchMeshGateway(m.Gateways) {
+				return route
+			}
+		}
+	}
+	return nil
+}
+
+// matchMeshGateway returns true if the match condition applies to the mesh traffic
+func matchMeshGateway(gateways []string) bool {
+	if len(gateways) == 0 {
+		return true
+	}
+	for _, gw := range gateways {
+		if gw == controller.MeshGateway {
+			return true
+		}
+	}
+	return false
+}
+
+// DestinationService returns the name and namespace of the service of a destination
+// host, a short name is interpreted in the namespace of the virtual service
+func DestinationService(host, namespace string) (string, string) {
+	parts := strings.Split(host, ".")
+	if len(parts) >= 2 {
+		return parts[0], parts[1]
+	}
+	return host, namespace
+}
+
+// pickByWeight returns the index of the picked one of n destinations, the chance of a
+// destination is its weight of the total weight. The destinations are picked evenly if
+// no weight is set, e.g. a single destination. -1 is returned if n is 0.
+func pickByWeight(n int, weight func(i int) int32) int {
+	if n == 0 {
+		return -1
+	}
+	var total int64
+	for i := 0; i < n; i++ {
+		if w := weight(i); w > 0 {
+			total += int64(w)
+		}
+	}
+	if total == 0 {
+		return rand.Intn(n)
+	}
+	r := rand.Int63n(total)
+	for i := 0; i < n; i++ {
+		w := int64(weight(i))
+		if w <= 0 {
+			continue
+		}
+		if r < w {
+			return i
+		}
+		r -= w
+	}
+	return n - 1
+}
@@ -0,0 +1,71 @@
+package protocol
+
+import (
+	"testing"
+
+	apiv1alpha3 "istio.io/api/networking/v1alpha3"
+	istioapi "istio.io/client-go/pkg/apis/networking/v1alpha3"
+)
+
+func TestPickHTTPDestination(t *testing.T) {
+	stable := &apiv1alpha3.HTTPRouteDestination{Destination: &apiv1alpha3.Destination{Host: "stable"}, Weight: 90}
+	canary := &apiv1alpha3.HTTPRouteDestination{Destination: &apiv1alpha3.Destination{Host: "canary"}, Weight: 10}
+	drained := &apiv1alpha3.HTTPRouteDestination{Destination: &apiv1alpha3.Destination{Host: "drained"}, Weight: 0}
+	dests := []*apiv1alpha3.HTTPRouteDestination{stable, canary, drained}
+
+	picked := make(map[string]int)
+	for i := 0; i < 10000; i++ {
+		picked[PickHTTPDestination(dests).Destination.Host]++
+	}
+	if picked["drained"] > 0 {
+		t.Errorf("destination with weight 0 is picked %d times", picked["drained"])
+	}
+	// expect about 1000 picks of canary
+	if picked["canary"] < 700 || picked["canary"] > 1300 {
+		t.Errorf("canary picked %d times of 10000, want about 1000", picked["canary"])
+	}
+
+	// a single destination without weight takes all the traffic
+	single := []*apiv1alpha3.HTTPRouteDestination{{Destination: &apiv1alpha3.Destination{Host: "only"}}}
+	if got := PickHTTPDestination(single).Destination.Host; got != "only" {
+		t.Errorf("picked %s, want only", got)
+	}
+	if PickHTTPDestination(nil) != nil {
+		t.Errorf("picked a destination of no destinations")
+	}
+}
+
+func TestMatchTCPRoute(t *testing.T) {
+	catchAll := &apiv1alpha3.TCPRoute{Route: []*apiv1alpha3.RouteDestination{{Destination: &apiv1alpha3.Destination{Host: "all"}}}}
+	mqtt := &apiv1alpha3.TCPRoute{
+		Match: []*apiv1alpha3.L4MatchAttributes{{Port: 1883}},
+		Route: []*apiv1alpha3.RouteDestination{{Destination: &apiv1alpha3.Destination{Host: "mqtt"}}},
+	}
+	gateway := &apiv1alpha3.TCPRoute{
+		Match: []*apiv1alpha3.L4MatchAttributes{{Gateways: []string{"edgegateway"}}},
+		Route: []*apiv1alpha3.RouteDestination{{Destination: &apiv1alpha3.Destination{Host: "gateway"}}},
+	}
+	vs := &istioapi.VirtualService{Spec: apiv1alpha3.VirtualService{Tcp: []*apiv1alpha3.TCPRoute{gateway, mqtt, catchAll}}}
+
+	if got := MatchTCPRoute(vs, 1883); got != mqtt {
+		t.Errorf("port 1883 matched %v, want the mqtt route", got)
+	}
+	if got := MatchTCPRoute(vs, 80); got != catchAll {
+		t.Errorf("port 80 matched %v, want the catch-all route", got)
+	}
+	vs.Spec.Tcp = []*apiv1alpha3.TCPRoute{gateway}
+	if got := MatchTCPRoute(vs, 80); got != nil {
+		t.Errorf("route of the gateway matched mesh traffic")
+	}
+
+	for host, want := range map[string][2]string{
+		"firmware":                           {"firmware", "edge"},
+		"firmware.default":                   {"firmware", "default"},
+		"firmware.default.svc.cluster.local": {"firmware", "default"},
+	} {
+		name, namespace := DestinationService(host, "edge")
+		if name != want[0] || namespace != want[1] {
+			t.Errorf("service of host %s = %s.%s, want %s.%s", host, name, namespace, want[0], want[1])
+		}
+	}
+}
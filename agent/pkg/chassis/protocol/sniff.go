@@ -0,0 +1,135 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// protocols detected by Sniff
+const (
+	ProtocolHTTP  = "http"
+	ProtocolHTTP2 = "http2"
+	ProtocolTLS   = "tls"
+	ProtocolTCP   = "tcp"
+)
+
+// sniffBufferSize is large enough to hold the longest signature
+const sniffBufferSize = 4096
+
+var (
+	http2Preface = []byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n")
+	httpMethods  = [][]byte{
+		[]byte("GET "),
+		[]byte("POST "),
+		[]byte("PUT "),
+		[]byte("DELETE "),
+		[]byte("HEAD "),
+		[]byte("OPTIONS "),
+		[]byte("PATCH "),
+		[]byte("CONNECT "),
+		[]byte("TRACE "),
+	}
+)
+
+// SniffConn is a net.Conn whose sniffed bytes are replayed to the following reads
+type SniffConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// Read reads the sniffed bytes first, then reads from the underlying conn directly
+func (c *SniffConn) Read(b []byte) (int, error) {
+	if c.r.Buffered() > 0 {
+		return c.r.Read(b)
+	}
+	return c.Conn.Read(b)
+}
+
+// Unwrap returns the sniffed bytes which haven't been read and the underlying conn,
+// the SniffConn must not be read any more.
+func (c *SniffConn) Unwrap() ([]byte, net.Conn) {
+	buffered := make([]byte, c.r.Buffered())
+	// never fails since the bytes have been buffered
+	c.r.Read(buffered)
+	return buffered, c.Conn
+}
+
+// Sniff peeks the first bytes of conn to detect its l7 protocol. It waits for
+// the client to talk at most timeout, a server-first or silent client is
+// treated as opaque tcp. The returned conn must be used instead of conn.
+func Sniff(conn net.Conn, timeout time.Duration) (string, net.Conn) {
+	sc := &SniffConn{
+		Conn: conn,
+		r:    bufio.NewReaderSize(conn, sniffBufferSize),
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		klog.Warningf("set read deadline err: %v", err)
+		return ProtocolTCP, sc
+	}
+	defer func() {
+		if err := conn.SetReadDeadline(time.Time{}); err != nil {
+			klog.Warningf("reset read deadline err: %v", err)
+		}
+	}()
+
+	n := 1
+	for {
+		// Peek blocks until n bytes arrive or the deadline exceeds, the error
+		// is consumed by Peek so it won't be seen by the following reads
+		_, err := sc.r.Peek(n)
+		head, _ := sc.r.Peek(sc.r.Buffered())
+		proto, more := detectProtocol(head)
+		if !more {
+			return proto, sc
+		}
+		if err != nil {
+			klog.V(4).Infof("sniff %d bytes from %s err: %v", len(head), conn.RemoteAddr(), err)
+			return ProtocolTCP, sc
+		}
+		n = len(head) + 1
+	}
+}
+
+// detectProtocol detects the protocol by the head of a stream, more is true if
+// head may be the prefix of a signature and more bytes are required.
+func detectProtocol(head []byte) (proto string, more bool) {
+	if len(head) == 0 {
+		return ProtocolTCP, true
+	}
+	// TLS record: content type handshake(0x16), major version 3, 2 bytes
+	// minor version and length, then handshake type ClientHello(0x01)
+	if head[0] == 0x16 {
+		if len(head) < 6 {
+			return ProtocolTCP, len(head) < 2 || head[1] == 0x03
+		}
+		if head[1] == 0x03 && head[5] == 0x01 {
+			return ProtocolTLS, false
+		}
+		return ProtocolTCP, false
+	}
+	if matched, prefix := hasPrefix(head, http2Preface); matched {
+		return ProtocolHTTP2, false
+	} else if prefix {
+		more = true
+	}
+	for _, method := range httpMethods {
+		if matched, prefix := hasPrefix(head, method); matched {
+			return ProtocolHTTP, false
+		} else if prefix {
+			more = true
+		}
+	}
+	return ProtocolTCP, more
+}
+
+// hasPrefix returns whether head starts with sig, or head is a prefix of sig
+func hasPrefix(head, sig []byte) (matched, prefix bool) {
+	if len(head) >= len(sig) {
+		return bytes.HasPrefix(head, sig), false
+	}
+	return false, bytes.HasPrefix(sig, head)
+}
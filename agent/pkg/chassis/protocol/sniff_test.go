@@ -0,0 +1,67 @@
+package protocol
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDetectProtocol(t *testing.T) {
+	tests := []struct {
+		name      string
+		head      []byte
+		wantProto string
+		wantMore  bool
+	}{
+		{"empty", nil, ProtocolTCP, true},
+		{"http get", []byte("GET / HTTP/1.1\r\n"), ProtocolHTTP, false},
+		{"http method prefix", []byte("PO"), ProtocolTCP, true},
+		{"http2 preface", []byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"), ProtocolHTTP2, false},
+		{"http2 preface prefix", []byte("PRI * HTTP/2"), ProtocolTCP, true},
+		{"tls client hello", []byte{0x16, 0x03, 0x01, 0x02, 0x00, 0x01, 0x00}, ProtocolTLS, false},
+		{"tls record prefix", []byte{0x16, 0x03}, ProtocolTCP, true},
+		{"tls other handshake", []byte{0x16, 0x03, 0x01, 0x02, 0x00, 0x02}, ProtocolTCP, false},
+		{"mqtt connect", []byte{0x10, 0x0c, 0x00, 0x04, 'M', 'Q', 'T', 'T'}, ProtocolTCP, false},
+		{"lowercase method", []byte("get / HTTP/1.1\r\n"), ProtocolTCP, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proto, more := detectProtocol(tt.head)
+			if proto != tt.wantProto || more != tt.wantMore {
+				t.Errorf("detectProtocol() = (%v, %v), want (%v, %v)", proto, more, tt.wantProto, tt.wantMore)
+			}
+		})
+	}
+}
+
+func TestSniff(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	payload := "GET / HTTP/1.1\r\nHost: foo\r\n\r\n"
+	go func() {
+		// write in pieces to make Sniff wait for more bytes
+		client.Write([]byte(payload[:2]))
+		client.Write([]byte(payload[2:]))
+		client.Close()
+	}()
+
+	proto, conn := Sniff(server, time.Second)
+	if proto != ProtocolHTTP {
+		t.Fatalf("Sniff() proto = %v, want %v", proto, ProtocolHTTP)
+	}
+	data, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("read sniffed conn err: %v", err)
+	}
+	if string(data) != payload {
+		t.Errorf("read sniffed conn = %q, want %q", data, payload)
+	}
+
+	// a silent client is treated as tcp when timeout
+	client, server = net.Pipe()
+	defer client.Close()
+	if proto, _ = Sniff(server, 10*time.Millisecond); proto != ProtocolTCP {
+		t.Errorf("Sniff() proto = %v, want %v", proto, ProtocolTCP)
+	}
+}
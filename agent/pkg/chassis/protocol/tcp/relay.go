@@ -0,0 +1,294 @@
+package tcp
+
+import (
+	"expvar"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"k8s.io/klog/v2"
+
+	"github.com/kubeedge/edgemesh/agent/pkg/chassis/config"
+	"github.com/kubeedge/edgemesh/agent/pkg/chassis/protocol"
+	meshutil "github.com/kubeedge/edgemesh/common/util"
+)
+
+var (
+	// relayStats records the traffic of l4 proxy by service
+	relayStats   = expvar.NewMap("tcp_relay")
+	relayStatsMu sync.Mutex
+)
+
+// conntrack is a pair of connections relayed by l4 proxy
+type conntrack struct {
+	// svc is the service key used for byte accounting
+	svc   string
+	lconn net.Conn
+	rconn net.Conn
+	// resetAfter is the number of bytes relayed in both directions before the connections
+	// are reset by an injected abort, no reset if it isn't positive
+	resetAfter int64
+	// relayed is the number of bytes relayed, only counted if resetAfter is positive
+	relayed int64
+}
+
+// closeWriter is implemented by connections supporting half-close, e.g. *net.TCPConn
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// relay copies data in both directions until both of them finish. The EOF of one
+// direction is propagated by half-closing the peer, so protocols relying on
+// shutdown(SHUT_WR) keep working. Copying between *net.TCPConn is done by splice.
+func (c *conntrack) relay() {
+	// replay the bytes read when sniffing, then the underlying conn can be spliced
+	if sc, ok := c.lconn.(*protocol.SniffConn); ok {
+		var buffered []byte
+		buffered, c.lconn = sc.Unwrap()
+		if len(buffered) > 0 {
+			if _, err := c.rconn.Write(buffered); err != nil {
+				klog.Errorf("l4 proxy write sniffed bytes err: %v", err)
+				c.close()
+				return
+			}
+		}
+	}
+	setKeepAlive(c.lconn)
+	setKeepAlive(c.rconn)
+
+	done := make(chan struct{})
+	if timeout := time.Duration(config.Chassis.Protocol.TCPIdleTimeout) * time.Second; timeout > 0 {
+		go c.watchIdle(timeout, done)
+	}
+
+	var sent, received int64
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		sent = c.copy(c.rconn, c.lconn)
+	}()
+	go func() {
+		defer wg.Done()
+		received = c.copy(c.lconn, c.rconn)
+	}()
+	wg.Wait()
+	close(done)
+	c.close()
+
+	addRelayStats(c.svc, sent, received)
+	klog.Infof("l4 proxy from %s to %s closed, %d bytes sent, %d bytes received",
+		c.lconn.RemoteAddr(), c.rconn.RemoteAddr(), sent, received)
+}
+
+// copy copies from src to dst until EOF, then half-closes dst. Both connections
+// are closed if any error occurs, which also stops the other direction.
+func (c *conntrack) copy(dst, src net.Conn) int64 {
+	var n int64
+	var err error
+	if c.resetAfter > 0 {
+		return c.copyUntilReset(dst, src)
+	}
+	if _, ok := dst.(*net.TCPConn); ok {
+		// *net.TCPConn implements io.ReaderFrom by splice
+		n, err = io.Copy(dst, src)
+	} else {
+		n, err = io.CopyBuffer(dst, src, make([]byte, config.Chassis.Protocol.TCPBufferSize))
+	}
+	if err != nil {
+		if !meshutil.IsClosedNetworkError(err) {
+			klog.Warningf("l4 proxy copy from %s to %s err: %v", src.RemoteAddr(), dst.RemoteAddr(), err)
+		}
+		c.close()
+		return n
+	}
+	if cw, ok := dst.(closeWriter); ok {
+		if err = cw.CloseWrite(); err != nil && !meshutil.IsClosedNetworkError(err) {
+			klog.Warningf("l4 proxy half-close %s err: %v", dst.RemoteAddr(), err)
+		}
+		return n
+	}
+	// half-close is not supported, close the connection entirely
+	c.close()
+	return n
+}
+
+// copyUntilReset copies from src to dst like copy, but resets both connections once
+// resetAfter bytes are relayed in both directions
+func (c *conntrack) copyUntilReset(dst, src net.Conn) int64 {
+	var n int64
+	buf := make([]byte, config.Chassis.Protocol.TCPBufferSize)
+	for {
+		nr, err := src.Read(buf)
+		if nr > 0 {
+			before := atomic.AddInt64(&c.relayed, int64(nr)) - int64(nr)
+			remaining := c.resetAfter - before
+			if remaining <= 0 {
+				c.reset()
+				return n
+			}
+			if int64(nr) > remaining {
+				nr = int(remaining)
+			}
+			nw, werr := dst.Write(buf[:nr])
+			n += int64(nw)
+			if werr != nil {
+				err = werr
+			} else if int64(nr) == remaining {
+				klog.Infof("l4 proxy from %s to %s reset by injected abort after %d bytes",
+					c.lconn.RemoteAddr(), c.rconn.RemoteAddr(), c.resetAfter)
+				c.reset()
+				return n
+			}
+		}
+		if err == io.EOF {
+			if cw, ok := dst.(closeWriter); ok {
+				if err = cw.CloseWrite(); err != nil && !meshutil.IsClosedNetworkError(err) {
+					klog.Warningf("l4 proxy half-close %s err: %v", dst.RemoteAddr(), err)
+				}
+				return n
+			}
+			c.close()
+			return n
+		}
+		if err != nil {
+			if !meshutil.IsClosedNetworkError(err) {
+				klog.Warningf("l4 proxy copy from %s to %s err: %v", src.RemoteAddr(), dst.RemoteAddr(), err)
+			}
+			c.close()
+			return n
+		}
+	}
+}
+
+// watchIdle closes the connections if no data is transferred in both directions
+// for timeout. The activity is read from TCP_INFO, so the splice isn't interrupted.
+func (c *conntrack) watchIdle(timeout time.Duration, done <-chan struct{}) {
+	lconn, lok := c.lconn.(*net.TCPConn)
+	rconn, rok := c.rconn.(*net.TCPConn)
+	if !lok || !rok {
+		klog.V(4).Infof("idle timeout is only supported between tcp connections")
+		return
+	}
+	interval := timeout / 2
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			lidle, err := idleTime(lconn)
+			if err != nil {
+				klog.Warningf("get idle time of %s err: %v", lconn.RemoteAddr(), err)
+				return
+			}
+			ridle, err := idleTime(rconn)
+			if err != nil {
+				klog.Warningf("get idle time of %s err: %v", rconn.RemoteAddr(), err)
+				return
+			}
+			if lidle >= timeout && ridle >= timeout {
+				klog.Infof("l4 proxy from %s to %s idle for %v, close it", lconn.RemoteAddr(), rconn.RemoteAddr(), timeout)
+				c.close()
+				return
+			}
+		}
+	}
+}
+
+func (c *conntrack) close() {
+	// closing twice is harmless, the error is ignored
+	c.lconn.Close()
+	c.rconn.Close()
+}
+
+// reset resets both connections
+func (c *conntrack) reset() {
+	Reset(c.lconn)
+	Reset(c.rconn)
+}
+
+// Reset closes conn with RST instead of FIN if it's a tcp connection
+func Reset(conn net.Conn) {
+	if sc, ok := conn.(*protocol.SniffConn); ok {
+		conn = sc.Conn
+	}
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		if err := tcpConn.SetLinger(0); err != nil {
+			klog.Warningf("set linger of %s err: %v", conn.RemoteAddr(), err)
+		}
+	}
+	// closing twice is harmless, the error is ignored
+	conn.Close()
+}
+
+// setKeepAlive enables tcp keepalive on conn by the configured period, or disables it if
+// the period is 0 or negative, since go enables it by default
+func setKeepAlive(conn net.Conn) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	period := config.Chassis.Protocol.TCPKeepAlivePeriod
+	if period <= 0 {
+		if err := tcpConn.SetKeepAlive(false); err != nil {
+			klog.Warningf("disable keepalive of %s err: %v", conn.RemoteAddr(), err)
+		}
+		return
+	}
+	if err := tcpConn.SetKeepAlive(true); err != nil {
+		klog.Warningf("set keepalive of %s err: %v", conn.RemoteAddr(), err)
+		return
+	}
+	if err := tcpConn.SetKeepAlivePeriod(time.Duration(period) * time.Second); err != nil {
+		klog.Warningf("set keepalive period of %s err: %v", conn.RemoteAddr(), err)
+	}
+}
+
+// idleTime returns the duration since data was last sent or received on conn
+func idleTime(conn *net.TCPConn) (time.Duration, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var info syscall.TCPInfo
+	size := uint32(unsafe.Sizeof(info))
+	var errno syscall.Errno
+	err = raw.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, syscall.IPPROTO_TCP, syscall.TCP_INFO,
+			uintptr(unsafe.Pointer(&info)), uintptr(unsafe.Pointer(&size)), 0)
+	})
+	if err != nil {
+		return 0, err
+	}
+	if errno != 0 {
+		return 0, errno
+	}
+	idle := info.Last_data_recv
+	if info.Last_data_sent < idle {
+		idle = info.Last_data_sent
+	}
+	return time.Duration(idle) * time.Millisecond, nil
+}
+
+// addRelayStats accounts the bytes relayed for a service
+func addRelayStats(svc string, sent, received int64) {
+	relayStatsMu.Lock()
+	m, ok := relayStats.Get(svc).(*expvar.Map)
+	if !ok {
+		m = new(expvar.Map).Init()
+		relayStats.Set(svc, m)
+	}
+	relayStatsMu.Unlock()
+	m.Add("connections", 1)
+	m.Add("bytesSent", sent)
+	m.Add("bytesReceived", received)
+}
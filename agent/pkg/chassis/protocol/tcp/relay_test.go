@@ -0,0 +1,70 @@
+package tcp
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"github.com/kubeedge/edgemesh/agent/pkg/chassis/config"
+)
+
+func TestRelayHalfClose(t *testing.T) {
+	config.InitConfigure(config.NewGoChassisConfig())
+
+	// server replies after the client half-closes the connection
+	server, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	go func() {
+		conn, err := server.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		req, _ := ioutil.ReadAll(conn)
+		conn.Write(append([]byte("echo: "), req...))
+	}()
+
+	proxy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	relayed := make(chan *conntrack, 1)
+	go func() {
+		lconn, err := proxy.Accept()
+		if err != nil {
+			return
+		}
+		rconn, err := net.Dial("tcp", server.Addr().String())
+		if err != nil {
+			lconn.Close()
+			return
+		}
+		ctk := &conntrack{svc: "test.default:80", lconn: lconn, rconn: rconn}
+		ctk.relay()
+		relayed <- ctk
+	}()
+
+	client, err := net.Dial("tcp", proxy.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, err = client.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err = client.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := ioutil.ReadAll(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(resp) != "echo: hello" {
+		t.Errorf("response = %q, want %q", resp, "echo: hello")
+	}
+	<-relayed
+}
@@ -14,17 +14,25 @@ import (
 	"k8s.io/klog/v2"
 
 	"github.com/kubeedge/edgemesh/agent/pkg/chassis/config"
+	"github.com/kubeedge/edgemesh/agent/pkg/chassis/loadbalancer/latency"
+	"github.com/kubeedge/edgemesh/agent/pkg/chassis/loadbalancer/leastconn"
+	"github.com/kubeedge/edgemesh/agent/pkg/chassis/loadbalancer/retry"
+	"github.com/kubeedge/edgemesh/agent/pkg/chassis/loadbalancer/sessionaffinity"
 	"github.com/kubeedge/edgemesh/agent/pkg/chassis/loadbalancer/util"
+	"github.com/kubeedge/edgemesh/agent/pkg/chassis/panel"
+	"github.com/kubeedge/edgemesh/agent/pkg/chassis/protocol"
+	"github.com/kubeedge/edgemesh/agent/pkg/chassis/registry"
 )
 
-const l4ProxyHandlerName = "l4Proxy"
+// L4ProxyHandlerName is the name of the handler returning the endpoint picked by the load balancer
+const L4ProxyHandlerName = "l4Proxy"
 
 // L4ProxyHandler l4 proxy handler
 type L4ProxyHandler struct{}
 
 // Name name
 func (h *L4ProxyHandler) Name() string {
-	return l4ProxyHandlerName
+	return L4ProxyHandlerName
 }
 
 // Handle handle
@@ -42,15 +50,25 @@ func newL4ProxyHandler() handler.Handler {
 }
 
 func init() {
-	err := handler.RegisterHandler(l4ProxyHandlerName, newL4ProxyHandler)
+	err := handler.RegisterHandler(L4ProxyHandlerName, newL4ProxyHandler)
 	if err != nil {
 		klog.Errorf("register l4 proxy handler err: %v", err)
 	}
+	err = protocol.Register(protocol.ProtocolTCP, newTCP)
+	if err != nil {
+		klog.Errorf("register tcp protocol err: %v", err)
+	}
 }
 
-type conntrack struct {
-	lconn net.Conn
-	rconn net.Conn
+func newTCP(opts *protocol.Options) (protocol.Protocol, error) {
+	return &TCP{
+		Conn:         opts.Conn,
+		SvcNamespace: opts.SvcNamespace,
+		SvcName:      opts.SvcName,
+		Port:         opts.Port,
+		External:     opts.External,
+		Subset:       opts.Subset,
+	}, nil
 }
 
 // TCP tcp
@@ -61,42 +79,133 @@ type TCP struct {
 	Port         int
 	// for websocket
 	UpgradeReq []byte
+	// External indicates the connection comes from outside the cluster
+	External bool
+	// Subset is the subset of the destination rule the connection is routed to
+	Subset string
+
+	// dialErr is the error dialing the endpoint picked by the last attempt
+	dialErr error
+	// resetAfter is the number of bytes relayed before the connection is reset by an
+	// injected abort, no reset if it's negative
+	resetAfter int64
 }
 
 // Process process
 func (p *TCP) Process() {
+	// create handlerchain
+	c, err := handler.CreateChain(common.Consumer, "tcp", panel.ConnectionPoolHandlerName, handler.Loadbalance, leastconn.ActiveCounterHandlerName, L4ProxyHandlerName)
+	if err != nil {
+		klog.Errorf("create handler chain error: %v", err)
+		err = p.Conn.Close()
+		if err != nil {
+			klog.Errorf("close conn err: %v", err)
+		}
+		return
+	}
+
+	// the connection attempts beyond the rate limits are closed
+	if !panel.Allow(p.newInvocation(nil)) {
+		err = p.Conn.Close()
+		if err != nil {
+			klog.Errorf("close conn err: %v", err)
+		}
+		return
+	}
+	if p.injectFault() {
+		return
+	}
+
+	// start to handle, another instance is picked if the picked one fails to connect
+	attempts := config.Chassis.Protocol.TCPReconnectTimes
+	if attempts < 1 {
+		attempts = 1
+	}
+	var failed []string
+	for attempt := 1; ; attempt++ {
+		inv := p.newInvocation(failed)
+		p.dialErr = nil
+		c.Next(inv, p.responseCallback)
+		if p.dialErr == nil {
+			return
+		}
+		if attempt >= attempts {
+			break
+		}
+		klog.Warningf("l4 proxy dial server %s error: %v, retry another instance", inv.Endpoint, p.dialErr)
+		failed = append(failed, inv.Endpoint)
+	}
+	// error when connecting to server, maybe timeout or any other error
+	klog.Errorf("l4 proxy dial server error: %v", p.dialErr)
+	err = p.Conn.Close()
+	if err != nil {
+		klog.Errorf("close conn err: %v", err)
+	}
+}
+
+// injectFault delays the connection and decides whether to abort it by the tcp fault of
+// the service. It returns true if the connection is reset right away.
+func (p *TCP) injectFault() bool {
+	p.resetAfter = -1
+	if p.UpgradeReq != nil {
+		// websocket carries the faults of the http route
+		return false
+	}
+	fault := panel.GetTCPFault(p.SvcNamespace, p.SvcName)
+	if fault == nil {
+		return false
+	}
+	if delay := panel.Delayed(fault.Delay); delay > 0 {
+		klog.V(4).Infof("inject delay %v to connection from %s of svc %s.%s", delay, p.Conn.RemoteAddr(), p.SvcNamespace, p.SvcName)
+		time.Sleep(delay)
+	}
+	if !panel.Aborted(fault.Abort) {
+		return false
+	}
+	klog.V(4).Infof("inject abort after %d bytes to connection from %s of svc %s.%s",
+		fault.AbortAfterBytes, p.Conn.RemoteAddr(), p.SvcNamespace, p.SvcName)
+	if fault.AbortAfterBytes == 0 {
+		Reset(p.Conn)
+		return true
+	}
+	p.resetAfter = fault.AbortAfterBytes
+	return false
+}
+
+// newInvocation creates an invocation excluding the endpoints failed by previous attempts
+func (p *TCP) newInvocation(failed []string) *invocation.Invocation {
 	// create invocation
 	inv := invocation.New(context.Background())
 
 	// set invocation
 	inv.MicroServiceName = fmt.Sprintf("%s.%s.svc.cluster.local:%d", p.SvcName, p.SvcNamespace, p.Port)
 	inv.SourceServiceID = ""
+	if p.External {
+		inv.SourceServiceID = registry.ExternalConsumerID
+	}
 	if p.UpgradeReq == nil {
 		inv.Protocol = "tcp"
 	} else {
 		// websocket
 		inv.Protocol = "rest"
 	}
-	inv.Strategy = util.GetStrategyName(p.SvcNamespace, p.SvcName)
+	inv.RouteTags = registry.SubsetTags(p.Subset)
+	inv.Strategy = util.GetStrategyName(p.SvcNamespace, p.SvcName, p.Subset)
 	inv.Args = p.UpgradeReq
-
-	// create handlerchain
-	c, err := handler.CreateChain(common.Consumer, "tcp", handler.Loadbalance, l4ProxyHandlerName)
-	if err != nil {
-		klog.Errorf("create handler chain error: %v", err)
-		err = p.Conn.Close()
-		if err != nil {
-			klog.Errorf("close conn err: %v", err)
-		}
-		return
+	sessionaffinity.SetClientIP(inv, p.Conn.RemoteAddr())
+	for _, ep := range failed {
+		retry.Exclude(inv, ep)
 	}
-
-	// start to handle
-	c.Next(inv, p.responseCallback)
+	return inv
 }
 
 // responseCallback process invocation response
 func (p *TCP) responseCallback(data *invocation.Response) error {
+	if data.Err == panel.ErrOverflow {
+		// the connection is reset like the upstream refuses it
+		Reset(p.Conn)
+		return data.Err
+	}
 	if data.Err != nil {
 		klog.Errorf("handle l4 proxy err: %v", data.Err)
 		err := p.Conn.Close()
@@ -139,28 +248,24 @@ func (p *TCP) responseCallback(data *invocation.Response) error {
 		Port: port,
 	}
 	klog.Infof("l4 proxy get server address: %v", addr)
-	var proxyClient net.Conn
-	defaultTCPReconnectTimes := config.Chassis.Protocol.TCPReconnectTimes
 	defaultTCPClientTimeout := time.Second * time.Duration(config.Chassis.Protocol.TCPClientTimeout)
-	for retry := 0; retry < defaultTCPReconnectTimes; retry++ {
-		proxyClient, err = net.DialTimeout("tcp", addr.String(), defaultTCPClientTimeout)
-		if err == nil {
-			break
-		}
-	}
-	// error when connecting to server, maybe timeout or any other error
+	start := time.Now()
+	proxyClient, err := net.DialTimeout("tcp", addr.String(), defaultTCPClientTimeout)
+	latency.Observe(addr.String(), time.Since(start), err)
 	if err != nil {
-		klog.Errorf("l4 proxy dial server error: %v", err)
-		err = p.Conn.Close()
-		if err != nil {
-			klog.Errorf("close conn err: %v", err)
-		}
+		registry.ReportError(p.SvcNamespace, p.SvcName, p.Subset, ep, true)
+		// the caller retries another instance or closes the conn
+		p.dialErr = err
 		return err
 	}
 
+	registry.ReportSuccess(p.SvcNamespace, p.SvcName, p.Subset, ep)
+
 	ctk := &conntrack{
-		lconn: p.Conn,
-		rconn: proxyClient,
+		svc:        fmt.Sprintf("%s.%s:%d", p.SvcName, p.SvcNamespace, p.Port),
+		lconn:      p.Conn,
+		rconn:      proxyClient,
+		resetAfter: p.resetAfter,
 	}
 
 	// do websocket req
@@ -182,96 +287,7 @@ func (p *TCP) responseCallback(data *invocation.Response) error {
 	}
 
 	klog.Infof("l4 Proxy start a proxy to server %s", addr.String())
-	go ctk.processServerProxy()
-	go ctk.processClientProxy()
+	// block until the connection is done, so the caller can track its lifetime
+	ctk.relay()
 	return nil
 }
-
-// processServerProxy process up link traffic
-func (c *conntrack) processClientProxy() {
-	buf := make([]byte, config.Chassis.Protocol.TCPBufferSize)
-	for {
-		n, err := c.lconn.Read(buf)
-		// service caller closes the connection
-		if n == 0 {
-			err = c.lconn.Close()
-			if err != nil {
-				klog.Errorf("lconn close err: %v", err)
-			}
-			err = c.rconn.Close()
-			if err != nil {
-				klog.Errorf("rconn close err: %v", err)
-			}
-			break
-		}
-		if err != nil {
-			klog.Infof("processClientProxy read err: %s", err)
-			err = c.lconn.Close()
-			if err != nil {
-				klog.Errorf("lconn close err: %v", err)
-			}
-			err = c.rconn.Close()
-			if err != nil {
-				klog.Errorf("rconn close err: %v", err)
-			}
-			break
-		}
-		_, err = c.rconn.Write(buf[:n])
-		if err != nil {
-			klog.Infof("processClientProxy write err: %s", err)
-			err = c.lconn.Close()
-			if err != nil {
-				klog.Errorf("lconn close err: %v", err)
-			}
-			err = c.rconn.Close()
-			if err != nil {
-				klog.Errorf("rconn close err: %v", err)
-			}
-			break
-		}
-	}
-}
-
-// processServerProxy process down link traffic
-func (c *conntrack) processServerProxy() {
-	buf := make([]byte, config.Chassis.Protocol.TCPBufferSize)
-	for {
-		n, err := c.rconn.Read(buf)
-		if n == 0 {
-			err = c.rconn.Close()
-			if err != nil {
-				klog.Errorf("rconn close err: %v", err)
-			}
-			err = c.lconn.Close()
-			if err != nil {
-				klog.Errorf("lconn close err: %v", err)
-			}
-			break
-		}
-		if err != nil {
-			klog.Infof("processServerProxy read err: %s", err)
-			err = c.rconn.Close()
-			if err != nil {
-				klog.Errorf("rconn close err: %v", err)
-			}
-			err = c.lconn.Close()
-			if err != nil {
-				klog.Errorf("lconn close err: %v", err)
-			}
-			break
-		}
-		_, err = c.lconn.Write(buf[:n])
-		if err != nil {
-			klog.Infof("processServerProxy write err: %s", err)
-			err = c.rconn.Close()
-			if err != nil {
-				klog.Errorf("rconn close err: %v", err)
-			}
-			err = c.lconn.Close()
-			if err != nil {
-				klog.Errorf("lconn close err: %v", err)
-			}
-			break
-		}
-	}
-}
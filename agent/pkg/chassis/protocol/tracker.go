@@ -0,0 +1,93 @@
+package protocol
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// closeWait is how long Drain waits for the handlers after force closing connections
+const closeWait = 5 * time.Second
+
+// ConnTracker tracks the connections being processed, so they can be drained on shutdown
+type ConnTracker struct {
+	mu       sync.Mutex
+	conns    map[net.Conn]struct{}
+	draining bool
+	wg       sync.WaitGroup
+}
+
+// NewConnTracker returns a ConnTracker
+func NewConnTracker() *ConnTracker {
+	return &ConnTracker{
+		conns: make(map[net.Conn]struct{}),
+	}
+}
+
+// Track starts tracking conn, false is returned if the tracker is draining
+// and the caller should close conn. Untrack must be called when conn is done.
+func (t *ConnTracker) Track(conn net.Conn) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.draining {
+		return false
+	}
+	t.conns[conn] = struct{}{}
+	t.wg.Add(1)
+	return true
+}
+
+// Untrack stops tracking conn
+func (t *ConnTracker) Untrack(conn net.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.conns[conn]; !ok {
+		return
+	}
+	delete(t.conns, conn)
+	t.wg.Done()
+}
+
+// Len returns the number of tracked connections
+func (t *ConnTracker) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.conns)
+}
+
+// Drain stops tracking new connections and waits for the tracked connections to
+// finish within period, the remaining connections are closed and their number is returned.
+func (t *ConnTracker) Drain(period time.Duration) int {
+	t.mu.Lock()
+	t.draining = true
+	t.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return 0
+	case <-time.After(period):
+	}
+
+	t.mu.Lock()
+	dropped := len(t.conns)
+	for conn := range t.conns {
+		if err := conn.Close(); err != nil {
+			klog.Errorf("close conn err: %v", err)
+		}
+	}
+	t.mu.Unlock()
+	// the handlers return soon after their connections are closed
+	select {
+	case <-done:
+	case <-time.After(closeWait):
+		klog.Warningf("%d connections are still being processed after closed", t.Len())
+	}
+	return dropped
+}
@@ -0,0 +1,42 @@
+package protocol
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestConnTrackerDrain(t *testing.T) {
+	tracker := NewConnTracker()
+
+	// a connection finishing within the drain period
+	finished, finishedPeer := net.Pipe()
+	defer finishedPeer.Close()
+	if !tracker.Track(finished) {
+		t.Fatalf("Track() = false before draining")
+	}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		finished.Close()
+		tracker.Untrack(finished)
+	}()
+
+	// a connection processed until it's closed
+	stuck, stuckPeer := net.Pipe()
+	defer stuckPeer.Close()
+	tracker.Track(stuck)
+	go func() {
+		defer tracker.Untrack(stuck)
+		stuck.Read(make([]byte, 1))
+	}()
+
+	if dropped := tracker.Drain(100 * time.Millisecond); dropped != 1 {
+		t.Errorf("Drain() = %d, want 1", dropped)
+	}
+	if n := tracker.Len(); n != 0 {
+		t.Errorf("Len() = %d after draining, want 0", n)
+	}
+	if tracker.Track(stuck) {
+		t.Errorf("Track() = true when draining")
+	}
+}
@@ -0,0 +1,356 @@
+package registry
+
+import (
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chassis/go-chassis/core/registry"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+
+	"github.com/kubeedge/edgemesh/common/util"
+)
+
+// HealthCheckAnnotation is the service annotation to check the health of the instances
+// actively, e.g. "type=http,path=/healthz,interval=10s,timeout=2s". The instances are
+// checked by tcp connect if type is tcp, or by http GET expecting a 2xx or 3xx status
+// if type is http. An instance is unhealthy after unhealthyThreshold consecutive failed
+// checks and healthy again after healthyThreshold consecutive successful ones, port
+// overrides the port of the instances to check. The instances failing the checks are
+// removed from the instances of the service.
+const HealthCheckAnnotation = "edgemesh.kubeedge.io/health-check"
+
+const (
+	// defaultHealthCheckInterval is the default interval between two checks
+	defaultHealthCheckInterval = 10 * time.Second
+	// defaultHealthCheckTimeout is the default timeout of a check
+	defaultHealthCheckTimeout = 2 * time.Second
+	// defaultHealthyThreshold is the default successful checks marking an instance healthy
+	defaultHealthyThreshold = 1
+	// defaultUnhealthyThreshold is the default failed checks marking an instance unhealthy
+	defaultUnhealthyThreshold = 3
+	// healthCheckExpireAfter is how many intervals an instance is checked since it's
+	// last looked up, the checker of a service stops once all its instances expire
+	healthCheckExpireAfter = 30
+)
+
+// checkers are the health checkers by service
+var checkers sync.Map
+
+func init() {
+	expvar.Publish("health_check", expvar.Func(func() interface{} {
+		snapshot := make(map[string]map[string]string)
+		checkers.Range(func(key, value interface{}) bool {
+			snapshot[key.(string)] = value.(*healthChecker).snapshot()
+			return true
+		})
+		return snapshot
+	}))
+}
+
+// healthCheck is the health check of a service
+type healthCheck struct {
+	checkType          string
+	path               string
+	port               int
+	interval           time.Duration
+	timeout            time.Duration
+	healthyThreshold   int
+	unhealthyThreshold int
+}
+
+// parseHealthCheck parses the value of HealthCheckAnnotation
+func parseHealthCheck(value string) (healthCheck, error) {
+	hc := healthCheck{
+		checkType:          "tcp",
+		path:               "/",
+		interval:           defaultHealthCheckInterval,
+		timeout:            defaultHealthCheckTimeout,
+		healthyThreshold:   defaultHealthyThreshold,
+		unhealthyThreshold: defaultUnhealthyThreshold,
+	}
+	err := util.ParseOptions(value, "health check", func(key, v string) (err error) {
+		switch key {
+		case "type":
+			if v != "tcp" && v != "http" {
+				err = fmt.Errorf("unsupported type")
+			}
+			hc.checkType = v
+		case "path":
+			if !strings.HasPrefix(v, "/") {
+				err = fmt.Errorf("path must start with /")
+			}
+			hc.path = v
+		case "port":
+			hc.port, err = strconv.Atoi(v)
+			if err == nil && (hc.port <= 0 || hc.port > 65535) {
+				err = fmt.Errorf("port out of range")
+			}
+		case "interval":
+			hc.interval, err = parsePositiveDuration(v)
+		case "timeout":
+			hc.timeout, err = parsePositiveDuration(v)
+		case "healthyThreshold":
+			hc.healthyThreshold, err = parsePositiveInt(v)
+		case "unhealthyThreshold":
+			hc.unhealthyThreshold, err = parsePositiveInt(v)
+		default:
+			err = util.ErrUnknownOption
+		}
+		return err
+	})
+	return hc, err
+}
+
+func parsePositiveDuration(v string) (time.Duration, error) {
+	d, err := time.ParseDuration(v)
+	if err == nil && d <= 0 {
+		err = fmt.Errorf("must be positive")
+	}
+	return d, err
+}
+
+func parsePositiveInt(v string) (int, error) {
+	n, err := strconv.Atoi(v)
+	if err == nil && n <= 0 {
+		err = fmt.Errorf("must be positive")
+	}
+	return n, err
+}
+
+// filterByHealth removes the instances failing the health check of the service, all the
+// instances are kept if none of them is healthy. The instances are checked from now on.
+func filterByHealth(svc *v1.Service, instances instanceList) instanceList {
+	key := fmt.Sprintf("%s.%s", svc.Namespace, svc.Name)
+	value, ok := svc.Annotations[HealthCheckAnnotation]
+	if !ok {
+		if v, loaded := checkers.Load(key); loaded {
+			v.(*healthChecker).stop()
+		}
+		return instances
+	}
+	hc, err := parseHealthCheck(value)
+	if err != nil {
+		klog.Errorf("parse health check of svc %s err: %v", key, err)
+		return instances
+	}
+	checker := getChecker(key, hc)
+
+	var healthy instanceList
+	for _, ins := range instances {
+		if checker.touch(instanceAddress(ins)) {
+			healthy = append(healthy, ins)
+		}
+	}
+	if len(healthy) == len(instances) {
+		return instances
+	}
+	if len(healthy) == 0 {
+		klog.Warningf("none of %d instances of svc %s is healthy, health check is skipped", len(instances), key)
+		return instances
+	}
+	klog.V(4).Infof("%d of %d instances of svc %s are unhealthy", len(instances)-len(healthy), len(instances), key)
+	return healthy
+}
+
+// instanceAddress returns an address of the instance, the addresses of all the protocols
+// of an instance are the same
+func instanceAddress(ins *registry.MicroServiceInstance) string {
+	for _, addr := range ins.EndpointsMap {
+		return addr
+	}
+	return ""
+}
+
+// getChecker returns the running checker of the service, it's restarted if the health
+// check of the service changes
+func getChecker(key string, hc healthCheck) *healthChecker {
+	for {
+		if v, ok := checkers.Load(key); ok {
+			checker := v.(*healthChecker)
+			if checker.hc == hc && !checker.stopped() {
+				return checker
+			}
+			checker.stop()
+		}
+		v, loaded := checkers.LoadOrStore(key, newHealthChecker(key, hc))
+		if !loaded {
+			checker := v.(*healthChecker)
+			klog.Infof("start health check of svc %s", key)
+			go checker.run()
+			return checker
+		}
+	}
+}
+
+// targetStatus is the health of an address checked
+type targetStatus struct {
+	healthy     bool
+	consecutive int
+	lastSeen    time.Time
+}
+
+// healthChecker checks the addresses of the instances of a service periodically. The
+// addresses are healthy until they fail the checks, so a new instance is picked at once.
+type healthChecker struct {
+	key     string
+	hc      healthCheck
+	mu      sync.Mutex
+	targets map[string]*targetStatus
+	done    chan struct{}
+	once    sync.Once
+}
+
+func newHealthChecker(key string, hc healthCheck) *healthChecker {
+	return &healthChecker{
+		key:     key,
+		hc:      hc,
+		targets: make(map[string]*targetStatus),
+		done:    make(chan struct{}),
+	}
+}
+
+// touch returns the health of addr, and keeps it checked
+func (c *healthChecker) touch(addr string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t, ok := c.targets[addr]
+	if !ok {
+		t = &targetStatus{healthy: true}
+		c.targets[addr] = t
+	}
+	t.lastSeen = time.Now()
+	return t.healthy
+}
+
+func (c *healthChecker) stop() {
+	c.once.Do(func() {
+		close(c.done)
+		checkers.Delete(c.key)
+		klog.Infof("stop health check of svc %s", c.key)
+	})
+}
+
+func (c *healthChecker) stopped() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *healthChecker) run() {
+	ticker := time.NewTicker(c.hc.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+		var addrs []string
+		now := time.Now()
+		c.mu.Lock()
+		for addr, t := range c.targets {
+			if now.Sub(t.lastSeen) > healthCheckExpireAfter*c.hc.interval {
+				delete(c.targets, addr)
+				continue
+			}
+			addrs = append(addrs, addr)
+		}
+		c.mu.Unlock()
+		if len(addrs) == 0 {
+			c.stop()
+			return
+		}
+
+		var wg sync.WaitGroup
+		for _, addr := range addrs {
+			wg.Add(1)
+			go func(addr string) {
+				defer wg.Done()
+				c.update(addr, c.check(addr))
+			}(addr)
+		}
+		wg.Wait()
+	}
+}
+
+// check checks the health of addr once
+func (c *healthChecker) check(addr string) error {
+	if c.hc.port != 0 {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return err
+		}
+		addr = net.JoinHostPort(host, strconv.Itoa(c.hc.port))
+	}
+	if c.hc.checkType == "tcp" {
+		conn, err := net.DialTimeout("tcp", addr, c.hc.timeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+	client := &http.Client{
+		Timeout:   c.hc.timeout,
+		Transport: &http.Transport{DisableKeepAlives: true},
+		// the redirects are healthy responses
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Get("http://" + addr + c.hc.path)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		return fmt.Errorf("unhealthy status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// update counts the result of a check of addr, and flips its health at the thresholds
+func (c *healthChecker) update(addr string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t, ok := c.targets[addr]
+	if !ok {
+		return
+	}
+	if (err == nil) == t.healthy {
+		t.consecutive = 0
+		return
+	}
+	t.consecutive++
+	switch {
+	case t.healthy && t.consecutive >= c.hc.unhealthyThreshold:
+		t.healthy, t.consecutive = false, 0
+		klog.Warningf("instance %s of svc %s becomes unhealthy: %v", addr, c.key, err)
+	case !t.healthy && t.consecutive >= c.hc.healthyThreshold:
+		t.healthy, t.consecutive = true, 0
+		klog.Infof("instance %s of svc %s becomes healthy", addr, c.key)
+	}
+}
+
+func (c *healthChecker) snapshot() map[string]string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	snapshot := make(map[string]string, len(c.targets))
+	for addr, t := range c.targets {
+		if t.healthy {
+			snapshot[addr] = "healthy"
+		} else {
+			snapshot[addr] = "unhealthy"
+		}
+	}
+	return snapshot
+}
@@ -0,0 +1,64 @@
+package registry
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseHealthCheck(t *testing.T) {
+	hc, err := parseHealthCheck("type=http, path=/healthz, interval=5s, unhealthyThreshold=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hc.checkType != "http" || hc.path != "/healthz" || hc.interval != 5*time.Second ||
+		hc.timeout != defaultHealthCheckTimeout || hc.unhealthyThreshold != 2 {
+		t.Errorf("health check = %+v", hc)
+	}
+	for _, value := range []string{"type=udp", "path=healthz", "interval=0s", "port=0"} {
+		if _, err = parseHealthCheck(value); err == nil {
+			t.Errorf("parse %q should fail", value)
+		}
+	}
+}
+
+func TestHealthChecker(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	hc, _ := parseHealthCheck("type=tcp,unhealthyThreshold=2")
+	c := newHealthChecker("default.nginx", hc)
+	addr := ln.Addr().String()
+	if !c.touch(addr) {
+		t.Fatalf("new instance should be healthy")
+	}
+	if err = c.check(addr); err != nil {
+		t.Errorf("check listening address err: %v", err)
+	}
+
+	c.update(addr, errors.New("refused"))
+	if !c.touch(addr) {
+		t.Errorf("instance is unhealthy before the threshold")
+	}
+	c.update(addr, errors.New("refused"))
+	if c.touch(addr) {
+		t.Errorf("instance is healthy after the threshold")
+	}
+	c.update(addr, nil)
+	if !c.touch(addr) {
+		t.Errorf("instance isn't healthy after a successful check")
+	}
+}
@@ -0,0 +1,121 @@
+package registry
+
+import (
+	"fmt"
+
+	apiv1alpha3 "istio.io/api/networking/v1alpha3"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+
+	"github.com/kubeedge/edgemesh/agent/pkg/chassis/controller"
+)
+
+// labelSubzone is the node label of the subzone, the same as istio
+const labelSubzone = "topology.istio.io/subzone"
+
+// locality priorities, the lower the better
+const (
+	prioritySubzone = iota
+	priorityZone
+	priorityRegion
+	priorityFailover
+	priorityAny
+)
+
+// locality is the topology of a node
+type locality struct {
+	region, zone, subzone string
+}
+
+func (l locality) String() string {
+	return fmt.Sprintf("%s/%s/%s", l.region, l.zone, l.subzone)
+}
+
+// getNodeLocality resolves the locality of a node by its topology labels,
+// the deprecated failure-domain labels are used if the stable ones are missing
+func getNodeLocality(name string) (locality, bool) {
+	if name == "" {
+		return locality{}, false
+	}
+	node, err := controller.APIConn.GetNodeLister().Get(name)
+	if err != nil {
+		klog.V(4).Infof("get node %s err: %v", name, err)
+		return locality{}, false
+	}
+	get := func(stable, deprecated string) string {
+		if value, ok := node.Labels[stable]; ok {
+			return value
+		}
+		return node.Labels[deprecated]
+	}
+	return locality{
+		region:  get(v1.LabelZoneRegionStable, v1.LabelZoneRegion),
+		zone:    get(v1.LabelZoneFailureDomainStable, v1.LabelZoneFailureDomain),
+		subzone: node.Labels[labelSubzone],
+	}, true
+}
+
+// localityPriority returns the priority of the instances in the locality dst
+// for the traffic from the locality src
+func localityPriority(src, dst locality, failover []*apiv1alpha3.LocalityLoadBalancerSetting_Failover) int {
+	if src.region == dst.region {
+		if src.zone == dst.zone {
+			if src.subzone == dst.subzone {
+				return prioritySubzone
+			}
+			return priorityZone
+		}
+		return priorityRegion
+	}
+	for _, f := range failover {
+		if f.From == src.region && f.To == dst.region {
+			return priorityFailover
+		}
+	}
+	return priorityAny
+}
+
+// getLocalityLbSetting returns the locality load balancing setting of the service or its subset if enabled
+func getLocalityLbSetting(namespace, name, subset string) *apiv1alpha3.LocalityLoadBalancerSetting {
+	setting := controller.APIConn.GetTrafficPolicy(namespace, name, subset).GetLoadBalancer().GetLocalityLbSetting()
+	if setting == nil || (setting.Enabled != nil && !setting.Enabled.Value) {
+		return nil
+	}
+	return setting
+}
+
+// filterByLocality keeps the instances with the best locality priority, so the traffic
+// stays in the site unless the site has no instance, then fails over to the next site
+func filterByLocality(svc *v1.Service, subset string, instances instanceList) instanceList {
+	setting := getLocalityLbSetting(svc.Namespace, svc.Name, subset)
+	if setting == nil || len(instances) == 0 {
+		return instances
+	}
+	if len(setting.Distribute) > 0 {
+		klog.Warningf("locality distribute of svc %s.%s is not supported, only priority and failover apply", svc.Namespace, svc.Name)
+	}
+	src, ok := getNodeLocality(nodeName)
+	if !ok || src.region == "" {
+		klog.V(4).Infof("locality of node %s is unknown, locality load balancing is skipped", nodeName)
+		return instances
+	}
+
+	best := priorityAny
+	var selected instanceList
+	for _, ins := range instances {
+		priority := priorityAny
+		if dst, ok := getNodeLocality(ins.Metadata[NodeNameMetadata]); ok {
+			priority = localityPriority(src, dst, setting.Failover)
+		}
+		switch {
+		case priority < best || selected == nil:
+			best = priority
+			selected = instanceList{ins}
+		case priority == best:
+			selected = append(selected, ins)
+		}
+	}
+	klog.V(4).Infof("%d instances of svc %s.%s in priority %d from locality %s",
+		len(selected), svc.Namespace, svc.Name, best, src)
+	return selected
+}
@@ -0,0 +1,271 @@
+package registry
+
+import (
+	"expvar"
+	"fmt"
+	"sync"
+	"time"
+
+	apiv1alpha3 "istio.io/api/networking/v1alpha3"
+	"k8s.io/klog/v2"
+
+	"github.com/kubeedge/edgemesh/agent/pkg/chassis/controller"
+	"github.com/kubeedge/edgemesh/common/util"
+)
+
+const (
+	// defaultConsecutive5xxErrors is the consecutive 5xx errors ejecting an instance if
+	// the outlier detection doesn't specify any consecutive errors
+	defaultConsecutive5xxErrors = 5
+	// defaultOutlierInterval is the default interval between the ejection sweeps
+	defaultOutlierInterval = 10 * time.Second
+	// defaultBaseEjectionTime is the default minimum ejection duration
+	defaultBaseEjectionTime = 30 * time.Second
+	// defaultMaxEjectionPercent is the default max percent of the instances ejected
+	defaultMaxEjectionPercent = 10
+)
+
+// detectors are the outlier detectors by service and subset
+var detectors sync.Map
+
+func init() {
+	expvar.Publish("outlier_ejections", expvar.Func(func() interface{} {
+		snapshot := make(map[string][]string)
+		detectors.Range(func(key, value interface{}) bool {
+			if ejected := value.(*outlierDetector).ejected(); len(ejected) > 0 {
+				snapshot[key.(string)] = ejected
+			}
+			return true
+		})
+		return snapshot
+	}))
+}
+
+// ReportSuccess reports a successful connection or response of the endpoint of the
+// service or its subset to the outlier detection
+func ReportSuccess(namespace, name, subset, endpoint string) {
+	report(namespace, name, subset, endpoint, false, false)
+}
+
+// ReportError reports an error of the endpoint of the service or its subset to the
+// outlier detection, e.g. a failed dial or a 5xx response. gateway indicates a gateway
+// error, i.e. a connection failure, a reset, a timeout or a 502, 503 or 504 response.
+func ReportError(namespace, name, subset, endpoint string, gateway bool) {
+	report(namespace, name, subset, endpoint, true, gateway)
+}
+
+func report(namespace, name, subset, endpoint string, failed, gateway bool) {
+	od := controller.APIConn.GetTrafficPolicy(namespace, name, subset).GetOutlierDetection()
+	if od == nil || endpoint == "" {
+		return
+	}
+	getDetector(outlierKey(namespace, name, subset)).report(newOutlierPolicy(od), endpoint, failed, gateway)
+}
+
+// filterByOutlier removes the instances ejected by the outlier detection of the service
+// or its subset, all the instances are kept if there are too few healthy ones
+func filterByOutlier(namespace, name, subset string, instances instanceList) instanceList {
+	od := controller.APIConn.GetTrafficPolicy(namespace, name, subset).GetOutlierDetection()
+	if od == nil || len(instances) == 0 {
+		return instances
+	}
+	return getDetector(outlierKey(namespace, name, subset)).filter(newOutlierPolicy(od), instances)
+}
+
+func outlierKey(namespace, name, subset string) string {
+	key := fmt.Sprintf("%s.%s", namespace, name)
+	if subset != "" {
+		key += "|" + subset
+	}
+	return key
+}
+
+func getDetector(key string) *outlierDetector {
+	v, _ := detectors.LoadOrStore(key, &outlierDetector{key: key, hosts: make(map[string]*hostStatus)})
+	return v.(*outlierDetector)
+}
+
+// outlierPolicy is the outlier detection of a destination rule with the defaults applied
+type outlierPolicy struct {
+	// consecutive5xx and consecutiveGateway are the consecutive errors ejecting an
+	// instance, 0 disables the kind of errors
+	consecutive5xx     int
+	consecutiveGateway int
+	interval           time.Duration
+	baseEjectionTime   time.Duration
+	maxEjectionPercent int
+	minHealthPercent   int
+}
+
+func newOutlierPolicy(od *apiv1alpha3.OutlierDetection) outlierPolicy {
+	policy := outlierPolicy{
+		consecutive5xx:     defaultConsecutive5xxErrors,
+		consecutiveGateway: int(od.GetConsecutiveGatewayErrors().GetValue()),
+		interval:           util.ProtoDuration(od.GetInterval()),
+		baseEjectionTime:   util.ProtoDuration(od.GetBaseEjectionTime()),
+		maxEjectionPercent: int(od.GetMaxEjectionPercent()),
+		minHealthPercent:   int(od.GetMinHealthPercent()),
+	}
+	if v := od.GetConsecutive_5XxErrors(); v != nil {
+		policy.consecutive5xx = int(v.GetValue())
+	} else if n := od.GetConsecutiveErrors(); n > 0 {
+		policy.consecutive5xx = int(n)
+	}
+	if policy.interval <= 0 {
+		policy.interval = defaultOutlierInterval
+	}
+	if policy.baseEjectionTime <= 0 {
+		policy.baseEjectionTime = defaultBaseEjectionTime
+	}
+	if policy.maxEjectionPercent <= 0 {
+		policy.maxEjectionPercent = defaultMaxEjectionPercent
+	}
+	return policy
+}
+
+// hostStatus is the outlier status of an endpoint
+type hostStatus struct {
+	consecutive5xx     int
+	consecutiveGateway int
+	ejectedAt          time.Time
+	// ejections is the multiplier of the base ejection time, it increases on each
+	// ejection and decreases on each sweep the endpoint isn't ejected
+	ejections int
+	ejected   bool
+}
+
+// outlierDetector ejects the endpoints with consecutive errors of a service or subset.
+// An endpoint is ejected for baseEjectionTime multiplied by the times it's ejected, and
+// is brought back by the sweep every interval, which runs lazily on the reports and
+// the lookups of the instances.
+type outlierDetector struct {
+	key       string
+	mu        sync.Mutex
+	hosts     map[string]*hostStatus
+	total     int
+	lastSweep time.Time
+}
+
+func (d *outlierDetector) report(policy outlierPolicy, endpoint string, failed, gateway bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.sweep(policy, time.Now())
+	h, ok := d.hosts[endpoint]
+	if !ok {
+		h = &hostStatus{}
+		d.hosts[endpoint] = h
+	}
+	if !failed {
+		h.consecutive5xx, h.consecutiveGateway = 0, 0
+		return
+	}
+	h.consecutive5xx++
+	if gateway {
+		h.consecutiveGateway++
+	} else {
+		h.consecutiveGateway = 0
+	}
+	if h.ejected {
+		return
+	}
+	reason := ""
+	switch {
+	case policy.consecutive5xx > 0 && h.consecutive5xx >= policy.consecutive5xx:
+		reason = fmt.Sprintf("%d consecutive 5xx errors", h.consecutive5xx)
+	case policy.consecutiveGateway > 0 && h.consecutiveGateway >= policy.consecutiveGateway:
+		reason = fmt.Sprintf("%d consecutive gateway errors", h.consecutiveGateway)
+	default:
+		return
+	}
+	total := d.total
+	if total < len(d.hosts) {
+		total = len(d.hosts)
+	}
+	if ejected := d.countEjected(); ejected*100 >= policy.maxEjectionPercent*total {
+		klog.Warningf("outlier %s of %s has %s, but %d of %d instances are ejected already",
+			endpoint, d.key, reason, ejected, total)
+		return
+	}
+	h.ejected = true
+	h.ejectedAt = time.Now()
+	h.ejections++
+	h.consecutive5xx, h.consecutiveGateway = 0, 0
+	klog.Warningf("outlier %s of %s is ejected for %v, it has %s",
+		endpoint, d.key, policy.baseEjectionTime*time.Duration(h.ejections), reason)
+}
+
+// sweep brings back the endpoints whose ejection time is over, it runs every interval
+func (d *outlierDetector) sweep(policy outlierPolicy, now time.Time) {
+	if now.Sub(d.lastSweep) < policy.interval {
+		return
+	}
+	d.lastSweep = now
+	for endpoint, h := range d.hosts {
+		switch {
+		case h.ejected && now.Sub(h.ejectedAt) >= policy.baseEjectionTime*time.Duration(h.ejections):
+			h.ejected = false
+			klog.Infof("outlier %s of %s is brought back after %v", endpoint, d.key, now.Sub(h.ejectedAt))
+		case !h.ejected && h.ejections > 0:
+			h.ejections--
+		case !h.ejected && h.consecutive5xx == 0 && h.consecutiveGateway == 0:
+			// forget the healthy endpoints, they may be gone
+			delete(d.hosts, endpoint)
+		}
+	}
+}
+
+func (d *outlierDetector) countEjected() int {
+	n := 0
+	for _, h := range d.hosts {
+		if h.ejected {
+			n++
+		}
+	}
+	return n
+}
+
+func (d *outlierDetector) filter(policy outlierPolicy, instances instanceList) instanceList {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.sweep(policy, time.Now())
+	d.total = len(instances)
+	var healthy instanceList
+	for _, ins := range instances {
+		if !d.isEjected(ins.EndpointsMap) {
+			healthy = append(healthy, ins)
+		}
+	}
+	if len(healthy) == len(instances) {
+		return instances
+	}
+	if len(healthy) == 0 || len(healthy)*100 < policy.minHealthPercent*len(instances) {
+		klog.Warningf("%d of %d instances of %s are healthy, outlier detection is skipped",
+			len(healthy), len(instances), d.key)
+		return instances
+	}
+	klog.V(4).Infof("%d of %d instances of %s are ejected", len(instances)-len(healthy), len(instances), d.key)
+	return healthy
+}
+
+// isEjected returns true if any endpoint of an instance is ejected
+func (d *outlierDetector) isEjected(endpoints map[string]string) bool {
+	for _, ep := range endpoints {
+		if h, ok := d.hosts[ep]; ok && h.ejected {
+			return true
+		}
+	}
+	return false
+}
+
+// ejected returns the ejected endpoints
+func (d *outlierDetector) ejected() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var endpoints []string
+	for endpoint, h := range d.hosts {
+		if h.ejected {
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+	return endpoints
+}
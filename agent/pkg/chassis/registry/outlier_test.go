@@ -0,0 +1,44 @@
+package registry
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-chassis/go-chassis/core/registry"
+	apiv1alpha3 "istio.io/api/networking/v1alpha3"
+)
+
+func TestOutlierDetector(t *testing.T) {
+	policy := newOutlierPolicy(&apiv1alpha3.OutlierDetection{ConsecutiveErrors: 2, MaxEjectionPercent: 50})
+	a := &registry.MicroServiceInstance{InstanceID: "a", EndpointsMap: endpointsMap("tcp", "10.0.0.1:80")}
+	b := &registry.MicroServiceInstance{InstanceID: "b", EndpointsMap: endpointsMap("tcp", "10.0.0.2:80")}
+	instances := instanceList{a, b}
+	d := getDetector("default.nginx")
+	d.filter(policy, instances)
+
+	d.report(policy, "10.0.0.1:80", true, true)
+	if got := d.filter(policy, instances); len(got) != 2 {
+		t.Fatalf("instance is ejected before consecutive errors")
+	}
+	d.report(policy, "10.0.0.1:80", true, false)
+	if got := d.filter(policy, instances); len(got) != 1 || got[0] != b {
+		t.Fatalf("instance with consecutive errors isn't ejected")
+	}
+	// max ejection percent keeps the other instance
+	d.report(policy, "10.0.0.2:80", true, true)
+	d.report(policy, "10.0.0.2:80", true, true)
+	if got := d.filter(policy, instances); len(got) != 1 || got[0] != b {
+		t.Fatalf("max ejection percent is exceeded")
+	}
+
+	// brought back by the sweep after the base ejection time
+	d.mu.Lock()
+	d.sweep(policy, time.Now().Add(policy.baseEjectionTime))
+	d.mu.Unlock()
+	if got := d.filter(policy, instances); len(got) != 2 {
+		t.Fatalf("ejected instance isn't brought back")
+	}
+	if got := d.ejected(); len(got) != 0 {
+		t.Errorf("ejected endpoints = %v, want none", got)
+	}
+}
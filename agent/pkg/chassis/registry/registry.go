@@ -18,8 +18,16 @@ import (
 const (
 	// EdgeRegistry constants string
 	EdgeRegistry = "edge"
+	// ExternalConsumerID is the consumer id of the invocations from outside the cluster,
+	// the externalTrafficPolicy of the service applies to them
+	ExternalConsumerID = "external"
+	// NodeNameMetadata is the instance metadata key of the node the instance runs on
+	NodeNameMetadata = "nodeName"
 )
 
+// nodeName is the node edgemesh runs on
+var nodeName = util.GetNodeName()
+
 type instanceList []*registry.MicroServiceInstance
 
 func (I instanceList) Len() int {
@@ -86,23 +94,27 @@ func (esd *EdgeServiceDiscovery) FindMicroServiceInstances(consumerID, microServ
 	if len(pods) == 0 {
 		return nil, fmt.Errorf("pod list is empty")
 	}
+	// narrow the pods by the subset, e.g. v1 or v2 routed by a virtual service
+	pods, err = filterBySubset(svc, pods, tags)
+	if err != nil {
+		return nil, err
+	}
 
-	// get targetPort and Protocol from Service
-	targetPort, proto := getPortAndProtocol(svc, svcPort)
+	// get service port and Protocol from Service
+	servicePort, proto := getPortAndProtocol(svc, svcPort)
 	// port not found
-	if targetPort == 0 {
+	if servicePort == nil {
 		klog.Errorf("port %d not found in svc: %s.%s", svcPort, namespace, name)
 		return nil, fmt.Errorf("port %d not found in svc: %s.%s", svcPort, namespace, name)
 	}
-	if proto == "http" {
-		proto = "rest"
-	}
-
 	// gen
 	var microServiceInstances instanceList
 	var hostPort int32
 	// all pods share the same host port, get from pods[0]
-	if pods[0].Spec.HostNetwork {
+	targetPort, err := util.FindPort(pods[0], servicePort)
+	if err != nil {
+		klog.Warningf("find target port of svc %s.%s in pod %s err: %v", namespace, name, pods[0].Name, err)
+	} else if pods[0].Spec.HostNetwork {
 		// host network
 		hostPort = int32(targetPort)
 	} else {
@@ -117,14 +129,31 @@ func (esd *EdgeServiceDiscovery) FindMicroServiceInstances(consumerID, microServ
 	}
 	// set targetPort from endpoints if hostPort == 0 still
 	if hostPort == 0 {
+		var subsetPods map[string]bool
+		if tags.KV[SubsetTag] != "" {
+			subsetPods = podNames(pods)
+		}
 		for _, a := range eps.Subsets {
 			for _, port := range a.Ports {
-				if port.Port != 0 {
+				// endpoints ports are named after the service ports they belong to
+				if port.Port == 0 || port.Name != servicePort.Name {
+					continue
+				}
+				for _, addr := range a.Addresses {
+					// endpoints of the pods out of the subset
+					if subsetPods != nil && (addr.TargetRef == nil || !subsetPods[addr.TargetRef.Name]) {
+						continue
+					}
+					var node string
+					if addr.NodeName != nil {
+						node = *addr.NodeName
+					}
 					microServiceInstances = append(microServiceInstances, &registry.MicroServiceInstance{
-						InstanceID:   fmt.Sprintf("%s.%s|%s.%d", namespace, name, a.Addresses[0].IP, port.Port),
-						ServiceID:    fmt.Sprintf("%s#%s#%s", namespace, name, a.Addresses[0].IP),
+						InstanceID:   fmt.Sprintf("%s.%s|%s.%d", namespace, name, addr.IP, port.Port),
+						ServiceID:    fmt.Sprintf("%s#%s#%s", namespace, name, addr.IP),
 						HostName:     "",
-						EndpointsMap: map[string]string{proto: fmt.Sprintf("%s:%d", a.Addresses[0].IP, port.Port)},
+						EndpointsMap: endpointsMap(proto, fmt.Sprintf("%s:%d", addr.IP, port.Port)),
+						Metadata:     map[string]string{NodeNameMetadata: node},
 					})
 				}
 			}
@@ -137,18 +166,73 @@ func (esd *EdgeServiceDiscovery) FindMicroServiceInstances(consumerID, microServ
 					InstanceID:   fmt.Sprintf("%s.%s|%s.%d", namespace, name, p.Status.HostIP, hostPort),
 					ServiceID:    fmt.Sprintf("%s#%s#%s", namespace, name, p.Status.HostIP),
 					HostName:     "",
-					EndpointsMap: map[string]string{proto: fmt.Sprintf("%s:%d", p.Status.HostIP, hostPort)},
+					EndpointsMap: endpointsMap(proto, fmt.Sprintf("%s:%d", p.Status.HostIP, hostPort)),
+					Metadata:     map[string]string{NodeNameMetadata: p.Spec.NodeName},
 				})
 			}
 		}
 	}
 
+	microServiceInstances, err = filterInstances(svc, tags.KV[SubsetTag], microServiceInstances, consumerID == ExternalConsumerID)
+	if err != nil {
+		return nil, err
+	}
+
 	// Why do we need to sort microServiceInstances?
 	// That's because the pod list obtained by the PodLister is out of order.
 	sort.Sort(microServiceInstances)
 	return microServiceInstances, nil
 }
 
+// filterInstances filters the instances of the service or its subset. The unhealthy and
+// ejected instances are removed first, so the traffic policy and the locality choose
+// among the healthy ones, e.g. the traffic fails over to the remote or next locality
+// instances if the local ones are failing.
+func filterInstances(svc *v1.Service, subset string, instances instanceList, external bool) (instanceList, error) {
+	instances = filterByHealth(svc, instances)
+	instances = filterByOutlier(svc.Namespace, svc.Name, subset, instances)
+	instances, err := filterByTrafficPolicy(svc, instances, external)
+	if err != nil {
+		return nil, err
+	}
+	return filterByLocality(svc, subset, instances), nil
+}
+
+// getTrafficPolicy returns the traffic policy of the service, externalTrafficPolicy
+// Local applies to the external traffic, the annotation applies to all the traffic in
+// place of internalTrafficPolicy, which the vendored kubernetes api doesn't have
+func getTrafficPolicy(svc *v1.Service, external bool) string {
+	if external && svc.Spec.ExternalTrafficPolicy == v1.ServiceExternalTrafficPolicyTypeLocal {
+		return util.TrafficPolicyLocal
+	}
+	return svc.Annotations[util.TrafficPolicyAnnotation]
+}
+
+// filterByTrafficPolicy keeps the instances on this node if the service asks for it
+func filterByTrafficPolicy(svc *v1.Service, instances instanceList, external bool) (instanceList, error) {
+	policy := getTrafficPolicy(svc, external)
+	if policy != util.TrafficPolicyLocal && policy != util.TrafficPolicyPreferLocal {
+		if policy != "" {
+			klog.Warningf("unsupported traffic policy %s of svc %s.%s", policy, svc.Namespace, svc.Name)
+		}
+		return instances, nil
+	}
+	var local instanceList
+	for _, ins := range instances {
+		if ins.Metadata[NodeNameMetadata] == nodeName {
+			local = append(local, ins)
+		}
+	}
+	if len(local) > 0 {
+		return local, nil
+	}
+	if policy == util.TrafficPolicyLocal {
+		return nil, fmt.Errorf("no local endpoints of svc %s.%s on node %s", svc.Namespace, svc.Name, nodeName)
+	}
+	klog.V(4).Infof("no local endpoints of svc %s.%s on node %s, fall back to remote ones", svc.Namespace, svc.Name, nodeName)
+	return instances, nil
+}
+
 // GetMicroServiceID get microServiceID
 func (esd *EdgeServiceDiscovery) GetMicroServiceID(appID, microServiceName, version, env string) (string, error) {
 	return "", nil
@@ -193,13 +277,27 @@ func parseServiceURL(serviceURL string) (string, string, int, error) {
 	return name, namespace, port, nil
 }
 
-func getPortAndProtocol(svc *v1.Service, svcPort int) (targetPort int, protocol string) {
-	for _, p := range svc.Spec.Ports {
-		if p.Protocol == "TCP" && int(p.Port) == svcPort {
-			protocol = strings.Split(p.Name, "-")[0]
-			targetPort = p.TargetPort.IntValue()
-			break
+// getPortAndProtocol finds the service port by the exact port number and resolves its protocol
+func getPortAndProtocol(svc *v1.Service, svcPort int) (*v1.ServicePort, string) {
+	for i := range svc.Spec.Ports {
+		p := &svc.Spec.Ports[i]
+		if p.Protocol == v1.ProtocolTCP && int(p.Port) == svcPort {
+			return p, util.GetServicePortProtocol(svc, p)
 		}
 	}
-	return targetPort, protocol
+	return nil, ""
+}
+
+// endpointsMap returns the endpoints of an instance keyed by go-chassis protocol. The
+// protocol of a port without a declared protocol is sniffed by edgeproxy, so it may be
+// served as either rest or tcp.
+func endpointsMap(proto, addr string) map[string]string {
+	switch proto {
+	case "http":
+		return map[string]string{"rest": addr}
+	case "tcp":
+		return map[string]string{"tcp": addr}
+	default:
+		return map[string]string{"rest": addr, "tcp": addr}
+	}
 }
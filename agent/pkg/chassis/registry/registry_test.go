@@ -0,0 +1,120 @@
+package registry
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/go-chassis/go-chassis/core/registry"
+	"github.com/kubeedge/kubeedge/pkg/apis/componentconfig/cloudcore/v1alpha1"
+	apiv1alpha3 "istio.io/api/networking/v1alpha3"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/kubeedge/edgemesh/agent/pkg/chassis/controller"
+	"github.com/kubeedge/edgemesh/common/informers"
+	"github.com/kubeedge/edgemesh/common/util"
+)
+
+func TestFilterByTrafficPolicy(t *testing.T) {
+	nodeName = "edge-a"
+	local := &registry.MicroServiceInstance{InstanceID: "local", Metadata: map[string]string{NodeNameMetadata: "edge-a"}}
+	remote := &registry.MicroServiceInstance{InstanceID: "remote", Metadata: map[string]string{NodeNameMetadata: "edge-b"}}
+
+	cases := []struct {
+		name       string
+		annotation string
+		external   bool
+		etp        v1.ServiceExternalTrafficPolicyType
+		instances  instanceList
+		want       []string
+		wantErr    bool
+	}{
+		{name: "no policy", instances: instanceList{local, remote}, want: []string{"local", "remote"}},
+		{name: "local", annotation: util.TrafficPolicyLocal, instances: instanceList{local, remote}, want: []string{"local"}},
+		{name: "local without local endpoints", annotation: util.TrafficPolicyLocal, instances: instanceList{remote}, wantErr: true},
+		{name: "prefer local", annotation: util.TrafficPolicyPreferLocal, instances: instanceList{local, remote}, want: []string{"local"}},
+		{name: "prefer local falls back", annotation: util.TrafficPolicyPreferLocal, instances: instanceList{remote}, want: []string{"remote"}},
+		{name: "external local", external: true, etp: v1.ServiceExternalTrafficPolicyTypeLocal, instances: instanceList{local, remote}, want: []string{"local"}},
+		{name: "external local ignored by internal traffic", etp: v1.ServiceExternalTrafficPolicyTypeLocal, instances: instanceList{local, remote}, want: []string{"local", "remote"}},
+	}
+	for _, c := range cases {
+		svc := &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "nginx", Namespace: "default", Annotations: map[string]string{}},
+			Spec:       v1.ServiceSpec{ExternalTrafficPolicy: c.etp},
+		}
+		if c.annotation != "" {
+			svc.Annotations[util.TrafficPolicyAnnotation] = c.annotation
+		}
+		got, err := filterByTrafficPolicy(svc, c.instances, c.external)
+		if (err != nil) != c.wantErr {
+			t.Errorf("%s: err = %v, wantErr %v", c.name, err, c.wantErr)
+			continue
+		}
+		if len(got) != len(c.want) {
+			t.Errorf("%s: got %d instances, want %v", c.name, len(got), c.want)
+			continue
+		}
+		for i := range got {
+			if got[i].InstanceID != c.want[i] {
+				t.Errorf("%s: got instance %s, want %s", c.name, got[i].InstanceID, c.want[i])
+			}
+		}
+	}
+}
+
+func TestFilterInstancesPreferLocalHealthy(t *testing.T) {
+	// the informers aren't started, so there's no destination rule or node
+	ifm, err := informers.NewManager(&v1alpha1.KubeAPIConfig{Master: "http://127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	controller.Init(ifm)
+
+	nodeName = "edge-a"
+	local := &registry.MicroServiceInstance{InstanceID: "local", EndpointsMap: endpointsMap("tcp", "10.0.0.1:80"),
+		Metadata: map[string]string{NodeNameMetadata: "edge-a"}}
+	remote := &registry.MicroServiceInstance{InstanceID: "remote", EndpointsMap: endpointsMap("tcp", "10.0.0.2:80"),
+		Metadata: map[string]string{NodeNameMetadata: "edge-b"}}
+	svc := &v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "nginx", Namespace: "default", Annotations: map[string]string{
+		util.TrafficPolicyAnnotation: util.TrafficPolicyPreferLocal,
+		HealthCheckAnnotation:        "type=tcp,unhealthyThreshold=1",
+	}}}
+	instances := instanceList{local, remote}
+
+	got, err := filterInstances(svc, "", instances, false)
+	if err != nil || len(got) != 1 || got[0] != local {
+		t.Fatalf("healthy local instance isn't preferred: %v, %v", got, err)
+	}
+	v, ok := checkers.Load("default.nginx")
+	if !ok {
+		t.Fatalf("health checker isn't started")
+	}
+	checker := v.(*healthChecker)
+	defer checker.stop()
+	checker.update("10.0.0.1:80", errors.New("refused"))
+
+	got, err = filterInstances(svc, "", instances, false)
+	if err != nil || len(got) != 1 || got[0] != remote {
+		t.Errorf("unhealthy local instance doesn't fall back to the healthy remote one: %v, %v", got, err)
+	}
+}
+
+func TestLocalityPriority(t *testing.T) {
+	src := locality{region: "cn-east", zone: "hangzhou", subzone: "site-1"}
+	failover := []*apiv1alpha3.LocalityLoadBalancerSetting_Failover{{From: "cn-east", To: "cn-north"}}
+	cases := []struct {
+		dst  locality
+		want int
+	}{
+		{locality{region: "cn-east", zone: "hangzhou", subzone: "site-1"}, prioritySubzone},
+		{locality{region: "cn-east", zone: "hangzhou", subzone: "site-2"}, priorityZone},
+		{locality{region: "cn-east", zone: "shanghai"}, priorityRegion},
+		{locality{region: "cn-north", zone: "beijing"}, priorityFailover},
+		{locality{region: "cn-south", zone: "shenzhen"}, priorityAny},
+	}
+	for _, c := range cases {
+		if got := localityPriority(src, c.dst, failover); got != c.want {
+			t.Errorf("priority from %s to %s = %d, want %d", src, c.dst, got, c.want)
+		}
+	}
+}
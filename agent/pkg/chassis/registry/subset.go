@@ -0,0 +1,58 @@
+package registry
+
+import (
+	"fmt"
+
+	utiltags "github.com/go-chassis/go-chassis/pkg/util/tags"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+
+	"github.com/kubeedge/edgemesh/agent/pkg/chassis/controller"
+)
+
+// SubsetTag is the route tag key of the destination rule subset an invocation is routed to
+const SubsetTag = "subset"
+
+// SubsetTags returns the route tags of an invocation routed to the subset, the tags are
+// empty if subset is empty, so the invocation goes to all the instances of the service
+func SubsetTags(subset string) utiltags.Tags {
+	if subset == "" {
+		return utiltags.Tags{}
+	}
+	return utiltags.Tags{
+		KV:    map[string]string{SubsetTag: subset},
+		Label: SubsetTag + ":" + subset,
+	}
+}
+
+// filterBySubset keeps the pods matching the labels of the subset in the route tags
+func filterBySubset(svc *v1.Service, pods []*v1.Pod, tags utiltags.Tags) ([]*v1.Pod, error) {
+	subsetName := tags.KV[SubsetTag]
+	if subsetName == "" {
+		return pods, nil
+	}
+	subset, err := controller.APIConn.GetSubset(svc.Namespace, svc.Name, subsetName)
+	if err != nil {
+		return nil, err
+	}
+	selector := labels.SelectorFromSet(subset.Labels)
+	var selected []*v1.Pod
+	for _, p := range pods {
+		if selector.Matches(labels.Set(p.Labels)) {
+			selected = append(selected, p)
+		}
+	}
+	if len(selected) == 0 {
+		return nil, fmt.Errorf("no pods of subset %s of svc %s.%s", subsetName, svc.Namespace, svc.Name)
+	}
+	return selected, nil
+}
+
+// podNames returns the names of the pods
+func podNames(pods []*v1.Pod) map[string]bool {
+	names := make(map[string]bool, len(pods))
+	for _, p := range pods {
+		names[p.Name] = true
+	}
+	return names
+}
@@ -13,6 +13,7 @@ import (
 
 	beehiveContext "github.com/kubeedge/beehive/pkg/core/context"
 	"github.com/kubeedge/edgemesh/agent/pkg/dns/controller"
+	"github.com/kubeedge/edgemesh/agent/pkg/handoff"
 	"github.com/kubeedge/edgemesh/common/util"
 )
 
@@ -29,6 +30,11 @@ func (dns *EdgeDNS) Run() {
 			select {
 			case <-ticker.C:
 				dns.ensureResolvForHost()
+			case <-handoff.Done():
+				// the new agent serves dns and keeps /etc/resolv.conf from now on
+				handoff.Unregister(handoff.DNSListener)
+				dns.DNSConn.Close()
+				return
 			case <-beehiveContext.Done():
 				dns.cleanResolvForHost()
 				return
@@ -40,6 +46,10 @@ func (dns *EdgeDNS) Run() {
 	for {
 		req := make([]byte, bufSize)
 		n, from, err := dns.DNSConn.ReadFromUDP(req)
+		if err != nil && util.IsClosedNetworkError(err) {
+			klog.Infof("edgedns stops serving")
+			return
+		}
 		if err != nil || n <= 0 {
 			klog.Errorf("dns server read from udp error: %v", err)
 			continue
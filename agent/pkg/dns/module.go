@@ -4,9 +4,12 @@ import (
 	"fmt"
 	"net"
 
+	"k8s.io/klog/v2"
+
 	"github.com/kubeedge/beehive/pkg/core"
 	"github.com/kubeedge/edgemesh/agent/pkg/dns/config"
 	"github.com/kubeedge/edgemesh/agent/pkg/dns/controller"
+	"github.com/kubeedge/edgemesh/agent/pkg/handoff"
 	"github.com/kubeedge/edgemesh/common/informers"
 	"github.com/kubeedge/edgemesh/common/modules"
 	"github.com/kubeedge/edgemesh/common/util"
@@ -38,10 +41,22 @@ func newEdgeDNS(c *config.EdgeDNSConfig, ifm *informers.Manager) (dns *EdgeDNS,
 		IP:   dns.ListenIP,
 		Port: dns.Config.ListenPort,
 	}
-	dns.DNSConn, err = net.ListenUDP("udp", laddr)
-	if err != nil {
-		return dns, fmt.Errorf("dns server listen on %v error: %v", laddr, err)
+	// the socket of the previous agent is preferred
+	if conn, ok := handoff.PacketConn(handoff.DNSListener); ok {
+		if conn.LocalAddr().String() == laddr.String() {
+			dns.DNSConn = conn
+		} else {
+			klog.Warningf("inherited dns socket on %s mismatches %s, drop it", conn.LocalAddr(), laddr)
+			conn.Close()
+		}
+	}
+	if dns.DNSConn == nil {
+		dns.DNSConn, err = net.ListenUDP("udp", laddr)
+		if err != nil {
+			return dns, fmt.Errorf("dns server listen on %v error: %v", laddr, err)
+		}
 	}
+	handoff.Register(handoff.DNSListener, dns.DNSConn)
 
 	return dns, nil
 }
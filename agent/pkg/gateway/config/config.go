@@ -17,13 +17,18 @@ type EdgeGatewayConfig struct {
 	// empty or "*" stands for not exclude any ip. You can also specify ips such as "192.168.1.56,10.3.2.1"
 	// default ""
 	ExcludeIP string `json:"excludeIP,omitempty"`
+	// DrainPeriod indicates how long a gateway server waits for the in-flight connections
+	// to finish when it's stopped before closing them, the unit is second.
+	// default 10
+	DrainPeriod int `json:"drainPeriod,omitempty"`
 }
 
 func NewEdgeGatewayConfig() *EdgeGatewayConfig {
 	return &EdgeGatewayConfig{
-		Enable:    true,
-		NIC:       "*",
-		IncludeIP: "*",
-		ExcludeIP: "*",
+		Enable:      true,
+		NIC:         "*",
+		IncludeIP:   "*",
+		ExcludeIP:   "*",
+		DrainPeriod: 10,
 	}
 }
@@ -3,12 +3,14 @@ package controller
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"fmt"
 	"net"
-	"os"
 	"reflect"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
 
 	apiv1alpha3 "istio.io/api/networking/v1alpha3"
 	istioapi "istio.io/client-go/pkg/apis/networking/v1alpha3"
@@ -20,10 +22,9 @@ import (
 	"k8s.io/klog/v2"
 
 	"github.com/kubeedge/edgemesh/agent/pkg/chassis/protocol"
-	"github.com/kubeedge/edgemesh/agent/pkg/chassis/protocol/http"
-	"github.com/kubeedge/edgemesh/agent/pkg/chassis/protocol/tcp"
 	"github.com/kubeedge/edgemesh/agent/pkg/gateway/config"
 	"github.com/kubeedge/edgemesh/agent/pkg/gateway/util"
+	"github.com/kubeedge/edgemesh/agent/pkg/handoff"
 	"github.com/kubeedge/edgemesh/common/informers"
 )
 
@@ -52,6 +53,11 @@ func Init(ifm *informers.Manager, cfg *config.EdgeGatewayConfig) {
 	})
 }
 
+// Shutdown stops all the gateway servers gracefully
+func (c *GatewayController) Shutdown() {
+	c.gwManager.Shutdown()
+}
+
 func (c *GatewayController) onCacheSynced() {
 	// set informers event handler
 	c.gwInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
@@ -150,12 +156,15 @@ func transformTLSCipherSuites(istioCipherSuites []string) (cipherSuites []uint16
 // Manager is gateway manager
 type Manager struct {
 	ipArray          []net.IP
+	drainPeriod      time.Duration
 	lock             sync.Mutex
+	shutdown         bool
 	serversByGateway map[string][]*Server // gatewayNamespace.gatewayName --> servers
 }
 
 func NewGatewayManager(c *config.EdgeGatewayConfig) *Manager {
 	mgr := &Manager{
+		drainPeriod:      time.Duration(c.DrainPeriod) * time.Second,
 		serversByGateway: make(map[string][]*Server),
 	}
 	klog.V(4).Infof("start get ips which need listen...")
@@ -170,20 +179,27 @@ func NewGatewayManager(c *config.EdgeGatewayConfig) *Manager {
 
 // AddGateway add a gateway server
 func (mgr *Manager) AddGateway(gw *istioapi.Gateway) {
+	mgr.lock.Lock()
+	defer mgr.lock.Unlock()
+
 	if gw == nil {
 		klog.Errorf("gateway is nil")
 		return
 	}
+	if mgr.shutdown {
+		return
+	}
 	key := fmt.Sprintf("%s.%s", gw.Namespace, gw.Name)
 	var gatewayServers []*Server
 	for _, ip := range mgr.ipArray {
 		for _, s := range gw.Spec.Servers {
 			opts := &ServerOptions{
-				Exposed:   true,
-				GwName:    gw.Name,
-				Namespace: gw.Namespace,
-				Hosts:     s.Hosts,
-				Protocol:  s.Port.Protocol,
+				Exposed:     true,
+				GwName:      gw.Name,
+				Namespace:   gw.Namespace,
+				Hosts:       s.Hosts,
+				Protocol:    s.Port.Protocol,
+				DrainPeriod: mgr.drainPeriod,
 			}
 			if s.Tls != nil && s.Tls.CredentialName != "" {
 				opts.CredentialName = s.Tls.CredentialName
@@ -194,19 +210,13 @@ func (mgr *Manager) AddGateway(gw *istioapi.Gateway) {
 			gatewayServer, err := NewServer(ip, int(s.Port.Number), opts)
 			if err != nil {
 				klog.Warningf("new gateway server on port %d error: %v", int(s.Port.Number), err)
-				if strings.Contains(err.Error(), "address already in use") {
-					klog.Errorf("new gateway server on port %d error: %v. please wait, maybe old pod is deleting.", int(s.Port.Number), err)
-					os.Exit(1)
-				}
 				continue
 			}
 			gatewayServers = append(gatewayServers, gatewayServer)
 		}
 	}
 
-	mgr.lock.Lock()
 	mgr.serversByGateway[key] = gatewayServers
-	mgr.lock.Unlock()
 }
 
 // UpdateGateway update a gateway server
@@ -218,6 +228,9 @@ func (mgr *Manager) UpdateGateway(gw *istioapi.Gateway) {
 		klog.Errorf("gateway is nil")
 		return
 	}
+	if mgr.shutdown {
+		return
+	}
 	// shutdown old servers
 	key := fmt.Sprintf("%s.%s", gw.Namespace, gw.Name)
 	if oldGatewayServers, ok := mgr.serversByGateway[key]; ok {
@@ -233,11 +246,12 @@ func (mgr *Manager) UpdateGateway(gw *istioapi.Gateway) {
 	for _, ip := range mgr.ipArray {
 		for _, s := range gw.Spec.Servers {
 			opts := &ServerOptions{
-				Exposed:   true,
-				GwName:    gw.Name,
-				Namespace: gw.Namespace,
-				Hosts:     s.Hosts,
-				Protocol:  s.Port.Protocol,
+				Exposed:     true,
+				GwName:      gw.Name,
+				Namespace:   gw.Namespace,
+				Hosts:       s.Hosts,
+				Protocol:    s.Port.Protocol,
+				DrainPeriod: mgr.drainPeriod,
 			}
 			if s.Tls != nil && s.Tls.CredentialName != "" {
 				opts.CredentialName = s.Tls.CredentialName
@@ -248,10 +262,6 @@ func (mgr *Manager) UpdateGateway(gw *istioapi.Gateway) {
 			gatewayServer, err := NewServer(ip, int(s.Port.Number), opts)
 			if err != nil {
 				klog.Warningf("new gateway server on port %d error: %v", int(s.Port.Number), err)
-				if strings.Contains(err.Error(), "address already in use") {
-					klog.Errorf("new gateway server on port %d error: %v. please wait, maybe old pod is deleting.", int(s.Port.Number), err)
-					os.Exit(1)
-				}
 				continue
 			}
 			newGatewayServers = append(newGatewayServers, gatewayServer)
@@ -278,14 +288,41 @@ func (mgr *Manager) DeleteGateway(gw *istioapi.Gateway) {
 	delete(mgr.serversByGateway, key)
 }
 
+// Shutdown stops all the gateway servers and drains their connections,
+// no server is started after it
+func (mgr *Manager) Shutdown() {
+	mgr.lock.Lock()
+	defer mgr.lock.Unlock()
+
+	mgr.shutdown = true
+	var wg sync.WaitGroup
+	for key, gatewayServers := range mgr.serversByGateway {
+		for _, gatewayServer := range gatewayServers {
+			wg.Add(1)
+			go func(srv *Server) {
+				defer wg.Done()
+				srv.Stop()
+			}(gatewayServer)
+		}
+		delete(mgr.serversByGateway, key)
+	}
+	wg.Wait()
+}
+
 // Server is gateway server
 type Server struct {
+	addr     string
+	lock     sync.Mutex
 	listener *net.TCPListener
 	stop     chan interface{}
 	wg       sync.WaitGroup
+	tracker  *protocol.ConnTracker
 	options  *ServerOptions
 }
 
+// listenRetryInterval is the interval to retry listening on an address in use
+const listenRetryInterval = 2 * time.Second
+
 // ServerOptions options
 type ServerOptions struct {
 	// ingress
@@ -298,28 +335,84 @@ type ServerOptions struct {
 	MinVersion     uint16
 	MaxVersion     uint16
 	CipherSuites   []uint16
+	// DrainPeriod is how long to wait for the connections to finish when stopped
+	DrainPeriod time.Duration
 }
 
-// NewServer new server and run
+// NewServer new server and run. The listener of the previous agent is preferred,
+// if the address is still in use, e.g. the old pod is terminating, listening is
+// retried in background until the server is stopped.
 func NewServer(ip net.IP, port int, opts *ServerOptions) (*Server, error) {
 	laddr := &net.TCPAddr{
 		IP:   ip,
 		Port: port,
 	}
-	ln, err := net.ListenTCP("tcp", laddr)
-	if err != nil {
-		return nil, err
-	}
 	s := &Server{
-		listener: ln,
-		stop:     make(chan interface{}),
-		options:  opts,
+		addr:    laddr.String(),
+		stop:    make(chan interface{}),
+		tracker: protocol.NewConnTracker(),
+		options: opts,
 	}
+	ln, ok := handoff.Listener(handoff.GatewayListener(s.addr))
+	if !ok {
+		var err error
+		ln, err = net.ListenTCP("tcp", laddr)
+		if err != nil && !errors.Is(err, syscall.EADDRINUSE) {
+			return nil, err
+		}
+		if err != nil {
+			klog.Warningf("gateway server %s: %v, maybe the old pod is terminating, keep retrying", s.addr, err)
+			s.wg.Add(1)
+			go s.retryListen(laddr)
+			return s, nil
+		}
+	}
+	s.setListener(ln)
 	s.wg.Add(1)
 	go s.serve()
 	return s, nil
 }
 
+// setListener sets the listener unless the server is stopped
+func (srv *Server) setListener(ln *net.TCPListener) bool {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	select {
+	case <-srv.stop:
+		ln.Close()
+		return false
+	default:
+	}
+	srv.listener = ln
+	handoff.Register(handoff.GatewayListener(srv.addr), ln)
+	return true
+}
+
+func (srv *Server) retryListen(laddr *net.TCPAddr) {
+	ticker := time.NewTicker(listenRetryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-srv.stop:
+			srv.wg.Done()
+			return
+		case <-ticker.C:
+		}
+		ln, err := net.ListenTCP("tcp", laddr)
+		if err != nil {
+			klog.V(4).Infof("retry listening on %s err: %v", srv.addr, err)
+			continue
+		}
+		if !srv.setListener(ln) {
+			srv.wg.Done()
+			return
+		}
+		klog.Infof("gateway server listens on %s", srv.addr)
+		srv.serve()
+		return
+	}
+}
+
 func (srv *Server) serve() {
 	defer srv.wg.Done()
 
@@ -397,11 +490,17 @@ func (srv *Server) serve() {
 				}
 				continue
 			}
-			srv.wg.Add(1)
-			go func() {
+			if !srv.tracker.Track(conn) {
+				err = conn.Close()
+				if err != nil {
+					klog.Errorf("close conn err: %v", err)
+				}
+				continue
+			}
+			go func(conn net.Conn) {
+				defer srv.tracker.Untrack(conn)
 				proto.Process()
-				srv.wg.Done()
-			}()
+			}(conn)
 		}
 	}
 }
@@ -421,45 +520,61 @@ func (srv *Server) newProto(conn net.Conn) (protocol.Protocol, error) {
 			}
 		}
 
-		// get protocol
-		if srv.options.Protocol == "HTTP" || srv.options.Protocol == "HTTPS" {
+		// get protocol, https has been terminated by the tls server
+		protoName := strings.ToLower(srv.options.Protocol)
+		if protoName == "https" {
+			protoName = protocol.ProtocolHTTP
+		}
+		if !protocol.IsRegistered(protoName) {
+			return nil, fmt.Errorf("protocol %s not supported", srv.options.Protocol)
+		}
+		if protoName == protocol.ProtocolHTTP {
+			// http traffic is routed by the virtual service per request
 			for _, vs := range vss {
-				proto := &http.HTTP{
+				return protocol.New(protoName, &protocol.Options{
 					Conn:           conn,
 					VirtualService: vs,
-				}
-				return proto, nil
+					External:       true,
+				})
 			}
 			return nil, fmt.Errorf("no match virtual service")
-		} else if srv.options.Protocol == "TCP" {
-			for _, vs := range vss {
-				// TODO: currently only one tcp route for a virtual service@Porunga
-				if len(vs.Spec.Tcp) == 1 && len(vs.Spec.Tcp[0].Route) == 1 {
-					proto := &tcp.TCP{
-						Conn:         conn,
-						SvcNamespace: srv.options.Namespace,
-						SvcName:      vs.Spec.Tcp[0].Route[0].Destination.Host,
-						Port:         int(vs.Spec.Tcp[0].Route[0].Destination.Port.Number),
-					}
-					return proto, nil
-				}
+		}
+		for _, vs := range vss {
+			// TODO: currently only the first tcp route for a virtual service@Porunga
+			if len(vs.Spec.Tcp) > 0 && len(vs.Spec.Tcp[0].Route) > 0 {
+				// pick a destination by weight per connection, e.g. canary release
+				dest := protocol.PickDestination(vs.Spec.Tcp[0].Route)
+				svcName, svcNamespace := protocol.DestinationService(dest.Destination.Host, srv.options.Namespace)
+				return protocol.New(protoName, &protocol.Options{
+					Conn:         conn,
+					SvcNamespace: svcNamespace,
+					SvcName:      svcName,
+					Port:         int(dest.Destination.GetPort().GetNumber()),
+					External:     true,
+					Subset:       dest.Destination.Subset,
+				})
 			}
-			return nil, fmt.Errorf("no match virtual service")
-		} else {
-			return nil, fmt.Errorf("protocol %s not supported", srv.options.Protocol)
 		}
+		return nil, fmt.Errorf("no match virtual service")
 	}
 	return nil, fmt.Errorf("egress traffic not supported")
 }
 
 // Stop stop
 func (srv *Server) Stop() {
+	srv.lock.Lock()
 	close(srv.stop)
-	err := srv.listener.Close()
-	if err != nil {
-		klog.Errorf("close Server err: %v", err)
+	if srv.listener != nil {
+		handoff.Unregister(handoff.GatewayListener(srv.addr))
+		if err := srv.listener.Close(); err != nil {
+			klog.Errorf("close Server err: %v", err)
+		}
 	}
+	srv.lock.Unlock()
 	srv.wg.Wait()
+	if dropped := srv.tracker.Drain(srv.options.DrainPeriod); dropped > 0 {
+		klog.Warningf("%d connections of gateway server %s dropped after draining", dropped, srv.addr)
+	}
 }
 
 func getTLSCertAndKey(s v1.Secret) ([]byte, []byte, []byte, error) {
@@ -4,8 +4,10 @@ import (
 	"fmt"
 
 	"github.com/kubeedge/beehive/pkg/core"
+	beehiveContext "github.com/kubeedge/beehive/pkg/core/context"
 	"github.com/kubeedge/edgemesh/agent/pkg/gateway/config"
 	"github.com/kubeedge/edgemesh/agent/pkg/gateway/controller"
+	"github.com/kubeedge/edgemesh/agent/pkg/handoff"
 	"github.com/kubeedge/edgemesh/common/informers"
 	"github.com/kubeedge/edgemesh/common/modules"
 )
@@ -13,6 +15,8 @@ import (
 // EdgeGateway is a edge ingress gateway
 type EdgeGateway struct {
 	Config  *config.EdgeGatewayConfig
+
+	shutdownDone func()
 }
 
 func newEdgeGateway(c *config.EdgeGatewayConfig, ifm *informers.Manager) (gw *EdgeGateway, err error) {
@@ -24,6 +28,7 @@ func newEdgeGateway(c *config.EdgeGatewayConfig, ifm *informers.Manager) (gw *Ed
 	// new controller
 	controller.Init(ifm, c)
 
+	gw.shutdownDone = modules.AddShutdownTask()
 	return gw, nil
 }
 
@@ -54,4 +59,11 @@ func (gw *EdgeGateway) Enable() bool {
 
 // Start edgegateway
 func (gw *EdgeGateway) Start() {
+	defer gw.shutdownDone()
+	// the listeners are closed after handed off, the new agent owns them
+	select {
+	case <-beehiveContext.Done():
+	case <-handoff.Done():
+	}
+	controller.APIConn.Shutdown()
 }
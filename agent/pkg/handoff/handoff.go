@@ -0,0 +1,409 @@
+package handoff
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"github.com/kubeedge/edgemesh/common/modules"
+	meshutil "github.com/kubeedge/edgemesh/common/util"
+)
+
+// The listening sockets of a running edgemesh-agent are passed to the agent
+// replacing it over a unix socket with SCM_RIGHTS, so a rolling update doesn't
+// drop the proxied connections. The exchange is:
+//   new -> old: identity, the enabled modules of the new agent
+//   old -> new: one message per socket, the name along with its fd
+//   old -> new: endOfSockets
+//   new -> old: ack
+//   new -> old: ready, once the caches are synced and the modules are started
+// The old agent keeps serving until the new agent is ready, then stops serving
+// and drains its connections. If the new agent fails or isn't ready in time, the
+// old agent keeps its sockets and serving.
+
+const (
+	// ProxyListener is the name of the edgeproxy listener
+	ProxyListener = modules.EdgeProxyModuleName
+	// DNSListener is the name of the edgedns udp socket
+	DNSListener = modules.EdgeDNSModuleName
+
+	endOfSockets = "."
+	ack          = "ok"
+	ready        = "ready"
+	// exchangeTimeout bounds the whole exchange, the agents are on the same host
+	exchangeTimeout = 10 * time.Second
+	// unclaimedTimeout is how long the inherited sockets wait for their modules,
+	// e.g. gateway servers are created after the informers synced
+	unclaimedTimeout = time.Minute
+	// readyTimeout is how long the old agent waits for the new one to be ready, it's
+	// longer than unclaimedTimeout so the new agent is ready once its sockets are claimed
+	readyTimeout = 2 * unclaimedTimeout
+	// claimCheckInterval is the interval to check whether the inherited sockets are claimed
+	claimCheckInterval = 100 * time.Millisecond
+	maxNameLen         = 256
+)
+
+var (
+	mu sync.Mutex
+	// inherited are the sockets received from the old agent, not claimed yet
+	inherited = make(map[string]*os.File)
+	// sockets are the listening sockets of this agent which can be handed off
+	sockets   = make(map[string]syscall.Conn)
+	handedOff bool
+	done      = make(chan struct{})
+	// readyConn is the conn to the old agent, which waits for the ready message
+	readyConn *net.UnixConn
+)
+
+// GatewayListener returns the name of a gateway server listener
+func GatewayListener(addr string) string {
+	return modules.EdgeGatewayModuleName + "/" + addr
+}
+
+// MetricsListener returns the name of the metrics listener
+func MetricsListener(addr string) string {
+	return "metrics/" + addr
+}
+
+// Register makes a listening socket available to the agent replacing this one,
+// e.g. *net.TCPListener or *net.UDPConn
+func Register(name string, sock syscall.Conn) {
+	mu.Lock()
+	defer mu.Unlock()
+	sockets[name] = sock
+}
+
+// Unregister must be called before closing a registered socket
+func Unregister(name string) {
+	mu.Lock()
+	defer mu.Unlock()
+	delete(sockets, name)
+}
+
+// Done is closed once the sockets are handed off to a new agent, then the
+// modules should stop serving, drain their connections and keep the host
+// state (iptables rules, resolv.conf, etc.) for the new agent
+func Done() <-chan struct{} {
+	return done
+}
+
+// HandedOff indicates whether the sockets are handed off to a new agent
+func HandedOff() bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return handedOff
+}
+
+// Listener returns the inherited tcp listener of name
+func Listener(name string) (*net.TCPListener, bool) {
+	f := claim(name)
+	if f == nil {
+		return nil, false
+	}
+	defer f.Close()
+	ln, err := net.FileListener(f)
+	if err != nil {
+		klog.Errorf("rebuild inherited listener %s err: %v", name, err)
+		return nil, false
+	}
+	tcpLn, ok := ln.(*net.TCPListener)
+	if !ok {
+		klog.Errorf("inherited listener %s is not a tcp listener", name)
+		ln.Close()
+		return nil, false
+	}
+	klog.Infof("inherit listener %s on %s", name, tcpLn.Addr())
+	return tcpLn, true
+}
+
+// PacketConn returns the inherited udp socket of name
+func PacketConn(name string) (*net.UDPConn, bool) {
+	f := claim(name)
+	if f == nil {
+		return nil, false
+	}
+	defer f.Close()
+	pc, err := net.FilePacketConn(f)
+	if err != nil {
+		klog.Errorf("rebuild inherited packet conn %s err: %v", name, err)
+		return nil, false
+	}
+	udpConn, ok := pc.(*net.UDPConn)
+	if !ok {
+		klog.Errorf("inherited packet conn %s is not a udp conn", name)
+		pc.Close()
+		return nil, false
+	}
+	klog.Infof("inherit packet conn %s on %s", name, udpConn.LocalAddr())
+	return udpConn, true
+}
+
+func claim(name string) *os.File {
+	mu.Lock()
+	defer mu.Unlock()
+	f, ok := inherited[name]
+	if !ok {
+		return nil
+	}
+	delete(inherited, name)
+	return f
+}
+
+// closeUnclaimed closes the inherited sockets no module claimed
+func closeUnclaimed() {
+	mu.Lock()
+	defer mu.Unlock()
+	for name, f := range inherited {
+		klog.Infof("close unclaimed inherited socket %s", name)
+		f.Close()
+		delete(inherited, name)
+	}
+}
+
+// Receive inherits the listening sockets from the agent serving on path.
+// It's fine if there's no such agent, the modules listen by themselves.
+func Receive(path, identity string) error {
+	conn, err := net.DialTimeout("unixpacket", path, exchangeTimeout)
+	if err != nil {
+		klog.Infof("no running agent to inherit sockets from: %v", err)
+		return nil
+	}
+	uc := conn.(*net.UnixConn)
+	// the conn is kept to send the ready message after the exchange succeeds
+	succeeded := false
+	defer func() {
+		if !succeeded {
+			uc.Close()
+		}
+	}()
+	if err = uc.SetDeadline(time.Now().Add(exchangeTimeout)); err != nil {
+		return fmt.Errorf("set handoff deadline err: %v", err)
+	}
+	if _, err = uc.Write([]byte(identity)); err != nil {
+		return fmt.Errorf("send handoff identity err: %v", err)
+	}
+
+	files := make(map[string]*os.File)
+	closeAll := func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}
+	buf := make([]byte, maxNameLen)
+	oob := make([]byte, syscall.CmsgSpace(4))
+	for {
+		n, oobn, _, _, err := uc.ReadMsgUnix(buf, oob)
+		if err != nil {
+			closeAll()
+			return fmt.Errorf("receive socket err: %v", err)
+		}
+		if n == 0 {
+			closeAll()
+			return fmt.Errorf("handoff rejected by the running agent, identity %q", identity)
+		}
+		name := string(buf[:n])
+		if name == endOfSockets {
+			break
+		}
+		fd, err := parseRights(oob[:oobn])
+		if err != nil {
+			closeAll()
+			return fmt.Errorf("receive socket %s err: %v", name, err)
+		}
+		files[name] = os.NewFile(uintptr(fd), name)
+	}
+	if _, err = uc.Write([]byte(ack)); err != nil {
+		closeAll()
+		return fmt.Errorf("acknowledge handoff err: %v", err)
+	}
+
+	mu.Lock()
+	for name, f := range files {
+		inherited[name] = f
+	}
+	readyConn = uc
+	mu.Unlock()
+	succeeded = true
+	time.AfterFunc(unclaimedTimeout, closeUnclaimed)
+	klog.Infof("inherited %d sockets from the running agent", len(files))
+	return nil
+}
+
+// Ready tells the old agent that this agent is ready to serve, the old agent stops
+// serving then. It must be called after the caches are synced and the modules are
+// started, and it waits for the modules to claim the inherited sockets at most
+// unclaimedTimeout. It's a no-op if no socket is inherited.
+func Ready() {
+	mu.Lock()
+	uc := readyConn
+	readyConn = nil
+	mu.Unlock()
+	if uc == nil {
+		return
+	}
+	defer uc.Close()
+	ticker := time.NewTicker(claimCheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		mu.Lock()
+		n := len(inherited)
+		mu.Unlock()
+		if n == 0 {
+			break
+		}
+	}
+	if err := uc.SetDeadline(time.Now().Add(exchangeTimeout)); err != nil {
+		klog.Errorf("set handoff deadline err: %v", err)
+		return
+	}
+	if _, err := uc.Write([]byte(ready)); err != nil {
+		klog.Errorf("notify the running agent of readiness err: %v", err)
+		return
+	}
+	klog.Infof("notified the running agent of readiness")
+}
+
+func parseRights(oob []byte) (int, error) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return -1, err
+	}
+	var fds []int
+	for i := range msgs {
+		rights, err := syscall.ParseUnixRights(&msgs[i])
+		if err != nil {
+			return -1, err
+		}
+		fds = append(fds, rights...)
+	}
+	if len(fds) != 1 {
+		for _, fd := range fds {
+			syscall.Close(fd)
+		}
+		return -1, fmt.Errorf("expect 1 fd, got %d", len(fds))
+	}
+	return fds[0], nil
+}
+
+// Serve hands off the registered sockets to the first agent with the same
+// identity connecting to path
+func Serve(path, identity string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("create handoff socket dir err: %v", err)
+	}
+	// the socket of the previous agent is stale after receiving from it
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("remove stale handoff socket err: %v", err)
+	}
+	ln, err := net.ListenUnix("unixpacket", &net.UnixAddr{Name: path, Net: "unixpacket"})
+	if err != nil {
+		return fmt.Errorf("listen on handoff socket %s err: %v", path, err)
+	}
+	// the socket file belongs to the next agent once it listens on the same path
+	ln.SetUnlinkOnClose(false)
+	go func() {
+		defer ln.Close()
+		for {
+			conn, err := ln.AcceptUnix()
+			if err != nil {
+				if meshutil.IsClosedNetworkError(err) {
+					return
+				}
+				klog.Warningf("accept handoff conn err: %v", err)
+				continue
+			}
+			err = handOff(conn, identity)
+			conn.Close()
+			if err != nil {
+				klog.Errorf("hand off sockets err: %v", err)
+				continue
+			}
+			klog.Infof("sockets handed off to the new agent")
+			return
+		}
+	}()
+	return nil
+}
+
+func handOff(conn *net.UnixConn, identity string) error {
+	if err := conn.SetDeadline(time.Now().Add(exchangeTimeout)); err != nil {
+		return fmt.Errorf("set handoff deadline err: %v", err)
+	}
+	buf := make([]byte, maxNameLen)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return fmt.Errorf("read handoff identity err: %v", err)
+	}
+	if string(buf[:n]) != identity {
+		// closing the conn rejects it
+		return fmt.Errorf("reject agent with identity %q, want %q", buf[:n], identity)
+	}
+
+	if err = sendSockets(conn); err != nil {
+		return err
+	}
+	n, err = conn.Read(buf)
+	if err != nil {
+		return fmt.Errorf("read handoff ack err: %v", err)
+	}
+	if string(buf[:n]) != ack {
+		return fmt.Errorf("unexpected handoff ack %q", buf[:n])
+	}
+
+	// keep serving until the new agent is ready
+	klog.Infof("sockets sent, wait for the new agent to be ready")
+	if err = conn.SetDeadline(time.Now().Add(readyTimeout)); err != nil {
+		return fmt.Errorf("set handoff deadline err: %v", err)
+	}
+	n, err = conn.Read(buf)
+	if err != nil {
+		return fmt.Errorf("new agent isn't ready, keep serving: %v", err)
+	}
+	if string(buf[:n]) != ready {
+		return fmt.Errorf("unexpected handoff ready %q, keep serving", buf[:n])
+	}
+	mu.Lock()
+	handedOff = true
+	mu.Unlock()
+	close(done)
+	return nil
+}
+
+// sendSockets sends the registered sockets followed by endOfSockets
+func sendSockets(conn *net.UnixConn) error {
+	// hold the lock, so no registered socket is closed while sending
+	mu.Lock()
+	defer mu.Unlock()
+	for name, sock := range sockets {
+		if err := sendSocket(conn, name, sock); err != nil {
+			return fmt.Errorf("send socket %s err: %v", name, err)
+		}
+	}
+	if _, err := conn.Write([]byte(endOfSockets)); err != nil {
+		return fmt.Errorf("send end of sockets err: %v", err)
+	}
+	return nil
+}
+
+// sendSocket sends the fd of sock without dup-ing it by File(), which would
+// switch the shared file description to blocking mode
+func sendSocket(conn *net.UnixConn, name string, sock syscall.Conn) error {
+	raw, err := sock.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var werr error
+	err = raw.Control(func(fd uintptr) {
+		_, _, werr = conn.WriteMsgUnix([]byte(name), syscall.UnixRights(int(fd)), nil)
+	})
+	if err != nil {
+		return err
+	}
+	return werr
+}
@@ -0,0 +1,91 @@
+package handoff
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHandOff(t *testing.T) {
+	dir, err := ioutil.TempDir("", "handoff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "handoff.sock")
+
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	Register(ProxyListener, ln)
+	defer Unregister(ProxyListener)
+	if err = Serve(path, "edgeproxy"); err != nil {
+		t.Fatal(err)
+	}
+
+	// an agent running other modules is rejected
+	if err = Receive(path, "edgegateway"); err == nil {
+		t.Fatal("expect handoff to an agent with another identity to be rejected")
+	}
+	if HandedOff() {
+		t.Fatal("sockets handed off to an agent with another identity")
+	}
+
+	// the old agent keeps serving if the new one exits before it's ready
+	if err = Receive(path, "edgeproxy"); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	readyConn.Close()
+	readyConn = nil
+	mu.Unlock()
+	closeUnclaimed()
+	time.Sleep(100 * time.Millisecond)
+	if HandedOff() {
+		t.Fatal("sockets handed off to an agent which isn't ready")
+	}
+
+	if err = Receive(path, "edgeproxy"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-Done():
+		t.Fatal("done is closed before the new agent is ready")
+	case <-time.After(100 * time.Millisecond):
+	}
+	inheritedLn, ok := Listener(ProxyListener)
+	if !ok {
+		t.Fatal("listener isn't inherited")
+	}
+	defer inheritedLn.Close()
+	Ready()
+	select {
+	case <-Done():
+	case <-time.After(time.Second):
+		t.Fatal("done isn't closed after the new agent is ready")
+	}
+	if _, ok = Listener(ProxyListener); ok {
+		t.Fatal("listener is claimed twice")
+	}
+
+	// the inherited listener keeps accepting after the old one is closed
+	ln.Close()
+	conn, err := net.Dial("tcp", inheritedLn.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err = inheritedLn.SetDeadline(time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := inheritedLn.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted.Close()
+}
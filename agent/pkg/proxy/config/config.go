@@ -14,6 +14,14 @@ type EdgeProxyConfig struct {
 	// ListenPort indicates the listen port of edgeproxy
 	// default 40001
 	ListenPort int `json:"listenPort,omitempty"`
+	// SniffTimeout indicates the milliseconds to wait for the first bytes of a connection
+	// when sniffing the protocol of a port without a declared protocol
+	// default 300
+	SniffTimeout int `json:"sniffTimeout,omitempty"`
+	// DrainPeriod indicates how long edgeproxy waits for the in-flight connections
+	// to finish on shutdown before closing them, the unit is second.
+	// default 10
+	DrainPeriod int `json:"drainPeriod,omitempty"`
 }
 
 func NewEdgeProxyConfig() *EdgeProxyConfig {
@@ -22,5 +30,7 @@ func NewEdgeProxyConfig() *EdgeProxyConfig {
 		SubNet:          "10.0.0.0/24",
 		ListenInterface: "docker0",
 		ListenPort:      40001,
+		SniffTimeout:    300,
+		DrainPeriod:     10,
 	}
 }
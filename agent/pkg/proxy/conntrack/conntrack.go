@@ -0,0 +1,107 @@
+package conntrack
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+// flowFilter matches conntrack flows, a zero value field matches anything
+type flowFilter struct {
+	protocol    uint8
+	origDstIP   net.IP
+	origDstPort uint16
+	replySrcIP  net.IP
+}
+
+// MatchConntrackFlow implements netlink.CustomConntrackFilter
+func (f *flowFilter) MatchConntrackFlow(flow *netlink.ConntrackFlow) bool {
+	if f.protocol != 0 && f.protocol != flow.Forward.Protocol {
+		return false
+	}
+	if f.origDstIP != nil && !f.origDstIP.Equal(flow.Forward.DstIP) {
+		return false
+	}
+	if f.origDstPort != 0 && f.origDstPort != flow.Forward.DstPort {
+		return false
+	}
+	if f.replySrcIP != nil && !f.replySrcIP.Equal(flow.Reverse.SrcIP) {
+		return false
+	}
+	return true
+}
+
+// ClearEntriesForIP deletes conntrack entries whose original destination is ip,
+// an empty protocol stands for all protocols.
+func ClearEntriesForIP(ip string, protocol v1.Protocol) error {
+	dst := net.ParseIP(ip)
+	if dst == nil {
+		return fmt.Errorf("invalid ip %s", ip)
+	}
+	return clearEntries(&flowFilter{
+		protocol:  protoNumber(protocol),
+		origDstIP: dst,
+	})
+}
+
+// ClearEntriesForPort deletes conntrack entries whose original destination is ip:port
+func ClearEntriesForPort(ip string, port int, protocol v1.Protocol) error {
+	dst := net.ParseIP(ip)
+	if dst == nil {
+		return fmt.Errorf("invalid ip %s", ip)
+	}
+	if port <= 0 || port > 65535 {
+		return fmt.Errorf("invalid port %d", port)
+	}
+	return clearEntries(&flowFilter{
+		protocol:    protoNumber(protocol),
+		origDstIP:   dst,
+		origDstPort: uint16(port),
+	})
+}
+
+// ClearEntriesForNAT deletes conntrack entries whose original destination is origin
+// and which were translated to dest, e.g. flows from a ClusterIP to a removed endpoint.
+func ClearEntriesForNAT(origin, dest string, protocol v1.Protocol) error {
+	dst := net.ParseIP(origin)
+	if dst == nil {
+		return fmt.Errorf("invalid ip %s", origin)
+	}
+	src := net.ParseIP(dest)
+	if src == nil {
+		return fmt.Errorf("invalid ip %s", dest)
+	}
+	return clearEntries(&flowFilter{
+		protocol:   protoNumber(protocol),
+		origDstIP:  dst,
+		replySrcIP: src,
+	})
+}
+
+func clearEntries(filter *flowFilter) error {
+	n, err := netlink.ConntrackDeleteFilter(netlink.ConntrackTable, netlink.InetFamily(netlink.FAMILY_V4), filter)
+	if err != nil {
+		return fmt.Errorf("delete conntrack entries err: %v", err)
+	}
+	if n > 0 {
+		klog.V(4).Infof("%d conntrack entries deleted, filter: %+v", n, *filter)
+	}
+	return nil
+}
+
+func protoNumber(protocol v1.Protocol) uint8 {
+	switch protocol {
+	case v1.ProtocolTCP:
+		return syscall.IPPROTO_TCP
+	case v1.ProtocolUDP:
+		return syscall.IPPROTO_UDP
+	case v1.ProtocolSCTP:
+		return syscall.IPPROTO_SCTP
+	default:
+		return 0
+	}
+}
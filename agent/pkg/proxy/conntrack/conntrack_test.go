@@ -0,0 +1,68 @@
+package conntrack
+
+import (
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+)
+
+func TestFlowFilterMatch(t *testing.T) {
+	flow := &netlink.ConntrackFlow{}
+	flow.Forward.Protocol = syscall.IPPROTO_UDP
+	flow.Forward.SrcIP = net.ParseIP("172.17.0.2")
+	flow.Forward.DstIP = net.ParseIP("10.96.0.10")
+	flow.Forward.DstPort = 53
+	flow.Reverse.SrcIP = net.ParseIP("172.17.0.5")
+	flow.Reverse.DstIP = net.ParseIP("172.17.0.2")
+
+	tests := []struct {
+		name   string
+		filter *flowFilter
+		want   bool
+	}{
+		{
+			"match cluster ip",
+			&flowFilter{origDstIP: net.ParseIP("10.96.0.10")},
+			true,
+		},
+		{
+			"mismatch cluster ip",
+			&flowFilter{origDstIP: net.ParseIP("10.96.0.11")},
+			false,
+		},
+		{
+			"match port and protocol",
+			&flowFilter{protocol: syscall.IPPROTO_UDP, origDstIP: net.ParseIP("10.96.0.10"), origDstPort: 53},
+			true,
+		},
+		{
+			"mismatch protocol",
+			&flowFilter{protocol: syscall.IPPROTO_TCP, origDstIP: net.ParseIP("10.96.0.10"), origDstPort: 53},
+			false,
+		},
+		{
+			"mismatch port",
+			&flowFilter{origDstIP: net.ParseIP("10.96.0.10"), origDstPort: 5353},
+			false,
+		},
+		{
+			"match nat",
+			&flowFilter{origDstIP: net.ParseIP("10.96.0.10"), replySrcIP: net.ParseIP("172.17.0.5")},
+			true,
+		},
+		{
+			"mismatch nat",
+			&flowFilter{origDstIP: net.ParseIP("10.96.0.10"), replySrcIP: net.ParseIP("172.17.0.6")},
+			false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.filter.MatchConntrackFlow(flow); got != tt.want {
+				t.Errorf("MatchConntrackFlow() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package controller
+
+import (
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/klog/v2"
+
+	"github.com/kubeedge/edgemesh/agent/pkg/proxy/conntrack"
+)
+
+// clearConntrackForIP deletes the non-tcp conntrack entries of a removed ClusterIP of
+// the service, the tcp ones are owned by edgeproxy like clearConntrackForStalePorts
+func clearConntrackForIP(svc *v1.Service, ip string) {
+	for _, protocol := range nonTCPProtocols(svc) {
+		klog.V(4).Infof("clear %s conntrack entries for cluster ip %s", protocol, ip)
+		if err := conntrack.ClearEntriesForIP(ip, protocol); err != nil {
+			klog.Errorf("clear %s conntrack entries for cluster ip %s err: %v", protocol, ip, err)
+		}
+	}
+}
+
+// clearConntrackForStalePorts deletes the conntrack entries of the service ports which
+// have been removed. The tcp entries are kept, since the tcp flows to the ClusterIP are
+// DNATed to edgeproxy which owns them, flushing them breaks the live proxied connections.
+func clearConntrackForStalePorts(oldSvc, svc *v1.Service) {
+	ip := oldSvc.Spec.ClusterIP
+	for _, oldPort := range oldSvc.Spec.Ports {
+		if oldPort.Protocol == v1.ProtocolTCP || oldPort.Protocol == "" {
+			continue
+		}
+		stale := true
+		for _, p := range svc.Spec.Ports {
+			if p.Port == oldPort.Port && p.Protocol == oldPort.Protocol {
+				stale = false
+				break
+			}
+		}
+		if !stale {
+			continue
+		}
+		klog.V(4).Infof("clear conntrack entries for %s %s:%d", oldPort.Protocol, ip, oldPort.Port)
+		if err := conntrack.ClearEntriesForPort(ip, int(oldPort.Port), oldPort.Protocol); err != nil {
+			klog.Errorf("clear conntrack entries for %s %s:%d err: %v", oldPort.Protocol, ip, oldPort.Port, err)
+		}
+	}
+}
+
+// clearConntrackForEndpoint deletes the non-tcp conntrack entries which still steer the
+// flows to the ClusterIP of the service to a removed endpoint address. These flows aren't
+// proxied by edgeproxy, they are translated to the endpoints by the node, so an entry
+// replied by the address lives until it times out, since udp has no connection state.
+func clearConntrackForEndpoint(svc *v1.Service, addr string) {
+	ip := svc.Spec.ClusterIP
+	for _, protocol := range nonTCPProtocols(svc) {
+		klog.V(4).Infof("clear %s conntrack entries for endpoint %s of cluster ip %s", protocol, addr, ip)
+		if err := conntrack.ClearEntriesForNAT(ip, addr, protocol); err != nil {
+			klog.Errorf("clear %s conntrack entries for endpoint %s of cluster ip %s err: %v", protocol, addr, ip, err)
+		}
+	}
+}
+
+// nonTCPProtocols returns the protocols of the service ports except tcp
+func nonTCPProtocols(svc *v1.Service) []v1.Protocol {
+	var protocols []v1.Protocol
+	seen := make(map[v1.Protocol]bool)
+	for _, p := range svc.Spec.Ports {
+		if p.Protocol == v1.ProtocolTCP || p.Protocol == "" || seen[p.Protocol] {
+			continue
+		}
+		seen[p.Protocol] = true
+		protocols = append(protocols, p.Protocol)
+	}
+	return protocols
+}
+
+// removedAddresses returns the ready addresses which exist in oldEp but not in ep
+func removedAddresses(oldEp, ep *v1.Endpoints) []string {
+	current := sets.NewString()
+	for _, subset := range ep.Subsets {
+		for _, addr := range subset.Addresses {
+			current.Insert(addr.IP)
+		}
+	}
+	removed := sets.NewString()
+	for _, subset := range oldEp.Subsets {
+		for _, addr := range subset.Addresses {
+			if !current.Has(addr.IP) {
+				removed.Insert(addr.IP)
+			}
+		}
+	}
+	return removed.List()
+}
@@ -1,15 +1,15 @@
 package controller
 
 import (
-	"fmt"
-	"strings"
 	"sync"
 
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/klog/v2"
 
 	"github.com/kubeedge/edgemesh/common/informers"
+	"github.com/kubeedge/edgemesh/common/util"
 )
 
 var (
@@ -19,20 +19,38 @@ var (
 
 type ProxyController struct {
 	svcInformer cache.SharedIndexInformer
+	epInformer  cache.SharedIndexInformer
 
 	sync.RWMutex
-	svcPortsByIP map[string]string // key: clusterIP, value: SvcPorts
-	ipBySvc      map[string]string // key: svcName.svcNamespace, value: clusterIP
+	svcPortsByIP map[string]*ServicePorts // key: clusterIP, value: port table of the clusterIP
+	ipBySvc      map[string]string        // key: svcNamespace.svcName, value: clusterIP
+}
+
+// ServicePort is an entry of the port table of a clusterIP
+type ServicePort struct {
+	Port       int32
+	TargetPort intstr.IntOrString
+	// Protocol is the l7 protocol name of the port, e.g. "http", "tcp"
+	Protocol string
+}
+
+// ServicePorts is the port table of a clusterIP, it's never modified after created
+type ServicePorts struct {
+	Namespace string
+	Name      string
+	Ports     map[int32]*ServicePort // key: service port
 }
 
 func Init(ifm *informers.Manager) {
 	once.Do(func() {
 		APIConn = &ProxyController{
 			svcInformer:  ifm.GetKubeFactory().Core().V1().Services().Informer(),
-			svcPortsByIP: make(map[string]string),
+			epInformer:   ifm.GetKubeFactory().Core().V1().Endpoints().Informer(),
+			svcPortsByIP: make(map[string]*ServicePorts),
 			ipBySvc:      make(map[string]string),
 		}
 		ifm.RegisterInformer(APIConn.svcInformer)
+		ifm.RegisterInformer(APIConn.epInformer)
 		ifm.RegisterSyncedFunc(APIConn.onCacheSynced)
 	})
 }
@@ -41,17 +59,28 @@ func (c *ProxyController) onCacheSynced() {
 	// set informers event handler
 	c.svcInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
 		AddFunc: c.svcAdd, UpdateFunc: c.svcUpdate, DeleteFunc: c.svcDelete})
+	c.epInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		UpdateFunc: c.epUpdate, DeleteFunc: c.epDelete})
 }
 
-func getSvcPorts(svc *v1.Service) string {
-	svcPorts := ""
-	svcName := svc.Namespace + "." + svc.Name
-	for _, p := range svc.Spec.Ports {
-		pro := strings.Split(p.Name, "-")
-		sub := fmt.Sprintf("%s,%d,%d|", pro[0], p.Port, p.TargetPort.IntVal)
-		svcPorts = svcPorts + sub
+// getSvcPorts builds the port table of a service, only tcp ports can be proxied
+func getSvcPorts(svc *v1.Service) *ServicePorts {
+	svcPorts := &ServicePorts{
+		Namespace: svc.Namespace,
+		Name:      svc.Name,
+		Ports:     make(map[int32]*ServicePort),
+	}
+	for i := range svc.Spec.Ports {
+		p := &svc.Spec.Ports[i]
+		if p.Protocol != v1.ProtocolTCP {
+			continue
+		}
+		svcPorts.Ports[p.Port] = &ServicePort{
+			Port:       p.Port,
+			TargetPort: p.TargetPort,
+			Protocol:   util.GetServicePortProtocol(svc, p),
+		}
 	}
-	svcPorts += svcName
 	return svcPorts
 }
 
@@ -71,17 +100,32 @@ func (c *ProxyController) svcAdd(obj interface{}) {
 }
 
 func (c *ProxyController) svcUpdate(oldObj, newObj interface{}) {
+	oldSvc, ok := oldObj.(*v1.Service)
+	if !ok {
+		klog.Errorf("invalid type %v", oldObj)
+		return
+	}
 	svc, ok := newObj.(*v1.Service)
 	if !ok {
 		klog.Errorf("invalid type %v", newObj)
 		return
 	}
-	svcPorts := getSvcPorts(svc)
 	svcName := svc.Namespace + "." + svc.Name
+	oldIP := oldSvc.Spec.ClusterIP
 	ip := svc.Spec.ClusterIP
+	if oldIP != "" && oldIP != "None" {
+		if oldIP != ip {
+			// the ClusterIP has changed, flows to the old one must not be steered anymore
+			c.deleteService(svcName, oldIP)
+			clearConntrackForIP(oldSvc, oldIP)
+		} else {
+			clearConntrackForStalePorts(oldSvc, svc)
+		}
+	}
 	if ip == "" || ip == "None" {
 		return
 	}
+	svcPorts := getSvcPorts(svc)
 	c.addOrUpdateService(svcName, ip, svcPorts)
 }
 
@@ -97,10 +141,60 @@ func (c *ProxyController) svcDelete(obj interface{}) {
 		return
 	}
 	c.deleteService(svcName, ip)
+	clearConntrackForIP(svc, ip)
+}
+
+func (c *ProxyController) epUpdate(oldObj, newObj interface{}) {
+	oldEp, ok := oldObj.(*v1.Endpoints)
+	if !ok {
+		klog.Errorf("invalid type %v", oldObj)
+		return
+	}
+	ep, ok := newObj.(*v1.Endpoints)
+	if !ok {
+		klog.Errorf("invalid type %v", newObj)
+		return
+	}
+	svc := c.getService(ep.Namespace, ep.Name)
+	if svc == nil {
+		return
+	}
+	for _, addr := range removedAddresses(oldEp, ep) {
+		clearConntrackForEndpoint(svc, addr)
+	}
+}
+
+func (c *ProxyController) epDelete(obj interface{}) {
+	ep, ok := obj.(*v1.Endpoints)
+	if !ok {
+		klog.Errorf("invalid type %v", obj)
+		return
+	}
+	svc := c.getService(ep.Namespace, ep.Name)
+	if svc == nil {
+		return
+	}
+	for _, addr := range removedAddresses(ep, &v1.Endpoints{}) {
+		clearConntrackForEndpoint(svc, addr)
+	}
+}
+
+// getService returns the service of the endpoints with a ClusterIP, service and
+// endpoints have the same name
+func (c *ProxyController) getService(namespace, name string) *v1.Service {
+	obj, exists, err := c.svcInformer.GetStore().GetByKey(namespace + "/" + name)
+	if err != nil || !exists {
+		return nil
+	}
+	svc, ok := obj.(*v1.Service)
+	if !ok || svc.Spec.ClusterIP == "" || svc.Spec.ClusterIP == "None" {
+		return nil
+	}
+	return svc
 }
 
 // AddOrUpdateService add or updates a service
-func (c *ProxyController) addOrUpdateService(svcName, ip, svcPorts string) {
+func (c *ProxyController) addOrUpdateService(svcName, ip string, svcPorts *ServicePorts) {
 	c.Lock()
 	defer c.Unlock()
 	c.ipBySvc[svcName] = ip
@@ -123,8 +217,9 @@ func (c *ProxyController) GetSvcIP(svcName string) string {
 	return ip
 }
 
-// GetSvcPorts is a thread-safe operation to get from map
-func (c *ProxyController) GetSvcPorts(ip string) string {
+// GetSvcPorts is a thread-safe operation to get the port table of a clusterIP,
+// nil is returned if no service owns the clusterIP
+func (c *ProxyController) GetSvcPorts(ip string) *ServicePorts {
 	c.RLock()
 	defer c.RUnlock()
 	svcPorts := c.svcPortsByIP[ip]
@@ -12,8 +12,6 @@ import (
 	"k8s.io/klog/v2"
 	utiliptables "k8s.io/kubernetes/pkg/util/iptables"
 	utilexec "k8s.io/utils/exec"
-
-	beehiveContext "github.com/kubeedge/beehive/pkg/core/context"
 )
 
 const (
@@ -28,6 +26,9 @@ type Proxier struct {
 	inboundRule  string
 	outboundRule string
 	dNatRule     string
+
+	stopCh  chan struct{}
+	stopped chan struct{}
 }
 
 func newProxier(subnet, netif string, listenIP net.IP, port int) (proxier *Proxier, err error) {
@@ -40,6 +41,8 @@ func newProxier(subnet, netif string, listenIP net.IP, port int) (proxier *Proxi
 		inboundRule:  "-p tcp -d " + subnet + " -i " + netif + " -j " + meshChain,
 		outboundRule: "-p tcp -d " + subnet + " -o " + netif + " -j " + meshChain,
 		dNatRule:     "-p tcp -j DNAT --to-destination " + serverAddr,
+		stopCh:       make(chan struct{}),
+		stopped:      make(chan struct{}),
 	}
 	// read and clean iptables rules
 	proxier.readAndCleanRule()
@@ -54,6 +57,15 @@ func newProxier(subnet, netif string, listenIP net.IP, port int) (proxier *Proxi
 		Dst: dst,
 		Gw:  listenIP,
 	}
+	// the ip of a dummy device is not reachable as a gateway, so route the subnet
+	// to the device directly, then the outbound rule can match it
+	if link, err := netlink.LinkByName(netif); err == nil && link.Type() == "dummy" {
+		proxier.route = netlink.Route{
+			Dst:       dst,
+			LinkIndex: link.Attrs().Index,
+			Scope:     netlink.SCOPE_LINK,
+		}
+	}
 	err = netlink.RouteAdd(&proxier.route)
 	if err != nil {
 		klog.Warningf("add route event: %v", err)
@@ -66,19 +78,26 @@ func newProxier(subnet, netif string, listenIP net.IP, port int) (proxier *Proxi
 // start network
 func (p *Proxier) start() {
 	go func() {
+		defer close(p.stopped)
 		ticker := time.NewTicker(10 * time.Second)
+		defer ticker.Stop()
 		for {
 			select {
 			case <-ticker.C:
 				p.ensureRule()
-			case <-beehiveContext.Done():
-				p.clean()
+			case <-p.stopCh:
 				return
 			}
 		}
 	}()
 }
 
+// stop stops ensuring iptables rules
+func (p *Proxier) stop() {
+	close(p.stopCh)
+	<-p.stopped
+}
+
 // ensureRule ensures iptables rules exist
 func (p *Proxier) ensureRule() {
 	iptInterface := p.iptables
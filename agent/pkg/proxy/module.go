@@ -7,6 +7,8 @@ import (
 	"k8s.io/klog/v2"
 
 	"github.com/kubeedge/beehive/pkg/core"
+	"github.com/kubeedge/edgemesh/agent/pkg/chassis/protocol"
+	"github.com/kubeedge/edgemesh/agent/pkg/handoff"
 	"github.com/kubeedge/edgemesh/agent/pkg/proxy/config"
 	"github.com/kubeedge/edgemesh/agent/pkg/proxy/controller"
 	"github.com/kubeedge/edgemesh/common/informers"
@@ -19,6 +21,9 @@ type EdgeProxy struct {
 	Config   *config.EdgeProxyConfig
 	Listener *net.TCPListener
 	Proxier  *Proxier
+
+	tracker      *protocol.ConnTracker
+	shutdownDone func()
 }
 
 func newEdgeProxy(c *config.EdgeProxyConfig, ifm *informers.Manager) (proxy *EdgeProxy, err error) {
@@ -36,13 +41,21 @@ func newEdgeProxy(c *config.EdgeProxyConfig, ifm *informers.Manager) (proxy *Edg
 		return proxy, fmt.Errorf("get proxy listen ip err: %v", err)
 	}
 
-	// get tcp listener
+	// get tcp listener, the one of the previous agent is preferred
+	if ln, ok := handoff.Listener(handoff.ProxyListener); ok {
+		if ln.Addr().(*net.TCPAddr).IP.Equal(listenIP) {
+			proxy.Listener = ln
+		} else {
+			klog.Warningf("inherited listener on %s mismatches listen ip %s, drop it", ln.Addr(), listenIP)
+			ln.Close()
+		}
+	}
 	tmpPort := 0
 	listenAddr := &net.TCPAddr{
 		IP:   listenIP,
 		Port: proxy.Config.ListenPort + tmpPort,
 	}
-	for {
+	for proxy.Listener == nil {
 		ln, err := net.ListenTCP("tcp", listenAddr)
 		if err == nil {
 			proxy.Listener = ln
@@ -63,6 +76,9 @@ func newEdgeProxy(c *config.EdgeProxyConfig, ifm *informers.Manager) (proxy *Edg
 		return proxy, fmt.Errorf("new proxier error: %v", err)
 	}
 
+	handoff.Register(handoff.ProxyListener, proxy.Listener)
+	proxy.tracker = protocol.NewConnTracker()
+	proxy.shutdownDone = modules.AddShutdownTask()
 	return proxy, nil
 }
 
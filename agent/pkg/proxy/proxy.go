@@ -3,17 +3,18 @@ package proxy
 import (
 	"fmt"
 	"net"
-	"strconv"
-	"strings"
 	"syscall"
+	"time"
 	"unsafe"
 
 	"k8s.io/klog/v2"
 
+	beehiveContext "github.com/kubeedge/beehive/pkg/core/context"
+	chassiscontroller "github.com/kubeedge/edgemesh/agent/pkg/chassis/controller"
 	"github.com/kubeedge/edgemesh/agent/pkg/chassis/protocol"
-	"github.com/kubeedge/edgemesh/agent/pkg/chassis/protocol/http"
-	"github.com/kubeedge/edgemesh/agent/pkg/chassis/protocol/tcp"
+	"github.com/kubeedge/edgemesh/agent/pkg/handoff"
 	"github.com/kubeedge/edgemesh/agent/pkg/proxy/controller"
+	meshutil "github.com/kubeedge/edgemesh/common/util"
 )
 
 const SoOriginalDst = 80
@@ -26,11 +27,16 @@ type sockAddr struct {
 func (proxy *EdgeProxy) Run() {
 	// ensure ipatbles
 	proxy.Proxier.start()
+	go proxy.shutdown()
 
 	// start server
 	for {
 		conn, err := proxy.Listener.Accept()
 		if err != nil {
+			if meshutil.IsClosedNetworkError(err) {
+				klog.Infof("edgeproxy stops accepting connections")
+				return
+			}
 			klog.Warningf("get tcp conn error: %v", err)
 			continue
 		}
@@ -41,14 +47,53 @@ func (proxy *EdgeProxy) Run() {
 			conn.Close()
 			continue
 		}
-		proto, err := proxy.newProtocolFromSock(ip, port, conn)
-		if err != nil {
-			klog.Warningf("get protocol from sock error: %v", err)
+		if !proxy.tracker.Track(conn) {
 			conn.Close()
 			continue
 		}
-		go proto.Process()
+		// sniffing may wait for the first bytes, don't block the accept loop
+		go proxy.process(ip, port, conn)
+	}
+}
+
+// shutdown stops edgeproxy when beehive signals Done or the listener is handed
+// off to a new agent. The listener is closed first, then the in-flight connections
+// are drained within the drain period. The iptables rules are kept for the new agent.
+func (proxy *EdgeProxy) shutdown() {
+	defer proxy.shutdownDone()
+	select {
+	case <-beehiveContext.Done():
+	case <-handoff.Done():
+	}
+
+	handoff.Unregister(handoff.ProxyListener)
+	if err := proxy.Listener.Close(); err != nil {
+		klog.Errorf("close edgeproxy listener err: %v", err)
+	}
+	proxy.Proxier.stop()
+	if !handoff.HandedOff() {
+		proxy.Proxier.clean()
+	}
+
+	period := time.Duration(proxy.Config.DrainPeriod) * time.Second
+	klog.Infof("draining %d connections of edgeproxy in %v", proxy.tracker.Len(), period)
+	if dropped := proxy.tracker.Drain(period); dropped > 0 {
+		klog.Warningf("%d connections of edgeproxy dropped after draining", dropped)
+	} else {
+		klog.Infof("all connections of edgeproxy drained")
+	}
+}
+
+// process proxies an intercepted connection
+func (proxy *EdgeProxy) process(ip string, port int, conn net.Conn) {
+	defer proxy.tracker.Untrack(conn)
+	proto, err := proxy.newProtocolFromSock(ip, port, conn)
+	if err != nil {
+		klog.Warningf("get protocol from sock error: %v", err)
+		conn.Close()
+		return
 	}
+	proto.Process()
 }
 
 // realServerAddress returns an intercepted connection's original destination.
@@ -105,63 +150,72 @@ func getSockOpt(s int, level int, name int, val uintptr, vallen *uint32) (err er
 }
 
 // newProtocolFromSock returns a protocol.Protocol interface if the ip is in proxier list
-func (proxy *EdgeProxy) newProtocolFromSock(ip string, port int, conn net.Conn) (proto protocol.Protocol, err error) {
+func (proxy *EdgeProxy) newProtocolFromSock(ip string, port int, conn net.Conn) (protocol.Protocol, error) {
 	svcPorts := controller.APIConn.GetSvcPorts(ip)
-	protoName, svcName := getProtocol(svcPorts, port)
-	if protoName == "" || svcName == "" {
-		return nil, fmt.Errorf("protocol name: %s or svcName: %s is invalid", protoName, svcName)
+	protoName, namespace, name := getProtocol(svcPorts, port)
+	if name == "" {
+		return nil, fmt.Errorf("service of %s:%d not found", ip, port)
 	}
 
-	svcNameSets := strings.Split(svcName, ".")
-	if len(svcNameSets) != 2 {
-		return nil, fmt.Errorf("invalid length %d after splitting svc name %s", len(svcNameSets), svcName)
+	if !protocol.IsRegistered(protoName) {
+		// the port doesn't declare a supported protocol, detect it from the first bytes
+		timeout := time.Duration(proxy.Config.SniffTimeout) * time.Millisecond
+		protoName, conn = protocol.Sniff(conn, timeout)
+		klog.V(4).Infof("sniffed protocol %s of %s:%d", protoName, ip, port)
+		if !protocol.IsRegistered(protoName) {
+			// e.g. http2 and tls, proxy them as opaque tcp streams
+			protoName = protocol.ProtocolTCP
+		}
+	}
+
+	opts := &protocol.Options{
+		Conn:         conn,
+		SvcNamespace: namespace,
+		SvcName:      name,
+		Port:         port,
 	}
-	namespace := svcNameSets[0]
-	name := svcNameSets[1]
+	applyVirtualService(protoName, opts)
+	return protocol.New(protoName, opts)
+}
 
+// applyVirtualService applies the virtual service routing the mesh traffic to the service,
+// http requests are routed per request by the http handler, and tcp connections are
+// routed here per connection
+func applyVirtualService(protoName string, opts *protocol.Options) {
+	vs := chassiscontroller.APIConn.GetMeshVirtualService(opts.SvcNamespace, opts.SvcName)
+	if vs == nil {
+		return
+	}
 	switch protoName {
-	case "http":
-		proto = &http.HTTP{
-			Conn:         conn,
-			SvcName:      name,
-			SvcNamespace: namespace,
-			Port:         port,
+	case protocol.ProtocolHTTP:
+		if len(vs.Spec.Http) > 0 {
+			opts.VirtualService = vs
 		}
-		err = nil
-	case "tcp":
-		proto = &tcp.TCP{
-			Conn:         conn,
-			SvcName:      name,
-			SvcNamespace: namespace,
-			Port:         port,
+	case protocol.ProtocolTCP:
+		route := protocol.MatchTCPRoute(vs, opts.Port)
+		if route == nil {
+			return
 		}
-		err = nil
-	default:
-		proto = nil
-		err = fmt.Errorf("protocol: %s is not supported yet", protoName)
+		// pick a destination by weight per connection, e.g. canary release
+		dest := protocol.PickDestination(route.Route)
+		opts.SvcName, opts.SvcNamespace = protocol.DestinationService(dest.Destination.Host, vs.Namespace)
+		if n := dest.Destination.GetPort().GetNumber(); n != 0 {
+			opts.Port = int(n)
+		}
+		opts.Subset = dest.Destination.Subset
+		klog.V(4).Infof("route tcp connection by virtual service %s.%s to svc %s.%s",
+			vs.Namespace, vs.Name, opts.SvcNamespace, opts.SvcName)
 	}
-	return
 }
 
-// getProtocol gets protocol name
-func getProtocol(svcPorts string, port int) (string, string) {
-	var protoName string
-	sub := strings.Split(svcPorts, "|")
-	n := len(sub)
-	if n < 2 {
-		return "", ""
-	}
-	svcName := sub[n-1]
-
-	pstr := strconv.Itoa(port)
-	if pstr == "" {
-		return "", ""
+// getProtocol gets protocol name and service of the given port in the port table
+func getProtocol(svcPorts *controller.ServicePorts, port int) (protoName, namespace, name string) {
+	if svcPorts == nil {
+		return "", "", ""
 	}
-	for _, s := range sub {
-		if strings.Contains(s, pstr) {
-			protoName = strings.Split(s, ",")[0]
-			break
-		}
+	p, ok := svcPorts.Ports[int32(port)]
+	if !ok {
+		return "", "", ""
 	}
-	return protoName, svcName
+	return p.Protocol, svcPorts.Namespace, svcPorts.Name
 }
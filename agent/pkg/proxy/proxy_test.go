@@ -2,40 +2,73 @@ package proxy
 
 import (
 	"testing"
+
+	"github.com/kubeedge/edgemesh/agent/pkg/proxy/controller"
 )
 
 func TestGetProtocol(t *testing.T) {
+	mosquitto := &controller.ServicePorts{
+		Namespace: "default",
+		Name:      "svc-mosquitto",
+		Ports: map[int32]*controller.ServicePort{
+			1883: {Port: 1883, Protocol: "mqtt"},
+		},
+	}
+	web := &controller.ServicePorts{
+		Namespace: "default",
+		Name:      "web",
+		Ports: map[int32]*controller.ServicePort{
+			80:   {Port: 80, Protocol: "http"},
+			8080: {Port: 8080, Protocol: "tcp"},
+		},
+	}
 	tests := []struct {
 		name          string
-		svcPorts      string
+		svcPorts      *controller.ServicePorts
 		port          int
 		wantProtoName string
 		wantSvcName   string
 	}{
 		{
 			"protocol parse",
-			"mqtt,1883|svc-mosquitto",
+			mosquitto,
 			1883,
 			"mqtt",
 			"svc-mosquitto",
 		},
 		{
-			"Endpoints -> Service",
-			"tcp,1883,1883|default.mosquitto-host-edge1",
-			1883,
+			"exact port",
+			web,
+			80,
+			"http",
+			"web",
+		},
+		{
+			"exact port with the same prefix",
+			web,
+			8080,
 			"tcp",
-			"default.mosquitto-host-edge1",
+			"web",
+		},
+		{
+			"port not found",
+			web,
+			8,
+			"",
+			"",
+		},
+		{
+			"service not found",
+			nil,
+			80,
+			"",
+			"",
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			protoName, svcName := getProtocol(tt.svcPorts, tt.port)
-			if protoName == "" || svcName == "" {
-				t.Errorf("getProtocol() failed, svcPorts = %v, port %v", tt.svcPorts, tt.port)
-				return
-			}
-
-			if protoName != tt.wantProtoName && svcName != tt.wantSvcName {
+			protoName, _, svcName := getProtocol(tt.svcPorts, tt.port)
+			if protoName != tt.wantProtoName || svcName != tt.wantSvcName {
 				t.Errorf("getProtocol() = (%v, %v), want (%v, %v)", protoName, svcName, tt.wantProtoName, tt.wantSvcName)
 			}
 		})
@@ -0,0 +1,22 @@
+package modules
+
+import "sync"
+
+// shutdownTasks are the cleanups of modules which must finish before edgemesh exits,
+// beehive doesn't wait for the modules after signaling Done
+var shutdownTasks sync.WaitGroup
+
+// AddShutdownTask registers a cleanup task, the returned done func must be called
+// once the task finishes
+func AddShutdownTask() (done func()) {
+	shutdownTasks.Add(1)
+	var once sync.Once
+	return func() {
+		once.Do(shutdownTasks.Done)
+	}
+}
+
+// WaitShutdownTasks blocks until all the shutdown tasks finish
+func WaitShutdownTasks() {
+	shutdownTasks.Wait()
+}
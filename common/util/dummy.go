@@ -0,0 +1,73 @@
+package util
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/vishvananda/netlink"
+	"k8s.io/klog/v2"
+)
+
+// EnsureDummyDevice creates a dummy device if it does not exist yet, binds ip to it
+// and brings it up. It is used to provide a stable listen address for edgedns and
+// edgeproxy on nodes without docker0.
+func EnsureDummyDevice(name, ip string) (netlink.Link, error) {
+	link, err := netlink.LinkByName(name)
+	if err == nil {
+		if _, ok := link.(*netlink.Dummy); !ok {
+			return nil, fmt.Errorf("link %s already exists but is not a dummy device, type: %s", name, link.Type())
+		}
+	} else {
+		if _, ok := err.(netlink.LinkNotFoundError); !ok {
+			return nil, fmt.Errorf("get link %s err: %v", name, err)
+		}
+		dummy := &netlink.Dummy{
+			LinkAttrs: netlink.LinkAttrs{Name: name},
+		}
+		if err = netlink.LinkAdd(dummy); err != nil {
+			return nil, fmt.Errorf("add dummy device %s err: %v", name, err)
+		}
+		klog.Infof("dummy device %s created", name)
+		if link, err = netlink.LinkByName(name); err != nil {
+			return nil, fmt.Errorf("get link %s err: %v", name, err)
+		}
+	}
+
+	addrIP := net.ParseIP(ip)
+	if addrIP == nil || addrIP.To4() == nil {
+		return nil, fmt.Errorf("invalid ipv4 address %s for dummy device %s", ip, name)
+	}
+	addr := &netlink.Addr{
+		IPNet: &net.IPNet{
+			IP:   addrIP.To4(),
+			Mask: net.CIDRMask(32, 32),
+		},
+	}
+	// AddrReplace is idempotent, the address will not be added twice when agent restarts
+	if err = netlink.AddrReplace(link, addr); err != nil {
+		return nil, fmt.Errorf("bind address %s to dummy device %s err: %v", ip, name, err)
+	}
+	if err = netlink.LinkSetUp(link); err != nil {
+		return nil, fmt.Errorf("set dummy device %s up err: %v", name, err)
+	}
+	return link, nil
+}
+
+// DeleteDummyDevice removes the dummy device created by EnsureDummyDevice
+func DeleteDummyDevice(name string) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			return nil
+		}
+		return fmt.Errorf("get link %s err: %v", name, err)
+	}
+	if _, ok := link.(*netlink.Dummy); !ok {
+		return fmt.Errorf("link %s is not a dummy device, type: %s", name, link.Type())
+	}
+	if err = netlink.LinkDel(link); err != nil {
+		return fmt.Errorf("delete dummy device %s err: %v", name, err)
+	}
+	klog.Infof("dummy device %s deleted", name)
+	return nil
+}
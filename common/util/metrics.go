@@ -0,0 +1,21 @@
+package util
+
+import (
+	"expvar"
+	"net"
+	"net/http"
+
+	"k8s.io/klog/v2"
+)
+
+// ServeMetrics serves the metrics published by expvar on ln at path /debug/vars,
+// until ln is closed
+func ServeMetrics(ln net.Listener) {
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	go func() {
+		if err := http.Serve(ln, mux); err != nil && !IsClosedNetworkError(err) {
+			klog.Errorf("serve metrics on %s err: %v", ln.Addr(), err)
+		}
+	}()
+}
@@ -1,16 +1,53 @@
 package util
 
 import (
+	"errors"
 	"fmt"
 	"net"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/selection"
+	"k8s.io/apimachinery/pkg/util/intstr"
 )
 
+// ProtocolAnnotation is the service annotation used to declare the l7 protocol of ports
+// that have neither an appProtocol nor a name. The value is either a protocol name
+// for all ports, e.g. "http", or a list of port:protocol pairs, e.g. "80:http,1883:mqtt".
+const ProtocolAnnotation = "edgemesh.kubeedge.io/protocol"
+
+// TrafficPolicyAnnotation is the service annotation used to keep the traffic on the node
+// it enters. "Local" only routes to the endpoints on the same node, it stands in for
+// spec.internalTrafficPolicy Local: the field comes with kubernetes 1.21, the vendored
+// k8s.io/api v0.19 lacks it and the typed informers drop it when decoding, so it can't
+// be read until the api is bumped. "PreferLocal" routes to the local endpoints if any,
+// otherwise falls back to remote ones.
+const TrafficPolicyAnnotation = "edgemesh.kubeedge.io/traffic-policy"
+
+const (
+	// TrafficPolicyLocal only routes to the local endpoints
+	TrafficPolicyLocal = "Local"
+	// TrafficPolicyPreferLocal prefers the local endpoints and falls back to remote ones
+	TrafficPolicyPreferLocal = "PreferLocal"
+)
+
+// GetNodeName returns the name of the node edgemesh runs on, from the env NODE_NAME
+// injected by the downward api, or the hostname
+func GetNodeName() string {
+	if name := os.Getenv("NODE_NAME"); name != "" {
+		return name
+	}
+	name, err := os.Hostname()
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(name)
+}
+
 // SplitServiceKey splits service name
 func SplitServiceKey(key string) (name, namespace string) {
 	sets := strings.Split(key, ".")
@@ -27,6 +64,45 @@ func SplitServiceKey(key string) (name, namespace string) {
 	return key, ns
 }
 
+// ProtoDuration converts a protobuf duration to time.Duration, 0 is returned if d is nil
+func ProtoDuration(d interface {
+	GetSeconds() int64
+	GetNanos() int32
+}) time.Duration {
+	return time.Duration(d.GetSeconds())*time.Second + time.Duration(d.GetNanos())
+}
+
+// ErrUnknownOption is returned by the setter of ParseOptions for an unknown key
+var ErrUnknownOption = errors.New("unknown option")
+
+// ParseOptions parses the comma separated key=value options of an annotation, e.g.
+// "qps=100,burst=200", set is called with the trimmed key and value of each option.
+// The errors are prefixed by kind, e.g. "invalid rate limit "qps=0": must be positive".
+func ParseOptions(value, kind string, set func(key, value string) error) error {
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		pair := strings.SplitN(item, "=", 2)
+		if len(pair) != 2 {
+			return fmt.Errorf("invalid %s %q", kind, item)
+		}
+		key := strings.TrimSpace(pair[0])
+		if err := set(key, strings.TrimSpace(pair[1])); err == ErrUnknownOption {
+			return fmt.Errorf("unknown %s %q", kind, key)
+		} else if err != nil {
+			return fmt.Errorf("invalid %s %q: %v", kind, item, err)
+		}
+	}
+	return nil
+}
+
+// IsClosedNetworkError returns true if err is caused by using a closed connection or listener
+func IsClosedNetworkError(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "use of closed network connection")
+}
+
 // GetInterfaceIP get net interface ipv4 address
 func GetInterfaceIP(name string) (net.IP, error) {
 	ifi, err := net.InterfaceByName(name)
@@ -51,3 +127,74 @@ func GetPodsSelector(svc *v1.Service) labels.Selector {
 	}
 	return selector
 }
+
+// namePrefixProtocols are the protocols a port name may declare by its prefix, following
+// the istio naming convention, e.g. "http-web" or "mqtt"
+var namePrefixProtocols = map[string]bool{
+	"grpc":  true,
+	"http":  true,
+	"http2": true,
+	"https": true,
+	"mongo": true,
+	"mqtt":  true,
+	"mysql": true,
+	"redis": true,
+	"tcp":   true,
+	"tls":   true,
+	"udp":   true,
+}
+
+// GetServicePortProtocol returns the l7 protocol name of a service port. It's resolved
+// from the appProtocol first, then the prefix of the port name if it's a known protocol,
+// and the annotation last, so ports named like "web" or "metrics-8080" fall through.
+func GetServicePortProtocol(svc *v1.Service, p *v1.ServicePort) string {
+	if p.AppProtocol != nil && *p.AppProtocol != "" {
+		return strings.ToLower(*p.AppProtocol)
+	}
+	if prefix := strings.ToLower(strings.Split(p.Name, "-")[0]); namePrefixProtocols[prefix] {
+		return prefix
+	}
+	value, ok := svc.Annotations[ProtocolAnnotation]
+	if !ok {
+		return ""
+	}
+	var protocol string
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		pair := strings.Split(item, ":")
+		switch len(pair) {
+		case 1:
+			// a protocol for all ports, but the one declared by port takes precedence
+			protocol = strings.ToLower(pair[0])
+		case 2:
+			if port, err := strconv.Atoi(strings.TrimSpace(pair[0])); err == nil && int32(port) == p.Port {
+				return strings.ToLower(strings.TrimSpace(pair[1]))
+			}
+		}
+	}
+	return protocol
+}
+
+// FindPort locates the container port for the given pod and service port,
+// a named targetPort is resolved by the container ports of the pod.
+func FindPort(pod *v1.Pod, svcPort *v1.ServicePort) (int, error) {
+	portName := svcPort.TargetPort
+	switch portName.Type {
+	case intstr.String:
+		name := portName.StrVal
+		for _, container := range pod.Spec.Containers {
+			for _, port := range container.Ports {
+				if port.Name == name && port.Protocol == svcPort.Protocol {
+					return int(port.ContainerPort), nil
+				}
+			}
+		}
+	case intstr.Int:
+		if portName.IntValue() == 0 {
+			// targetPort defaults to the same value as port
+			return int(svcPort.Port), nil
+		}
+		return portName.IntValue(), nil
+	}
+	return 0, fmt.Errorf("no suitable port for manifest: %s", pod.UID)
+}
@@ -0,0 +1,71 @@
+package util
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestParseOptions(t *testing.T) {
+	parse := func(value string) (map[string]int, error) {
+		options := make(map[string]int)
+		err := ParseOptions(value, "option", func(key, value string) error {
+			if key != "a" && key != "b" {
+				return ErrUnknownOption
+			}
+			n, err := strconv.Atoi(value)
+			if err == nil && n <= 0 {
+				err = fmt.Errorf("must be positive")
+			}
+			options[key] = n
+			return err
+		})
+		return options, err
+	}
+
+	options, err := parse(" a=1, ,b = 2,")
+	if err != nil || !reflect.DeepEqual(options, map[string]int{"a": 1, "b": 2}) {
+		t.Errorf("parse options = %v, %v", options, err)
+	}
+	for value, want := range map[string]string{
+		"a":       `invalid option "a"`,
+		"a=0":     `invalid option "a=0": must be positive`,
+		"a=1,c=1": `unknown option "c"`,
+	} {
+		if _, err = parse(value); err == nil || err.Error() != want {
+			t.Errorf("parse %q err = %v, want %s", value, err, want)
+		}
+	}
+}
+
+func TestGetServicePortProtocol(t *testing.T) {
+	grpc := "gRPC"
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{ProtocolAnnotation: "tcp,80:http,1883:mqtt"},
+		},
+	}
+	for _, c := range []struct {
+		port v1.ServicePort
+		want string
+	}{
+		{v1.ServicePort{Name: "web", Port: 9090, AppProtocol: &grpc}, "grpc"},
+		{v1.ServicePort{Name: "HTTP-web", Port: 1883}, "http"},
+		{v1.ServicePort{Name: "mqtt", Port: 80}, "mqtt"},
+		{v1.ServicePort{Name: "web", Port: 80}, "http"},
+		{v1.ServicePort{Name: "metrics-8080", Port: 1883}, "mqtt"},
+		{v1.ServicePort{Name: "web", Port: 8080}, "tcp"},
+		{v1.ServicePort{Port: 80}, "http"},
+	} {
+		if got := GetServicePortProtocol(svc, &c.port); got != c.want {
+			t.Errorf("protocol of port %s/%d = %q, want %q", c.port.Name, c.port.Port, got, c.want)
+		}
+	}
+	if got := GetServicePortProtocol(&v1.Service{}, &v1.ServicePort{Name: "web"}); got != "" {
+		t.Errorf("protocol of port web without annotation = %q, want empty", got)
+	}
+}